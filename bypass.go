@@ -0,0 +1,63 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Bypass hosts skip the proxy. They come from system_proxy.bypass_hosts in
+// settings.yaml and from a profile's bypass_hosts, use the OS syntax
+// (example.com, *.example.com, 10.0.0.0/8) and are written both to the OS
+// bypass list and to mitmproxy's ignore_hosts, so clients that talk to the
+// proxy directly are not intercepted either.
+
+// bypassHostsFor returns the controller-wide bypass hosts followed by the
+// profile's own, without duplicates.
+func bypassHostsFor(profile ServiceProfile) []string {
+	return mergeHostLists(appSettings.SystemProxy.BypassHosts, profile.BypassHosts)
+}
+
+// systemBypassHosts is the list written to the OS for the primary profile.
+func systemBypassHosts() []string {
+	profile, _ := getSelectedProfile()
+	return bypassHostsFor(profile)
+}
+
+func mergeHostLists(lists ...[]string) []string {
+	var merged []string
+	seen := map[string]bool{}
+	for _, list := range lists {
+		for _, host := range list {
+			host = strings.TrimSpace(host)
+			key := strings.ToLower(host)
+			if host == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			merged = append(merged, host)
+		}
+	}
+	return merged
+}
+
+// ignoreHostPattern converts a bypass entry into a mitmproxy ignore_hosts
+// regex, which is matched against "host:port". Network ranges and the
+// Windows "<local>" token have no regex equivalent and stay OS-only.
+func ignoreHostPattern(host string) (string, bool) {
+	if host == "<local>" || strings.Contains(host, "/") {
+		return "", false
+	}
+	quoted := regexp.QuoteMeta(host)
+	quoted = strings.ReplaceAll(quoted, `\*`, ".*")
+	return "^" + quoted + `(:\d+)?$`, true
+}
+
+func ignoreHostsArgs(hosts []string) []string {
+	var args []string
+	for _, host := range hosts {
+		if pattern, ok := ignoreHostPattern(host); ok {
+			args = append(args, "--set", "ignore_hosts="+pattern)
+		}
+	}
+	return args
+}
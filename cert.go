@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// The controller creates mitmproxy's CA itself, so it can be installed
+// before mitmproxy has ever run. The files match what mitmproxy writes to its
+// confdir on first start; mitmproxy only creates a CA when mitmproxy-ca.pem
+// is missing, so it uses this one unchanged.
+
+const (
+	mitmCABasename      = "mitmproxy"
+	defaultCAKeyType    = "rsa-2048"
+	defaultCAValidity   = 3650
+	defaultCACommonName = "mitmproxy"
+	defaultCAOrgName    = "mitmproxy"
+	caBackdate          = 48 * time.Hour
+	caFileModeSecret    = 0600
+	caFileModePublic    = 0644
+)
+
+// caKeyTypes are the supported CA key algorithms. mitmproxy also signs leaf
+// certificates with the CA key, so every type here must be usable for both.
+var caKeyTypes = []string{"rsa-2048", "rsa-3072", "rsa-4096", "ecdsa-p256", "ecdsa-p384"}
+
+// mitmCAFileNames are the files of a CA in mitmproxy's confdir, the one
+// mitmproxy loads first.
+var mitmCAFileNames = []string{
+	mitmCABasename + "-ca.pem",
+	mitmCABasename + "-ca.p12",
+	mitmCABasename + "-ca-cert.pem",
+	mitmCABasename + "-ca-cert.cer",
+	mitmCABasename + "-ca-cert.p12",
+	mitmCABasename + "-dhparam.pem",
+}
+
+// caSettings is the "ca:" block of settings.yaml.
+type caSettings struct {
+	KeyType      string `yaml:"key_type"`
+	ValidityDays int    `yaml:"validity_days"`
+	CommonName   string `yaml:"common_name"`
+	Organization string `yaml:"organization"`
+	// ExpiryWarningDays is how long before expiry the tray warns.
+	ExpiryWarningDays int `yaml:"expiry_warning_days"`
+	// ExportTimeoutMinutes is how long "Expose CA for Devices" waits for
+	// a download.
+	ExportTimeoutMinutes int `yaml:"export_timeout_minutes"`
+	// TrustTargets are runtime CA lists beyond the OS store.
+	TrustTargets []trustTargetSettings `yaml:"trust_targets"`
+}
+
+// caOptions describes a CA to generate.
+type caOptions struct {
+	KeyType      string
+	ValidityDays int
+	CommonName   string
+	Organization string
+}
+
+// mitmDHParams are the RFC 7919 ffdhe4096 parameters, written as
+// mitmproxy-dhparam.pem like mitmproxy does with its built-in ones.
+const mitmDHParams = `-----BEGIN DH PARAMETERS-----
+MIICCAKCAgEA//////////+t+FRYortKmq/cViAnPTzx2LnFg84tNpWp4TZBFGQz
++8yTnc4kmz75fS/jY2MMddj2gbICrsRhetPfHtXV/WVhJDP1H18GbtCFY2VVPe0a
+87VXE15/V8k1mE8McODmi3fipona8+/och3xWKE2rec1MKzKT0g6eXq8CrGCsyT7
+YdEIqUuyyOP7uWrat2DX9GgdT0Kj3jlN9K5W7edjcrsZCwenyO4KbXCeAvzhzffi
+7MA0BM0oNC9hkXL+nOmFg/+OTxIy7vKBg8P+OxtMb61zO7X8vC7CIAXFjvGDfRaD
+ssbzSibBsu/6iGtCOGEfz9zeNVs7ZRkDW7w09N75nAI4YbRvydbmyQd62R0mkff3
+7lmMsPrBhtkcrv4TCYUTknC0EwyTvEN5RPT9RFLi103TZPLiHnH1S/9croKrnJ32
+nuhtK8UiNjoNq8Uhl5sN6todv5pC1cRITgq80Gv6U93vPBsg7j/VnXwl5B0rZp4e
+8W5vUsMWTfT7eTDp5OWIV7asfV9C1p9tGHdjzx1VA0AEh/VbpX4xzHpxNciG77Qx
+iu1qHgEtnmgyqQdgCpGBMMRtx3j5ca0AOAkpmaMzy4t6Gh25PXFAADwqTs6p+Y0K
+zAqCkc3OyX3Pjsm1Wn+IpGtNtahR9EGC4caKAH5eZV9q//////////8CAQI=
+-----END DH PARAMETERS-----
+`
+
+// caOptionsFromSettings returns the options from settings.yaml with
+// defaults filled in.
+func caOptionsFromSettings() caOptions {
+	s := appSettings.CA
+	opts := caOptions{
+		KeyType:      strings.ToLower(strings.TrimSpace(s.KeyType)),
+		ValidityDays: s.ValidityDays,
+		CommonName:   strings.TrimSpace(s.CommonName),
+		Organization: strings.TrimSpace(s.Organization),
+	}
+	if opts.KeyType == "" {
+		opts.KeyType = defaultCAKeyType
+	}
+	if opts.ValidityDays <= 0 {
+		opts.ValidityDays = defaultCAValidity
+	}
+	if opts.CommonName == "" {
+		opts.CommonName = defaultCACommonName
+	}
+	if opts.Organization == "" {
+		opts.Organization = defaultCAOrgName
+	}
+	return opts
+}
+
+// mitmCAKeyPath is the file mitmproxy loads the active CA from: the private
+// key followed by the certificate.
+func mitmCAKeyPath() string {
+	return filepath.Join(activeConfdir(), mitmCABasename+"-ca.pem")
+}
+
+// ensureMitmCA creates the active CA unless it exists.
+func ensureMitmCA() (bool, error) {
+	return ensureConfdirCA(activeConfdir())
+}
+
+// ensureConfdirCA creates the CA with the settings.yaml options unless the
+// confdir already has one. It reports whether it created one.
+func ensureConfdirCA(confdir string) (bool, error) {
+	if _, err := os.Stat(filepath.Join(confdir, mitmCABasename+"-ca.pem")); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	if err := ensureConfdir(confdir); err != nil {
+		return false, err
+	}
+	if err := generateMitmCA(confdir, caOptionsFromSettings()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// generateMitmCA writes a new CA in mitmproxy's layout to confdir:
+//
+//	mitmproxy-ca.pem        key + certificate (what mitmproxy loads)
+//	mitmproxy-ca.p12        key + certificate, PKCS#12
+//	mitmproxy-ca-cert.pem   certificate
+//	mitmproxy-ca-cert.cer   certificate (same PEM, for Android)
+//	mitmproxy-ca-cert.p12   certificate, PKCS#12 (for Windows)
+//	mitmproxy-dhparam.pem   DH parameters
+//
+// Files are written under temporary names first, so an error never leaves
+// a partial CA behind.
+func generateMitmCA(confdir string, opts caOptions) error {
+	key, err := newCAKey(opts.KeyType)
+	if err != nil {
+		return err
+	}
+	cert, err := newCACertificate(key, opts)
+	if err != nil {
+		return err
+	}
+
+	keyPEM, err := marshalCAKeyPEM(key)
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	keyP12, err := pkcs12.Passwordless.Encode(key, cert, nil, "")
+	if err != nil {
+		return fmt.Errorf("failed to encode PKCS#12: %w", err)
+	}
+	certP12, err := pkcs12.Passwordless.EncodeTrustStoreEntries([]pkcs12.TrustStoreEntry{{Cert: cert, FriendlyName: mitmCABasename}}, "")
+	if err != nil {
+		return fmt.Errorf("failed to encode PKCS#12: %w", err)
+	}
+
+	contents := map[string][]byte{
+		mitmCABasename + "-ca.pem":      append(keyPEM, certPEM...),
+		mitmCABasename + "-ca.p12":      keyP12,
+		mitmCABasename + "-ca-cert.pem": certPEM,
+		mitmCABasename + "-ca-cert.cer": certPEM,
+		mitmCABasename + "-ca-cert.p12": certP12,
+		mitmCABasename + "-dhparam.pem": []byte(mitmDHParams),
+	}
+
+	if err := os.MkdirAll(confdir, 0755); err != nil {
+		return err
+	}
+	var written []string
+	cleanup := func() {
+		for _, path := range written {
+			os.Remove(path)
+		}
+	}
+	for _, name := range mitmCAFileNames {
+		mode := os.FileMode(caFileModePublic)
+		if strings.HasPrefix(name, mitmCABasename+"-ca.") {
+			mode = caFileModeSecret
+		}
+		tmp := filepath.Join(confdir, name+".tmp")
+		if err := os.WriteFile(tmp, contents[name], mode); err != nil {
+			cleanup()
+			return err
+		}
+		written = append(written, tmp)
+	}
+	// mitmproxy-ca.pem goes last: it is what marks the CA as present.
+	for i := len(mitmCAFileNames) - 1; i >= 0; i-- {
+		path := filepath.Join(confdir, mitmCAFileNames[i])
+		if err := os.Rename(path+".tmp", path); err != nil {
+			cleanup()
+			return err
+		}
+	}
+	return nil
+}
+
+func newCAKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "rsa-2048":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "rsa-3072":
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case "rsa-4096":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case "ecdsa-p256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ecdsa-p384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	}
+	return nil, fmt.Errorf("unknown CA key type %q (use %s)", keyType, strings.Join(caKeyTypes, ", "))
+}
+
+// newCACertificate issues the self-signed CA certificate with the
+// extensions mitmproxy gives its own. It is backdated two days against
+// clients with a slow clock.
+func newCACertificate(key crypto.Signer, opts caOptions) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	keyID := sha1.Sum(publicDER)
+
+	now := time.Now()
+	name := pkix.Name{CommonName: opts.CommonName, Organization: []string{opts.Organization}}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               name,
+		Issuer:                name,
+		NotBefore:             now.Add(-caBackdate),
+		NotAfter:              now.AddDate(0, 0, opts.ValidityDays),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+			x509.ExtKeyUsageEmailProtection,
+			x509.ExtKeyUsageTimeStamping,
+		},
+		SubjectKeyId: keyID[:],
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	return x509.ParseCertificate(der)
+}
+
+// marshalCAKeyPEM encodes the key in the traditional OpenSSL formats
+// mitmproxy writes (RSA PRIVATE KEY, EC PRIVATE KEY).
+func marshalCAKeyPEM(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}), nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	}
+	return nil, fmt.Errorf("unsupported CA key %T", key)
+}
+
+// The installed CA is identified by the SHA-256 fingerprint of the
+// certificate in mitmproxy-ca-cert.pem, never by name: a CA left over from an
+// older confdir has the same name but does not sign what mitmproxy serves.
+
+// caTrustState compares the CA on disk with the system trust store.
+type caTrustState struct {
+	Disk      *x509.Certificate
+	Installed bool
+	// Stale are other mitmproxy CAs in the store, e.g. from a previous
+	// confdir; with Installed false they are what browsers trust instead.
+	Stale []*x509.Certificate
+	// Browsers are the NSS databases of browsers that ignore the system
+	// store (Firefox, and Chromium on Linux).
+	Browsers []browserTrust
+}
+
+// mismatch reports whether the store holds a mitmproxy CA, but not ours.
+func (s caTrustState) mismatch() bool {
+	return !s.Installed && len(s.Stale) > 0
+}
+
+// untrustedBrowsers returns the browser profiles that do not trust the CA
+// on disk for SSL.
+func (s caTrustState) untrustedBrowsers() []browserTrust {
+	var list []browserTrust
+	for _, b := range s.Browsers {
+		if !b.Trusted {
+			list = append(list, b)
+		}
+	}
+	return list
+}
+
+// browserTrust is the CA's state in one browser profile's NSS database.
+type browserTrust struct {
+	Browser   string `json:"browser"`
+	Profile   string `json:"profile,omitempty"`
+	Path      string `json:"path"`
+	Installed bool   `json:"installed"`
+	Trusted   bool   `json:"trusted"`
+	Error     string `json:"error,omitempty"`
+	// nickname is the one the CA on disk is stored under, staleNicknames
+	// those of other mitmproxy CAs in the database.
+	nickname       string
+	staleNicknames []string
+}
+
+func (b browserTrust) label() string {
+	if b.Profile == "" {
+		return b.Browser
+	}
+	return fmt.Sprintf("%s (%s)", b.Browser, b.Profile)
+}
+
+func (b browserTrust) statusLabel() string {
+	switch {
+	case b.Error != "":
+		return b.Error
+	case b.Trusted:
+		return "✓ Trusted"
+	case b.Installed:
+		return "installed, not trusted"
+	}
+	return "not installed"
+}
+
+func loadMitmCACert() (*x509.Certificate, error) {
+	content, err := os.ReadFile(getMitmCACertPEMPath())
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseCertificatesPEM(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", getMitmCACertPEMPath(), err)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s contains no certificate", getMitmCACertPEMPath())
+	}
+	return certs[0], nil
+}
+
+func parseCertificatesPEM(content []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// certFingerprint is the SHA-256 fingerprint in the usual AB:CD:... form.
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return formatFingerprint(sum[:])
+}
+
+// certThumbprint is the SHA-1 hash Windows and the macOS keychain use to
+// address a certificate.
+func certThumbprint(cert *x509.Certificate) string {
+	sum := sha1.Sum(cert.Raw)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func formatFingerprint(sum []byte) string {
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// isControllerCA reports whether a certificate from a trust store is a
+// mitmproxy CA: self-signed, and with the subject of the CA on disk or
+// mitmproxy's default one.
+func isControllerCA(cert, disk *x509.Certificate) bool {
+	if !cert.IsCA || !bytes.Equal(cert.RawSubject, cert.RawIssuer) {
+		return false
+	}
+	if disk != nil && bytes.Equal(cert.RawSubject, disk.RawSubject) {
+		return true
+	}
+	return cert.Subject.CommonName == defaultCACommonName && containsString(cert.Subject.Organization, defaultCAOrgName)
+}
+
+// readCATrustState looks up the CA on disk in the trust store. Without a CA
+// on disk everything in the store counts as stale.
+func readCATrustState() (caTrustState, error) {
+	var state caTrustState
+	disk, err := loadMitmCACert()
+	if err != nil && !os.IsNotExist(err) {
+		return state, err
+	}
+	state.Disk = disk
+
+	installed, err := installedControllerCAs(disk)
+	if err != nil {
+		return state, err
+	}
+	for _, cert := range installed {
+		if disk != nil && bytes.Equal(cert.Raw, disk.Raw) {
+			state.Installed = true
+		} else if !belongsToOtherConfdir(cert) {
+			state.Stale = append(state.Stale, cert)
+		}
+	}
+	state.Browsers = readBrowserTrust(disk)
+	return state, nil
+}
+
+func isCertInstalled() bool {
+	state, err := readCATrustState()
+	return err == nil && state.Installed
+}
+
+func isCertTrusted() bool {
+	state, err := readCATrustState()
+	return err == nil && caTrustedForSSL(state)
+}
+
+// caTrustRefreshInterval is how often the tray reads the trust store again
+// on its own. CA actions in the tray refresh it right away.
+const caTrustRefreshInterval = 60 * time.Second
+
+// caTrustCache is the trust state the tray shows. Reading it runs security,
+// PowerShell or certutil once per store and browser profile, too slow for
+// every status update.
+var caTrustCache struct {
+	mu     sync.Mutex
+	key    string
+	state  caTrustState
+	err    error
+	readAt time.Time
+}
+
+// cachedCATrustState returns the trust state for the status display. It is
+// read again after caTrustRefreshInterval, after invalidateCATrustState, or
+// when the CA on disk or a browser database changed: a rotation, a profile
+// with another confdir, a new browser profile.
+func cachedCATrustState() (caTrustState, error) {
+	caTrustCache.mu.Lock()
+	defer caTrustCache.mu.Unlock()
+
+	key := caTrustCacheKey()
+	if key != caTrustCache.key || time.Since(caTrustCache.readAt) >= caTrustRefreshInterval {
+		state, err := readCATrustState()
+		caTrustCache.key, caTrustCache.state, caTrustCache.err, caTrustCache.readAt = key, state, err, time.Now()
+	}
+	return caTrustCache.state, caTrustCache.err
+}
+
+// invalidateCATrustState makes the next cachedCATrustState read the store.
+func invalidateCATrustState() {
+	caTrustCache.mu.Lock()
+	defer caTrustCache.mu.Unlock()
+	caTrustCache.readAt = time.Time{}
+}
+
+// caTrustCacheKey identifies the CA on disk and the browser databases by
+// path, size and modification time.
+func caTrustCacheKey() string {
+	paths := []string{getMitmCACertPEMPath()}
+	for _, b := range findNSSDatabases() {
+		paths = append(paths, filepath.Join(b.Path, "cert9.db"))
+	}
+	var key strings.Builder
+	for _, path := range paths {
+		key.WriteString(path)
+		if info, err := os.Stat(path); err == nil {
+			fmt.Fprintf(&key, "|%d|%d", info.Size(), info.ModTime().UnixNano())
+		}
+		key.WriteString("\n")
+	}
+	return key.String()
+}
+
+// removeCACertificate removes the CA on disk and stale mitmproxy CAs from
+// the trust store and browser databases, each by fingerprint.
+func removeCACertificate() string {
+	state, err := readCATrustState()
+	if err != nil {
+		return fmt.Sprintf("Failed to read the certificate store: %v", err)
+	}
+	certs := state.Stale
+	if state.Installed {
+		certs = append([]*x509.Certificate{state.Disk}, certs...)
+	}
+	var browsers []string
+	for _, b := range state.Browsers {
+		if b.Installed || len(b.staleNicknames) > 0 {
+			browsers = append(browsers, b.label())
+		}
+	}
+	if len(certs) == 0 && len(browsers) == 0 {
+		return "No mitmproxy CA certificate is installed"
+	}
+
+	if len(certs) > 0 {
+		if err := removeStoreCertificates(certs); err != nil {
+			return fmt.Sprintf("Failed to remove certificate: %v", err)
+		}
+	}
+	if err := removeBrowserCAs(state.Browsers); err != nil {
+		return fmt.Sprintf("Failed to remove certificate from browsers: %v", err)
+	}
+
+	var result string
+	switch {
+	case len(certs) == 0:
+		result = "CA certificate removed from " + strings.Join(browsers, ", ")
+	case len(certs) == 1:
+		result = "CA certificate removed"
+	default:
+		result = fmt.Sprintf("%d CA certificates removed", len(certs))
+	}
+	if len(certs) > 0 && len(browsers) > 0 {
+		result += " (also from " + strings.Join(browsers, ", ") + ")"
+	}
+	return result + ". Restart your browser."
+}
@@ -3,79 +3,136 @@
 package main
 
 import (
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"strings"
 )
 
-func getMitmproxyCertPath() string {
-	home, _ := os.UserHomeDir()
-	return filepath.Join(home, ".mitmproxy", "mitmproxy-ca-cert.pem")
-}
+const systemKeychain = "/Library/Keychains/System.keychain"
 
-func isCertInstalled() bool {
-	out, err := exec.Command("security", "find-certificate", "-c", "mitmproxy", "/Library/Keychains/System.keychain").Output()
-	return err == nil && len(out) > 0
-}
+// installedControllerCAs returns the mitmproxy CAs in the System keychain.
+// find-certificate only filters by name; isControllerCA decides.
+func installedControllerCAs(disk *x509.Certificate) ([]*x509.Certificate, error) {
+	names := []string{defaultCACommonName}
+	if disk != nil && disk.Subject.CommonName != defaultCACommonName {
+		names = append(names, disk.Subject.CommonName)
+	}
 
-func isCertTrusted() bool {
-	cmd := exec.Command("security", "find-certificate", "-c", "mitmproxy", "-p", "/Library/Keychains/System.keychain")
-	certPem, err := cmd.Output()
-	if err != nil || len(certPem) == 0 {
-		return false
+	var found []*x509.Certificate
+	seen := map[string]bool{}
+	for _, name := range names {
+		out, err := exec.Command("security", "find-certificate", "-a", "-p", "-c", name, systemKeychain).Output()
+		if err != nil {
+			// No match is reported as an error.
+			continue
+		}
+		certs, err := parseCertificatesPEM(out)
+		if err != nil {
+			return nil, err
+		}
+		for _, cert := range certs {
+			if fp := certFingerprint(cert); !seen[fp] && isControllerCA(cert, disk) {
+				seen[fp] = true
+				found = append(found, cert)
+			}
+		}
 	}
+	return found, nil
+}
 
-	tmpFile, err := os.CreateTemp("", "mitmproxy-cert-*.pem")
-	if err != nil {
+// caTrustedForSSL verifies the CA on disk, not whatever matches by name,
+// for the SSL policy.
+func caTrustedForSSL(state caTrustState) bool {
+	if !state.Installed {
 		return false
 	}
-	defer os.Remove(tmpFile.Name())
-	tmpFile.Write(certPem)
-	tmpFile.Close()
+	return exec.Command("security", "verify-cert", "-c", getMitmCACertPEMPath(), "-p", "ssl").Run() == nil
+}
 
-	verifyCmd := exec.Command("security", "verify-cert", "-c", tmpFile.Name(), "-p", "ssl")
-	return verifyCmd.Run() == nil
+// deleteCertificatesScript removes certificates from the System keychain
+// by SHA-1 hash, together with their trust settings.
+func deleteCertificatesScript(certs []*x509.Certificate) (string, func(), error) {
+	var script strings.Builder
+	var files []string
+	cleanup := func() {
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}
+	for _, cert := range certs {
+		tmpFile, err := os.CreateTemp("", "mitmproxy-cert-*.pem")
+		if err != nil {
+			cleanup()
+			return "", nil, err
+		}
+		files = append(files, tmpFile.Name())
+		_ = pem.Encode(tmpFile, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		tmpFile.Close()
+		fmt.Fprintf(&script, "security remove-trusted-cert -d '%s' 2>/dev/null || true\n", tmpFile.Name())
+		fmt.Fprintf(&script, "security delete-certificate -Z %s %s\n", certThumbprint(cert), systemKeychain)
+	}
+	return script.String(), cleanup, nil
 }
 
 func installCACertificate() string {
-	certPath := getMitmproxyCertPath()
+	certPath := getMitmCACertPEMPath()
+
+	if _, err := ensureMitmCA(); err != nil {
+		return fmt.Sprintf("Failed to create CA certificate: %v", err)
+	}
+	state, err := readCATrustState()
+	if err != nil {
+		return fmt.Sprintf("Failed to read the certificate store: %v", err)
+	}
 
-	if _, err := os.Stat(certPath); os.IsNotExist(err) {
-		return "CA cert not found. Start mitmproxy first to generate it."
+	// Only browser profiles are missing: no administrator prompt.
+	if state.Installed && len(state.Stale) == 0 && caTrustedForSSL(state) {
+		return "CA certificate installed & trusted." + browserInstallSuffix() + " Restart your browser."
 	}
 
 	// Three-step process:
-	// 1. Delete all existing mitmproxy certs from System keychain
+	// 1. Delete stale mitmproxy CAs (and a previous import of ours) by hash
 	// 2. Import cert to System keychain
 	// 3. Set trust settings with SSL policy
+	stale := state.Stale
+	if state.Installed {
+		stale = append(stale, state.Disk)
+	}
+	deleteScript, cleanup, err := deleteCertificatesScript(stale)
+	if err != nil {
+		return fmt.Sprintf("Failed to install certificate: %v", err)
+	}
+	defer cleanup()
+
 	script := fmt.Sprintf(`do shell script "
-		# Delete all existing mitmproxy certs
-		while security delete-certificate -c mitmproxy /Library/Keychains/System.keychain 2>/dev/null; do :; done
-		
+		# Delete stale mitmproxy certs
+		%s
 		# Import the certificate to System keychain
-		security import '%s' -k /Library/Keychains/System.keychain -t cert
+		security import '%s' -k %s -t cert
 		
 		# Set trust settings with SSL policy (like devcert)
-		security add-trusted-cert -d -r trustRoot -p ssl -p basic -k /Library/Keychains/System.keychain '%s'
+		security add-trusted-cert -d -r trustRoot -p ssl -p basic -k %s '%s'
 		
 		# Refresh trust daemon
 		killall -HUP trustd 2>/dev/null || true
-	" with administrator privileges`, certPath, certPath)
+	" with administrator privileges`, deleteScript, certPath, systemKeychain, systemKeychain, certPath)
 
 	cmd := exec.Command("osascript", "-e", script)
 	if err := cmd.Run(); err != nil {
 		return fmt.Sprintf("Failed to install certificate: %v", err)
 	}
 
-	return "CA certificate installed & trusted. Restart your browser."
+	return "CA certificate installed & trusted." + browserInstallSuffix() + " Restart your browser."
 }
 
 func trustCACertificate() string {
-	certPath := getMitmproxyCertPath()
+	certPath := getMitmCACertPEMPath()
 
-	if _, err := os.Stat(certPath); os.IsNotExist(err) {
-		return "CA cert not found. Start mitmproxy first to generate it."
+	if _, err := ensureMitmCA(); err != nil {
+		return fmt.Sprintf("Failed to create CA certificate: %v", err)
 	}
 
 	// Apply trust settings to already-installed certificate
@@ -92,26 +149,20 @@ func trustCACertificate() string {
 		return fmt.Sprintf("Failed to trust certificate: %v", err)
 	}
 
-	return "CA certificate is now trusted. Restart your browser."
+	return "CA certificate is now trusted." + browserInstallSuffix() + " Restart your browser."
 }
 
-func removeCACertificate() string {
-	// Remove trust settings and delete certificate from System keychain
-	script := `do shell script "
-		# Remove trust settings
-		security remove-trusted-cert -d /Library/Keychains/System.keychain 2>/dev/null || true
-		
-		# Delete all mitmproxy certs from System keychain
-		while security delete-certificate -c mitmproxy /Library/Keychains/System.keychain 2>/dev/null; do :; done
-		
-		# Refresh trust daemon
-		killall -HUP trustd 2>/dev/null || true
-	" with administrator privileges`
-
-	cmd := exec.Command("osascript", "-e", script)
-	if err := cmd.Run(); err != nil {
-		return fmt.Sprintf("Failed to remove certificate: %v", err)
+func removeStoreCertificates(certs []*x509.Certificate) error {
+	deleteScript, cleanup, err := deleteCertificatesScript(certs)
+	if err != nil {
+		return err
 	}
+	defer cleanup()
 
-	return "CA certificate removed. Restart your browser."
+	script := fmt.Sprintf(`do shell script "
+		%s
+		# Refresh trust daemon
+		killall -HUP trustd 2>/dev/null || true
+	" with administrator privileges`, deleteScript)
+	return exec.Command("osascript", "-e", script).Run()
 }
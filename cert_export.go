@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"rsc.io/qr"
+)
+
+// Phones and other machines get the CA from a short-lived HTTP server on
+// the LAN address: the URL carries a random token, the server stops after
+// the first certificate download or a timeout, and nothing else is served.
+
+const (
+	defaultCAExportTimeout = 10 * time.Minute
+	caExportQRFile         = "ca-export.png"
+)
+
+// caExportFile is one download: the PEM certificate, the DER one that iOS
+// and Windows expect in a .cer, or the iOS/macOS configuration profile.
+type caExportFile struct {
+	name        string
+	contentType string
+	content     []byte
+}
+
+// caExport is a running export server.
+type caExport struct {
+	URL         string
+	Confdir     string
+	Fingerprint string
+	ExpiresAt   time.Time
+
+	prefix   string
+	files    []caExportFile
+	server   *http.Server
+	timer    *time.Timer
+	onDone   func(reason string)
+	stopOnce sync.Once
+	done     chan struct{}
+	reason   string
+}
+
+// caExportTimeout is how long an export waits for a download.
+func caExportTimeout() time.Duration {
+	if minutes := appSettings.CA.ExportTimeoutMinutes; minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return defaultCAExportTimeout
+}
+
+// startCAExport serves the CA of a confdir on the LAN address until the
+// first download or the timeout. onDone, if set, is called once with the
+// reason the server stopped.
+func startCAExport(confdir string, timeout time.Duration, onDone func(reason string)) (*caExport, error) {
+	content, err := os.ReadFile(caCertPEMPath(confdir))
+	if err != nil {
+		return nil, fmt.Errorf("CA not found at %s", caCertPEMPath(confdir))
+	}
+	certs, err := parseCertificatesPEM(content)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate in %s", caCertPEMPath(confdir))
+	}
+	cert := certs[0]
+
+	host := lanAddress()
+	if host == proxyHost {
+		return nil, fmt.Errorf("no LAN address found; join the network the device is on")
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", host, err)
+	}
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	prefix := "/" + hex.EncodeToString(token) + "/"
+
+	e := &caExport{
+		URL:         "http://" + listener.Addr().String() + prefix,
+		Confdir:     confdir,
+		Fingerprint: certFingerprint(cert),
+		ExpiresAt:   time.Now().Add(timeout),
+		prefix:      prefix,
+		onDone:      onDone,
+		done:        make(chan struct{}),
+		files: []caExportFile{
+			{mitmCABasename + "-ca-cert.pem", "application/x-x509-ca-cert", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})},
+			{mitmCABasename + "-ca-cert.cer", "application/x-x509-ca-cert", cert.Raw},
+			{mitmCABasename + "-ca.mobileconfig", "application/x-apple-aspen-config", caMobileConfig(cert, confdirName(confdir))},
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(prefix, e.handleIndex)
+	for _, f := range e.files {
+		mux.HandleFunc(prefix+f.name, e.handleFile(f))
+	}
+	e.server = &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	e.timer = time.AfterFunc(timeout, func() { e.stop("timed out") })
+	go func() {
+		_ = e.server.Serve(listener)
+	}()
+	return e, nil
+}
+
+// stop shuts the server down after responses in flight are written.
+func (e *caExport) stop(reason string) {
+	e.stopOnce.Do(func() {
+		e.reason = reason
+		e.timer.Stop()
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = e.server.Shutdown(ctx)
+			close(e.done)
+			if e.onDone != nil {
+				e.onDone(reason)
+			}
+		}()
+	})
+}
+
+// wait blocks until the server stopped and returns why.
+func (e *caExport) wait() string {
+	<-e.done
+	return e.reason
+}
+
+func (e *caExport) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != e.prefix {
+		http.NotFound(w, r)
+		return
+	}
+	var links strings.Builder
+	for _, f := range e.files {
+		fmt.Fprintf(&links, "<li><a href=\"%s\">%s</a></li>\n", f.name, f.name)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html><head><meta name="viewport" content="width=device-width"><title>mitmproxy CA</title></head>
+<body style="font-family: sans-serif">
+<h1>mitmproxy CA</h1>
+<p>SHA-256 <code>%s</code></p>
+<ul>
+%s</ul>
+<p>iOS: open the .mobileconfig, install it in Settings, then enable it under General &rsaquo; About &rsaquo; Certificate Trust Settings.<br>
+Android: download the .cer and install it under Settings &rsaquo; Security &rsaquo; Encryption &amp; credentials &rsaquo; Install a certificate &rsaquo; CA certificate.</p>
+<p>This page stops after the first download.</p>
+</body></html>
+`, html.EscapeString(e.Fingerprint), links.String())
+}
+
+// handleFile serves one download and stops the server once it is written.
+func (e *caExport) handleFile(f caExportFile) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", f.contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", f.name))
+		w.Header().Set("Cache-Control", "no-store")
+		if _, err := w.Write(f.content); err != nil {
+			return
+		}
+		client, _, _ := net.SplitHostPort(r.RemoteAddr)
+		e.stop(fmt.Sprintf("%s downloaded by %s", f.name, client))
+	}
+}
+
+// writeQRPNG writes the URL as a QR code image.
+func (e *caExport) writeQRPNG(path string) error {
+	code, err := qr.Encode(e.URL, qr.L)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, code.PNG(), 0600)
+}
+
+// caMobileConfig is a configuration profile with the CA as a root
+// certificate payload. The UUIDs derive from the fingerprint, so installing
+// the profile of the same CA again replaces it rather than adding a copy.
+func caMobileConfig(cert *x509.Certificate, confdir string) []byte {
+	sum := sha256.Sum256(cert.Raw)
+	uuid := func(salt byte) string {
+		b := sha256.Sum256(append(sum[:], salt))
+		b[6] = b[6]&0x0f | 0x50
+		b[8] = b[8]&0x3f | 0x80
+		return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	}
+	id := "mitmproxy-controller.ca." + strings.ToLower(hex.EncodeToString(sum[:8]))
+	name := html.EscapeString(cert.Subject.CommonName)
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>%s-ca-cert.cer</string>
+			<key>PayloadContent</key>
+			<data>%s</data>
+			<key>PayloadDescription</key>
+			<string>Adds the mitmproxy CA as a root certificate</string>
+			<key>PayloadDisplayName</key>
+			<string>%s</string>
+			<key>PayloadIdentifier</key>
+			<string>%s.cert</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>%s</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>mitmproxy CA (%s)</string>
+	<key>PayloadIdentifier</key>
+	<string>%s</string>
+	<key>PayloadRemovalDisallowed</key>
+	<false/>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>%s</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`, mitmCABasename, base64.StdEncoding.EncodeToString(cert.Raw), name, id, uuid(1), html.EscapeString(confdir), id, uuid(2)))
+}
+
+// caExportCurrent is the export started from the tray, nil when none runs.
+// Only the tray loop touches it.
+var caExportCurrent *caExport
+
+// caExportDoneC tells the tray loop that its export stopped.
+var caExportDoneC = make(chan string, 1)
+
+// toggleCAExportFromTray starts an export of the selected profile's CA and
+// opens its QR code, or stops the running one.
+func toggleCAExportFromTray() string {
+	if caExportCurrent != nil {
+		caExportCurrent.stop("stopped")
+		return "Stopping CA export…"
+	}
+	if _, err := ensureMitmCA(); err != nil {
+		return fmt.Sprintf("Failed to create CA certificate: %v", err)
+	}
+	export, err := startCAExport(activeConfdir(), caExportTimeout(), func(reason string) {
+		caExportDoneC <- reason
+	})
+	if err != nil {
+		return fmt.Sprintf("Failed to expose CA: %v", err)
+	}
+	caExportCurrent = export
+
+	qrPath := filepath.Join(getControllerDataDirectory(), caExportQRFile)
+	if err := os.MkdirAll(filepath.Dir(qrPath), 0755); err == nil && export.writeQRPNG(qrPath) == nil {
+		_ = openFile(qrPath)
+	}
+	return fmt.Sprintf("CA at %s until %s (stops after the first download)", export.URL, export.ExpiresAt.Format("15:04"))
+}
+
+// caExportMenuTitle is the title of the export menu item.
+func caExportMenuTitle() string {
+	if caExportCurrent == nil {
+		return "Expose CA for Devices…"
+	}
+	return fmt.Sprintf("Stop Exposing CA (until %s)", caExportCurrent.ExpiresAt.Format("15:04"))
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	defaultCAExpiryWarningDays = 30
+	// caMinRSABits is the smallest RSA key browsers still accept.
+	caMinRSABits = 2048
+)
+
+// caHealth is the state of the mitmproxy CA as shown in the tray and by
+// `cert status`. Warnings are problems worth flagging; a CA that is simply
+// not installed yet is unhealthy without being one. Healthy also requires
+// every browser profile with its own NSS database to trust the CA.
+type caHealth struct {
+	Confdir               string         `json:"confdir"`
+	Path                  string         `json:"path"`
+	Present               bool           `json:"present"`
+	Subject               string         `json:"subject,omitempty"`
+	Fingerprint           string         `json:"fingerprint,omitempty"`
+	NotBefore             *time.Time     `json:"not_before,omitempty"`
+	NotAfter              *time.Time     `json:"not_after,omitempty"`
+	DaysLeft              int            `json:"days_left"`
+	KeyAlgorithm          string         `json:"key_algorithm,omitempty"`
+	KeySize               int            `json:"key_size,omitempty"`
+	Installed             bool           `json:"installed"`
+	InstalledFingerprints []string       `json:"installed_fingerprints"`
+	FingerprintMatch      bool           `json:"fingerprint_match"`
+	TrustedForSSL         bool           `json:"trusted_for_ssl"`
+	Browsers              []browserTrust `json:"browsers"`
+	// Targets are only checked by `cert status`; keytool is too slow for
+	// every tray poll.
+	Targets  []trustTargetStatus `json:"targets,omitempty"`
+	Healthy  bool                `json:"healthy"`
+	Warnings []string            `json:"warnings"`
+	// Issues holds the kind of every warning, in the same order.
+	Issues []caIssue `json:"-"`
+}
+
+type caIssueKind int
+
+const (
+	caIssueUnreadable caIssueKind = iota
+	caIssueMismatch
+	caIssueExpired
+	caIssueNotYetValid
+	caIssueExpiring
+	caIssueWeakKey
+	caIssueUntrusted
+	caIssueBrowser
+	caIssueTarget
+)
+
+type caIssue struct {
+	Kind    caIssueKind
+	Message string
+}
+
+// warn records a warning and its kind.
+func (h *caHealth) warn(kind caIssueKind, message string) {
+	h.Warnings = append(h.Warnings, message)
+	h.Issues = append(h.Issues, caIssue{Kind: kind, Message: message})
+}
+
+// caExpiryWarningDays is how long before expiry the CA is flagged.
+func caExpiryWarningDays() int {
+	if days := appSettings.CA.ExpiryWarningDays; days > 0 {
+		return days
+	}
+	return defaultCAExpiryWarningDays
+}
+
+// readCAHealth reads the trust store and checks the CA on disk.
+func readCAHealth() caHealth {
+	state, err := readCATrustState()
+	return checkCAHealth(state, err, time.Now())
+}
+
+// checkCAHealth derives the health from a trust state read once, so the
+// tray does not query the store twice per poll.
+func checkCAHealth(state caTrustState, stateErr error, now time.Time) caHealth {
+	health := caHealth{
+		Confdir:               confdirName(activeConfdir()),
+		Path:                  getMitmCACertPEMPath(),
+		InstalledFingerprints: []string{},
+		Browsers:              []browserTrust{},
+		Warnings:              []string{},
+	}
+	if stateErr != nil {
+		health.warn(caIssueUnreadable, fmt.Sprintf("cannot read the CA: %v", stateErr))
+		return health
+	}
+
+	if state.Installed {
+		health.InstalledFingerprints = append(health.InstalledFingerprints, certFingerprint(state.Disk))
+	}
+	for _, cert := range state.Stale {
+		health.InstalledFingerprints = append(health.InstalledFingerprints, certFingerprint(cert))
+	}
+	if state.Browsers != nil {
+		health.Browsers = state.Browsers
+	}
+	if state.mismatch() {
+		health.warn(caIssueMismatch, "installed CA differs from "+health.Confdir)
+	}
+
+	cert := state.Disk
+	if cert == nil {
+		return health
+	}
+	health.Present = true
+	health.Subject = cert.Subject.String()
+	health.Fingerprint = certFingerprint(cert)
+	health.NotBefore, health.NotAfter = &cert.NotBefore, &cert.NotAfter
+	health.DaysLeft = int(math.Floor(cert.NotAfter.Sub(now).Hours() / 24))
+	health.KeyAlgorithm, health.KeySize = certKeyInfo(cert)
+	health.Installed = state.Installed
+	health.FingerprintMatch = state.Installed
+	health.TrustedForSSL = state.Installed && caTrustedForSSL(state)
+
+	switch {
+	case now.After(cert.NotAfter):
+		health.warn(caIssueExpired, fmt.Sprintf("CA expired on %s", cert.NotAfter.Format("2006-01-02")))
+	case now.Before(cert.NotBefore):
+		health.warn(caIssueNotYetValid, fmt.Sprintf("CA is not valid before %s", cert.NotBefore.Format("2006-01-02")))
+	case health.DaysLeft < caExpiryWarningDays():
+		health.warn(caIssueExpiring, fmt.Sprintf("CA expires in %d days", health.DaysLeft))
+	}
+	if health.KeyAlgorithm == "RSA" && health.KeySize < caMinRSABits {
+		health.warn(caIssueWeakKey, fmt.Sprintf("weak CA key (RSA %d)", health.KeySize))
+	}
+	if health.Installed && !health.TrustedForSSL {
+		health.warn(caIssueUntrusted, "CA installed but not trusted for SSL")
+	}
+	// Browser profiles only count once the system store is set up; before
+	// that "Install CA Certificate" covers both.
+	if health.TrustedForSSL {
+		for _, b := range state.untrustedBrowsers() {
+			health.warn(caIssueBrowser, fmt.Sprintf("%s: %s", b.label(), b.statusLabel()))
+		}
+	}
+
+	health.Healthy = health.TrustedForSSL && len(health.Warnings) == 0
+	return health
+}
+
+// addTrustTargets adds the configured trust targets; one without the CA,
+// or with an old one left, is a warning.
+func (h *caHealth) addTrustTargets(statuses []trustTargetStatus) {
+	h.Targets = statuses
+	for _, s := range statuses {
+		if s.Error != "" || !s.Installed || s.Stale > 0 {
+			h.warn(caIssueTarget, fmt.Sprintf("%s: %s", s.Name, s.label()))
+		}
+	}
+	h.Healthy = h.TrustedForSSL && len(h.Warnings) == 0
+}
+
+// certKeyInfo returns the public key algorithm and its size in bits.
+func certKeyInfo(cert *x509.Certificate) (string, int) {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA", key.N.BitLen()
+	case *ecdsa.PublicKey:
+		return "ECDSA", key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return "Ed25519", 256
+	}
+	return cert.PublicKeyAlgorithm.String(), 0
+}
+
+// menuTitle is the informational CA line in the tray menu, naming the
+// confdir when the selected profile has its own.
+func (h caHealth) menuTitle() string {
+	label := "CA"
+	if h.Confdir != "" && h.Confdir != confdirName(getMitmHomeDirectory()) {
+		label = fmt.Sprintf("CA (%s)", h.Confdir)
+	}
+	if !h.Present {
+		return label + ": not created yet"
+	}
+	title := fmt.Sprintf("%s: %s %d, expires %s (%d days)", label, h.KeyAlgorithm, h.KeySize, h.NotAfter.Format("2006-01-02"), h.DaysLeft)
+	if len(h.Warnings) > 0 {
+		title = "⚠ " + title
+	}
+	return title
+}
+
+// statusSummary is the CA part of the tray status line, empty when there
+// is nothing to flag.
+func (h caHealth) statusSummary() string {
+	switch len(h.Warnings) {
+	case 0:
+		return ""
+	case 1:
+		return "CA: " + h.Warnings[0]
+	}
+	return fmt.Sprintf("CA: %s (+%d)", h.Warnings[0], len(h.Warnings)-1)
+}
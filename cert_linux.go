@@ -0,0 +1,182 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// linuxTrustStore is a distribution's system CA anchor directory together
+// with the command that rebuilds the CA bundle from it.
+type linuxTrustStore struct {
+	anchorPath string
+	update     string
+}
+
+var linuxTrustStores = []linuxTrustStore{
+	// Debian, Ubuntu
+	{"/usr/local/share/ca-certificates/mitmproxy.crt", "update-ca-certificates"},
+	// Fedora, RHEL, Arch, openSUSE
+	{"/etc/pki/ca-trust/source/anchors/mitmproxy.pem", "update-ca-trust"},
+	{"/etc/ca-certificates/trust-source/anchors/mitmproxy.pem", "update-ca-trust"},
+}
+
+// anchorFor is the anchor file of a confdir's CA: the distribution's usual
+// name for ~/.mitmproxy, mitmproxy-<name> for a profile's own confdir.
+func (s linuxTrustStore) anchorFor(confdir string) string {
+	if confdir == getMitmHomeDirectory() {
+		return s.anchorPath
+	}
+	ext := filepath.Ext(s.anchorPath)
+	return filepath.Join(filepath.Dir(s.anchorPath), "mitmproxy-"+filepath.Base(confdir)+ext)
+}
+
+// anchorFiles returns our anchor files with the certificates in them.
+func (s linuxTrustStore) anchorFiles() (map[string][]*x509.Certificate, error) {
+	ext := filepath.Ext(s.anchorPath)
+	paths, err := filepath.Glob(filepath.Join(filepath.Dir(s.anchorPath), "mitmproxy*"+ext))
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]*x509.Certificate)
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		certs, err := parseCertificatesPEM(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		files[path] = certs
+	}
+	return files, nil
+}
+
+// anchorsHolding returns the anchor files that hold any of certs.
+func (s linuxTrustStore) anchorsHolding(certs []*x509.Certificate) ([]string, error) {
+	files, err := s.anchorFiles()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for path, inFile := range files {
+	match:
+		for _, a := range inFile {
+			for _, b := range certs {
+				if bytes.Equal(a.Raw, b.Raw) {
+					paths = append(paths, path)
+					break match
+				}
+			}
+		}
+	}
+	return paths, nil
+}
+
+// removeFilesCommand is an rm -f of paths for a pkexec script.
+func removeFilesCommand(paths []string) string {
+	args := []string{"rm", "-f"}
+	for _, path := range paths {
+		args = append(args, shellQuote(path))
+	}
+	return strings.Join(args, " ")
+}
+
+func findLinuxTrustStore() (linuxTrustStore, bool) {
+	for _, store := range linuxTrustStores {
+		if _, err := exec.LookPath(store.update); err != nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Dir(store.anchorPath)); err == nil {
+			return store, true
+		}
+	}
+	return linuxTrustStore{}, false
+}
+
+// installedControllerCAs returns the certificates in our anchor files, one
+// per confdir. The file names are ours, so anything in them counts, whatever
+// the subject.
+func installedControllerCAs(disk *x509.Certificate) ([]*x509.Certificate, error) {
+	store, ok := findLinuxTrustStore()
+	if !ok {
+		return nil, nil
+	}
+	files, err := store.anchorFiles()
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for _, inFile := range files {
+		certs = append(certs, inFile...)
+	}
+	return certs, nil
+}
+
+// caTrustedForSSL reports whether the current CA is the installed anchor;
+// the bundle is rebuilt whenever the anchor is written.
+func caTrustedForSSL(state caTrustState) bool {
+	return state.Installed
+}
+
+func installCACertificate() string {
+	certPath := getMitmCACertPEMPath()
+	if _, err := ensureMitmCA(); err != nil {
+		return fmt.Sprintf("Failed to create CA certificate: %v", err)
+	}
+
+	// The system anchor needs pkexec; skip it when only browsers are missing.
+	if state, err := readCATrustState(); err != nil || !state.Installed {
+		store, ok := findLinuxTrustStore()
+		if !ok {
+			return "No supported system trust store found (update-ca-certificates or update-ca-trust)"
+		}
+
+		anchor := store.anchorFor(activeConfdir())
+		script := fmt.Sprintf("install -m 0644 %s %s && %s", shellQuote(certPath), shellQuote(anchor), store.update)
+		if stale, _ := store.anchorsHolding(state.Stale); len(stale) > 0 {
+			script = removeFilesCommand(stale) + " && " + script
+		}
+		if out, err := exec.Command("pkexec", "sh", "-c", script).CombinedOutput(); err != nil {
+			return fmt.Sprintf("Failed to install certificate: %v %s", err, bytes.TrimSpace(out))
+		}
+	}
+	return "CA certificate installed and trusted." + browserInstallSuffix() + " Restart your browser."
+}
+
+// trustCACertificate re-installs the anchor; Linux has no separate trust step.
+func trustCACertificate() string {
+	return installCACertificate()
+}
+
+// removeStoreCertificates removes the anchor files holding certs, leaving
+// the CAs of other confdirs, and rebuilds the bundle.
+func removeStoreCertificates(certs []*x509.Certificate) error {
+	store, ok := findLinuxTrustStore()
+	if !ok {
+		return fmt.Errorf("no supported system trust store found")
+	}
+	paths, err := store.anchorsHolding(certs)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	script := fmt.Sprintf("%s && %s", removeFilesCommand(paths), store.update)
+	if store.update == "update-ca-certificates" {
+		script += " --fresh"
+	}
+	if out, err := exec.Command("pkexec", "sh", "-c", script).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
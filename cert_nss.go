@@ -0,0 +1,286 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// Firefox, and Chromium on Linux, trust the CAs in their own NSS databases
+// rather than the system store. Each profile has one (cert9.db), managed
+// with NSS's certutil, which has nothing to do with Windows' certutil.
+
+// nssCATrust is the trust given to the CA: a trusted CA for SSL.
+const nssCATrust = "C,,"
+
+// nssProfileRoot is a folder whose subfolders are browser profiles, or one
+// profile itself when profiles is false.
+type nssProfileRoot struct {
+	browser  string
+	dir      string
+	profiles bool
+}
+
+func nssProfileRoots() []nssProfileRoot {
+	home, _ := os.UserHomeDir()
+	if runtime.GOOS == "darwin" {
+		return []nssProfileRoot{
+			{"Firefox", filepath.Join(home, "Library", "Application Support", "Firefox", "Profiles"), true},
+		}
+	}
+	return []nssProfileRoot{
+		{"Firefox", filepath.Join(home, ".mozilla", "firefox"), true},
+		{"Firefox (snap)", filepath.Join(home, "snap", "firefox", "common", ".mozilla", "firefox"), true},
+		{"Firefox (flatpak)", filepath.Join(home, ".var", "app", "org.mozilla.firefox", ".mozilla", "firefox"), true},
+		{"Chrome/Chromium", filepath.Join(home, ".pki", "nssdb"), false},
+		{"Chromium (snap)", filepath.Join(home, "snap", "chromium", "current", ".pki", "nssdb"), false},
+	}
+}
+
+// findNSSDatabases returns the browser profiles that have an NSS database
+// in the sql format. The profile name is the folder name without Firefox's
+// random prefix.
+func findNSSDatabases() []browserTrust {
+	var found []browserTrust
+	for _, root := range nssProfileRoots() {
+		dirs := []string{root.dir}
+		if root.profiles {
+			entries, err := os.ReadDir(root.dir)
+			if err != nil {
+				continue
+			}
+			dirs = dirs[:0]
+			for _, entry := range entries {
+				if entry.IsDir() {
+					dirs = append(dirs, filepath.Join(root.dir, entry.Name()))
+				}
+			}
+		}
+		for _, dir := range dirs {
+			if _, err := os.Stat(filepath.Join(dir, "cert9.db")); err != nil {
+				continue
+			}
+			b := browserTrust{Browser: root.browser, Path: dir}
+			if root.profiles {
+				name := filepath.Base(dir)
+				if _, suffix, ok := strings.Cut(name, "."); ok {
+					name = suffix
+				}
+				b.Profile = name
+			}
+			found = append(found, b)
+		}
+	}
+	return found
+}
+
+// findNSSCertutil looks for NSS's certutil, which Homebrew installs keg-only.
+func findNSSCertutil() (string, error) {
+	if path, err := exec.LookPath("certutil"); err == nil {
+		return path, nil
+	}
+	for _, path := range []string{"/opt/homebrew/opt/nss/bin/certutil", "/usr/local/opt/nss/bin/certutil"} {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	if runtime.GOOS == "darwin" {
+		return "", fmt.Errorf("certutil not found (brew install nss)")
+	}
+	return "", fmt.Errorf("certutil not found (install libnss3-tools or nss-tools)")
+}
+
+// nssListLine is a line of `certutil -L`: the nickname, then the SSL,
+// S/MIME and code signing trust flags.
+var nssListLine = regexp.MustCompile(`^(.*\S)\s+([a-zA-Z]*,[a-zA-Z]*,[a-zA-Z]*)\s*$`)
+
+// readBrowserTrust checks every browser profile for the CA on disk. Only
+// nicknames that look like a mitmproxy CA are fetched; Firefox also caches
+// intermediates in its database.
+func readBrowserTrust(disk *x509.Certificate) []browserTrust {
+	browsers := findNSSDatabases()
+	if len(browsers) == 0 {
+		return nil
+	}
+	certutil, err := findNSSCertutil()
+	if err != nil {
+		for i := range browsers {
+			browsers[i].Error = err.Error()
+		}
+		return browsers
+	}
+
+	for i := range browsers {
+		b := &browsers[i]
+		db := "sql:" + b.Path
+		out, err := exec.Command(certutil, "-L", "-d", db).Output()
+		if err != nil {
+			b.Error = fmt.Sprintf("certutil failed: %v", err)
+			continue
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			m := nssListLine.FindStringSubmatch(line)
+			if m == nil || !isNSSCandidate(m[1], disk) {
+				continue
+			}
+			nickname, flags := m[1], m[2]
+			pemOut, err := exec.Command(certutil, "-L", "-d", db, "-n", nickname, "-a").Output()
+			if err != nil {
+				continue
+			}
+			certs, err := parseCertificatesPEM(pemOut)
+			if err != nil {
+				continue
+			}
+			for _, cert := range certs {
+				switch {
+				case disk != nil && bytes.Equal(cert.Raw, disk.Raw):
+					b.Installed = true
+					b.nickname = nickname
+					sslFlags, _, _ := strings.Cut(flags, ",")
+					b.Trusted = strings.Contains(sslFlags, "C")
+				case isStaleCA(cert, disk):
+					b.staleNicknames = append(b.staleNicknames, nickname)
+				}
+			}
+		}
+	}
+	return browsers
+}
+
+func isNSSCandidate(nickname string, disk *x509.Certificate) bool {
+	if strings.Contains(strings.ToLower(nickname), "mitmproxy") {
+		return true
+	}
+	return disk != nil && nickname == disk.Subject.CommonName
+}
+
+// nssNickname names the CA after its fingerprint, so it never collides
+// with the nickname of another CA.
+func nssNickname(cert *x509.Certificate) string {
+	fp := strings.ReplaceAll(certFingerprint(cert), ":", "")
+	return "mitmproxy-controller " + strings.ToLower(fp[:16])
+}
+
+// installBrowserCAs adds and trusts the CA on disk in every browser profile,
+// replacing stale mitmproxy CAs, and returns the profiles it changed. The
+// databases belong to the user, so no administrator prompt is needed.
+func installBrowserCAs(state caTrustState) ([]string, error) {
+	if state.Disk == nil || len(state.Browsers) == 0 {
+		return nil, nil
+	}
+	certutil, err := findNSSCertutil()
+	if err != nil {
+		return nil, err
+	}
+
+	var changed, failed []string
+	for _, b := range state.Browsers {
+		if b.Error != "" {
+			failed = append(failed, fmt.Sprintf("%s: %s", b.label(), b.Error))
+			continue
+		}
+		if b.Trusted && len(b.staleNicknames) == 0 {
+			continue
+		}
+		if err := updateNSSDatabase(certutil, b, state.Disk); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", b.label(), err))
+			continue
+		}
+		changed = append(changed, b.label())
+	}
+	if len(failed) > 0 {
+		return changed, fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return changed, nil
+}
+
+// updateNSSDatabase deletes stale CAs from one database, then adds the CA
+// on disk or fixes its trust flags.
+func updateNSSDatabase(certutil string, b browserTrust, disk *x509.Certificate) error {
+	db := "sql:" + b.Path
+	for _, nickname := range b.staleNicknames {
+		if nickname == b.nickname {
+			continue
+		}
+		if err := deleteNSSCertificate(certutil, db, nickname); err != nil {
+			return err
+		}
+	}
+
+	var out []byte
+	var err error
+	if b.Installed {
+		out, err = exec.Command(certutil, "-M", "-d", db, "-n", b.nickname, "-t", nssCATrust).CombinedOutput()
+	} else {
+		out, err = exec.Command(certutil, "-A", "-d", db, "-n", nssNickname(disk), "-t", nssCATrust, "-i", getMitmCACertPEMPath()).CombinedOutput()
+	}
+	if err != nil {
+		return fmt.Errorf("%v %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// deleteNSSCertificate deletes a certificate by nickname. A nickname listed
+// twice is gone after the first delete, which is not an error.
+func deleteNSSCertificate(certutil, db, nickname string) error {
+	out, err := exec.Command(certutil, "-D", "-d", db, "-n", nickname).CombinedOutput()
+	if err != nil && !bytes.Contains(out, []byte("could not find certificate")) {
+		return fmt.Errorf("%v %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// removeBrowserCAs deletes the CA on disk and stale mitmproxy CAs from every
+// browser profile.
+func removeBrowserCAs(browsers []browserTrust) error {
+	var failed []string
+	for _, b := range browsers {
+		nicknames := b.staleNicknames
+		if b.Installed {
+			nicknames = append([]string{b.nickname}, nicknames...)
+		}
+		if len(nicknames) == 0 {
+			continue
+		}
+		certutil, err := findNSSCertutil()
+		if err != nil {
+			return err
+		}
+		for _, nickname := range nicknames {
+			if err := deleteNSSCertificate(certutil, "sql:"+b.Path, nickname); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", b.label(), err))
+				break
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// browserInstallSuffix installs the CA into the browser profiles and
+// describes the result for the status line after a system install.
+func browserInstallSuffix() string {
+	state, err := readCATrustState()
+	if err != nil {
+		return ""
+	}
+	changed, err := installBrowserCAs(state)
+	if err != nil {
+		return " Browsers: " + err.Error()
+	}
+	if len(changed) > 0 {
+		return " Also trusted in " + strings.Join(changed, ", ") + "."
+	}
+	return ""
+}
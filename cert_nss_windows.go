@@ -0,0 +1,24 @@
+//go:build windows
+
+package main
+
+import "crypto/x509"
+
+// Firefox on Windows imports the CAs of the Root store itself
+// (security.enterprise_roots.enabled), and Windows' certutil is not NSS's.
+
+func readBrowserTrust(disk *x509.Certificate) []browserTrust {
+	return nil
+}
+
+func installBrowserCAs(state caTrustState) ([]string, error) {
+	return nil, nil
+}
+
+func removeBrowserCAs(browsers []browserTrust) error {
+	return nil
+}
+
+func findNSSDatabases() []browserTrust {
+	return nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// caArchiveDir holds the CAs replaced by rotation, one timestamped
+// directory each, below mitmproxy's confdir.
+const caArchiveDir = "ca-archive"
+
+// caRotation describes a finished rotation.
+type caRotation struct {
+	OldFingerprint string   `json:"old_fingerprint,omitempty"`
+	NewFingerprint string   `json:"new_fingerprint"`
+	Archive        string   `json:"archive,omitempty"`
+	Restarted      []string `json:"restarted,omitempty"`
+	Warnings       []string `json:"warnings,omitempty"`
+}
+
+func (r caRotation) summary() string {
+	result := "CA rotated | " + shortFingerprint(r.NewFingerprint)
+	if len(r.Restarted) > 0 {
+		result += " | restarted " + strings.Join(r.Restarted, ", ")
+	}
+	if len(r.Warnings) > 0 {
+		result += " | " + strings.Join(r.Warnings, " | ")
+	}
+	return result
+}
+
+// shortFingerprint keeps the first four bytes of a fingerprint for status
+// lines.
+func shortFingerprint(fp string) string {
+	if len(fp) > 11 {
+		return fp[:11] + "…"
+	}
+	return fp
+}
+
+// rotateCA replaces the CA in the selected profile's confdir with a new one
+// and moves trust over to it. Running instances on that confdir are stopped
+// first, since mitmproxy only reads the CA at startup, and started again at
+// the end. A failure before the new CA is trusted restores the old files and
+// trust.
+func rotateCA(opts caOptions) (caRotation, error) {
+	var rotation caRotation
+	if !slices.Contains(caKeyTypes, opts.KeyType) {
+		return rotation, fmt.Errorf("unknown CA key type %q (use %s)", opts.KeyType, strings.Join(caKeyTypes, ", "))
+	}
+	if opts.ValidityDays <= 0 {
+		return rotation, fmt.Errorf("validity must be positive")
+	}
+	if len(runningInstances()) == 0 && checkExistingMitmproxy() {
+		return rotation, fmt.Errorf("mitmproxy is running outside the controller; stop it first")
+	}
+
+	confdir := activeConfdir()
+	oldState, err := readCATrustState()
+	if err != nil {
+		return rotation, fmt.Errorf("failed to read the certificate store: %w", err)
+	}
+	if oldState.Disk != nil {
+		rotation.OldFingerprint = certFingerprint(oldState.Disk)
+	}
+
+	stopped, err := stopInstancesForRotation(confdir)
+	restart := func() {
+		for _, id := range stopped {
+			profile, ok := getProfileByID(id)
+			if !ok {
+				continue
+			}
+			startProfileInstance(profile)
+			if _, running := getInstance(id); running {
+				rotation.Restarted = append(rotation.Restarted, profile.Name)
+			} else {
+				rotation.Warnings = append(rotation.Warnings, fmt.Sprintf("%s did not restart", profile.Name))
+			}
+		}
+	}
+	if err != nil {
+		restart()
+		return rotation, err
+	}
+
+	archive, err := archiveMitmCA(confdir)
+	if err != nil {
+		restart()
+		return rotation, fmt.Errorf("failed to archive the CA: %w", err)
+	}
+	rotation.Archive = archive
+
+	// rollback undoes every step after the archive; newCert is nil when
+	// the new CA never reached the trust store.
+	rollback := func(cause error, newCert *x509.Certificate) (caRotation, error) {
+		var problems []string
+		if newCert != nil {
+			if err := removeStoreCertificates([]*x509.Certificate{newCert}); err != nil {
+				problems = append(problems, fmt.Sprintf("removing the new CA: %v", err))
+			}
+		}
+		if err := restoreMitmCA(confdir, archive); err != nil {
+			problems = append(problems, fmt.Sprintf("restoring %s: %v", archive, err))
+		}
+		if oldState.Installed {
+			if state, err := readCATrustState(); err != nil || !state.Installed {
+				installCACertificate()
+			}
+		}
+		restart()
+		if len(problems) > 0 {
+			return rotation, fmt.Errorf("%w; rollback incomplete: %s", cause, strings.Join(problems, "; "))
+		}
+		return rotation, fmt.Errorf("%w; the previous CA was restored", cause)
+	}
+
+	if err := generateMitmCA(confdir, opts); err != nil {
+		return rollback(fmt.Errorf("failed to generate the CA: %w", err), nil)
+	}
+	newCert, err := loadMitmCACert()
+	if err != nil {
+		return rollback(fmt.Errorf("failed to read the new CA: %w", err), nil)
+	}
+	rotation.NewFingerprint = certFingerprint(newCert)
+
+	if oldState.Installed {
+		if err := removeStoreCertificates([]*x509.Certificate{oldState.Disk}); err != nil {
+			return rollback(fmt.Errorf("failed to remove the old CA: %w", err), nil)
+		}
+	}
+
+	result := installCACertificate()
+	state, err := readCATrustState()
+	if err != nil {
+		return rollback(fmt.Errorf("failed to read the certificate store: %w", err), newCert)
+	}
+	if !state.Installed || !caTrustedForSSL(state) {
+		installed := newCert
+		if !state.Installed {
+			installed = nil
+		}
+		return rollback(fmt.Errorf("new CA not trusted: %s", result), installed)
+	}
+
+	_, failed := applyTrustTargets(func(t trustTarget, disk *x509.Certificate) error {
+		return t.install(disk)
+	})
+	rotation.Warnings = append(rotation.Warnings, failed...)
+
+	restart()
+	return rotation, nil
+}
+
+// stopInstancesForRotation stops the running instances on confdir and
+// returns their profile ids, the selected profile first so it restarts
+// first. Instances on other confdirs keep running.
+func stopInstancesForRotation(confdir string) ([]string, error) {
+	var ids []string
+	if _, ok := primaryInstance(); ok {
+		ids = append(ids, selectedProfileID)
+	}
+	for _, inst := range runningInstances() {
+		if inst.Profile.ID != selectedProfileID && profileConfdir(inst.Profile) == confdir {
+			ids = append(ids, inst.Profile.ID)
+		}
+	}
+
+	var stopped []string
+	for _, id := range ids {
+		result := stopProfileInstance(id)
+		if _, running := getInstance(id); running {
+			return stopped, fmt.Errorf("failed to stop %s: %s", id, result)
+		}
+		stopped = append(stopped, id)
+	}
+	return stopped, nil
+}
+
+// archiveMitmCA moves the CA files out of confdir into a new timestamped
+// archive directory and returns its path.
+func archiveMitmCA(confdir string) (string, error) {
+	archive := filepath.Join(confdir, caArchiveDir, time.Now().Format("20060102-150405"))
+	if _, err := os.Stat(archive); err == nil {
+		return "", fmt.Errorf("%s already exists", archive)
+	}
+	if err := os.MkdirAll(archive, 0700); err != nil {
+		return "", err
+	}
+
+	var moved []string
+	for _, name := range mitmCAFileNames {
+		src := filepath.Join(confdir, name)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Rename(src, filepath.Join(archive, name)); err != nil {
+			for _, done := range moved {
+				os.Rename(filepath.Join(archive, done), filepath.Join(confdir, done))
+			}
+			os.Remove(archive)
+			return "", err
+		}
+		moved = append(moved, name)
+	}
+	return archive, nil
+}
+
+// restoreMitmCA puts an archived CA back in confdir, dropping whatever CA
+// files were written since.
+func restoreMitmCA(confdir, archive string) error {
+	for _, name := range mitmCAFileNames {
+		path := filepath.Join(confdir, name)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Remove(path + ".tmp"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, name := range mitmCAFileNames {
+		src := filepath.Join(archive, name)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Rename(src, filepath.Join(confdir, name)); err != nil {
+			return err
+		}
+	}
+	return os.Remove(archive)
+}
+
+// rotateProfileCA rotates the CA of profileID's confdir, or of the selected
+// profile's if it is empty, with that profile selected for the rotation.
+func rotateProfileCA(profileID string, opts caOptions) (caRotation, error) {
+	if profileID != "" && profileID != selectedProfileID {
+		if !hasProfile(profileID) {
+			return caRotation{}, fmt.Errorf("unknown profile %q", profileID)
+		}
+		previous := selectedProfileID
+		selectedProfileID = profileID
+		defer func() { selectedProfileID = previous }()
+	}
+	return rotateCA(opts)
+}
+
+// rotateCAFromTray asks for confirmation, then rotates with the options
+// from settings.yaml.
+func rotateCAFromTray() string {
+	confirmed, err := confirmAction("Rotate CA Certificate",
+		fmt.Sprintf("Stop mitmproxy, replace the CA in %s and trust the new one? Devices that trust the old CA need the new one installed.", confdirName(activeConfdir())))
+	if err != nil {
+		return fmt.Sprintf("Failed to rotate CA: %v", err)
+	}
+	if !confirmed {
+		return "Rotation cancelled"
+	}
+	rotation, err := rotateCA(caOptionsFromSettings())
+	if err != nil {
+		return fmt.Sprintf("Failed to rotate CA: %v", err)
+	}
+	return rotation.summary()
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Developer runtimes keep CA lists of their own: the JVM its cacerts
+// keystore, Python's certifi a PEM bundle. Trust targets are configured in
+// settings.yaml under ca.trust_targets and get the CA on install, rotation
+// and removal, next to the OS store.
+
+// trustTargetSettings is one entry of ca.trust_targets.
+type trustTargetSettings struct {
+	Type string `yaml:"type"`
+	// Name identifies the target in `cert target` and `cert status`;
+	// defaults to the type.
+	Name string `yaml:"name"`
+	// Path is the bundle of a pem_bundle target, or the keystore of a jvm
+	// target (default: lib/security/cacerts of the JDK).
+	Path      string `yaml:"path"`
+	JavaHome  string `yaml:"java_home"`
+	StorePass string `yaml:"storepass"`
+}
+
+// trustTarget is a CA list the controller manages. status never fails:
+// problems are reported in the returned status.
+type trustTarget interface {
+	name() string
+	// detect reports why the target cannot be used, e.g. a missing JDK.
+	detect() error
+	status(disk *x509.Certificate) trustTargetStatus
+	// install adds the CA on disk and drops stale mitmproxy CAs.
+	install(disk *x509.Certificate) error
+	// remove drops the CA on disk and stale mitmproxy CAs.
+	remove(disk *x509.Certificate) error
+}
+
+type trustTargetStatus struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Location  string `json:"location"`
+	Detected  bool   `json:"detected"`
+	Installed bool   `json:"installed"`
+	Stale     int    `json:"stale"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (s trustTargetStatus) label() string {
+	switch {
+	case s.Error != "":
+		return s.Error
+	case s.Installed && s.Stale > 0:
+		return fmt.Sprintf("✓ installed, %d old CA(s) left", s.Stale)
+	case s.Installed:
+		return "✓ installed"
+	case s.Stale > 0:
+		return "old CA installed"
+	}
+	return "not installed"
+}
+
+// trustTargetTypes is the registry of target types by their settings name.
+var trustTargetTypes = map[string]func(trustTargetSettings) (trustTarget, error){
+	"jvm":        newJVMTarget,
+	"pem_bundle": newPEMBundleTarget,
+}
+
+// configuredTrustTargets builds the targets from settings.yaml.
+func configuredTrustTargets() ([]trustTarget, error) {
+	var targets []trustTarget
+	seen := map[string]bool{}
+	for i, s := range appSettings.CA.TrustTargets {
+		s.Type = strings.ToLower(strings.TrimSpace(s.Type))
+		newTarget, ok := trustTargetTypes[s.Type]
+		if !ok {
+			return nil, fmt.Errorf("ca.trust_targets[%d]: unknown type %q (use jvm or pem_bundle)", i, s.Type)
+		}
+		if s.Name == "" {
+			s.Name = s.Type
+		}
+		if seen[s.Name] {
+			return nil, fmt.Errorf("ca.trust_targets[%d]: name %q is used twice; set name", i, s.Name)
+		}
+		seen[s.Name] = true
+		target, err := newTarget(s)
+		if err != nil {
+			return nil, fmt.Errorf("ca.trust_targets[%d] (%s): %w", i, s.Name, err)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// selectTrustTargets returns the configured targets with the given names,
+// all of them when names is empty.
+func selectTrustTargets(names []string) ([]trustTarget, error) {
+	targets, err := configuredTrustTargets()
+	if err != nil || len(names) == 0 {
+		return targets, err
+	}
+	var selected []trustTarget
+	for _, name := range names {
+		found := false
+		for _, target := range targets {
+			if target.name() == name {
+				selected = append(selected, target)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no trust target named %q in settings.yaml", name)
+		}
+	}
+	return selected, nil
+}
+
+func trustTargetStatuses(targets []trustTarget, disk *x509.Certificate) []trustTargetStatus {
+	statuses := []trustTargetStatus{}
+	for _, target := range targets {
+		statuses = append(statuses, target.status(disk))
+	}
+	return statuses
+}
+
+// installTrustTargets installs the CA on disk into every configured target
+// and returns a suffix for the status line, empty without targets.
+func installTrustTargets() string {
+	done, failed := applyTrustTargets(func(t trustTarget, disk *x509.Certificate) error {
+		return t.install(disk)
+	})
+	return trustTargetsSummary("installed in", done, failed)
+}
+
+// removeTrustTargets removes the CA on disk and stale ones from every
+// configured target.
+func removeTrustTargets() string {
+	done, failed := applyTrustTargets(func(t trustTarget, disk *x509.Certificate) error {
+		return t.remove(disk)
+	})
+	return trustTargetsSummary("removed from", done, failed)
+}
+
+// applyTrustTargets runs apply on every configured target and returns the
+// names of those it succeeded on and the failures.
+func applyTrustTargets(apply func(trustTarget, *x509.Certificate) error) ([]string, []string) {
+	targets, err := configuredTrustTargets()
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	disk, err := loadMitmCACert()
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+
+	var done, failed []string
+	for _, target := range targets {
+		if err := target.detect(); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", target.name(), err))
+			continue
+		}
+		if err := apply(target, disk); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", target.name(), err))
+			continue
+		}
+		done = append(done, target.name())
+	}
+	return done, failed
+}
+
+func trustTargetsSummary(verb string, done, failed []string) string {
+	var result string
+	if len(done) > 0 {
+		result += fmt.Sprintf(" Also %s %s.", verb, strings.Join(done, ", "))
+	}
+	if len(failed) > 0 {
+		result += " Trust targets failed: " + strings.Join(failed, "; ") + "."
+	}
+	return result
+}
+
+// targetNickname is the alias the CA gets in keystores, after its
+// fingerprint like in NSS databases.
+func targetNickname(cert *x509.Certificate) string {
+	fp := strings.ReplaceAll(certFingerprint(cert), ":", "")
+	return "mitmproxy-controller-" + strings.ToLower(fp[:16])
+}
+
+// jvmTarget is the cacerts keystore of a JDK, managed with its keytool.
+type jvmTarget struct {
+	settings trustTargetSettings
+	javaHome string
+	cacerts  string
+	keytool  string
+}
+
+func newJVMTarget(s trustTargetSettings) (trustTarget, error) {
+	t := &jvmTarget{settings: s}
+	if s.StorePass == "" {
+		t.settings.StorePass = "changeit"
+	}
+	t.javaHome = expandHomePath(s.JavaHome)
+	if t.javaHome == "" {
+		t.javaHome = findJavaHome()
+	}
+	t.cacerts = expandHomePath(s.Path)
+	if t.cacerts == "" && t.javaHome != "" {
+		// JDK 9+ and JDK 8 layouts.
+		t.cacerts = filepath.Join(t.javaHome, "lib", "security", "cacerts")
+		if _, err := os.Stat(t.cacerts); err != nil {
+			t.cacerts = filepath.Join(t.javaHome, "jre", "lib", "security", "cacerts")
+		}
+	}
+	t.keytool = "keytool"
+	if t.javaHome != "" {
+		t.keytool = filepath.Join(t.javaHome, "bin", "keytool")
+	}
+	return t, nil
+}
+
+// findJavaHome follows JAVA_HOME, macOS's java_home or the java on PATH.
+func findJavaHome() string {
+	if home := os.Getenv("JAVA_HOME"); home != "" {
+		return home
+	}
+	if runtime.GOOS == "darwin" {
+		if out, err := exec.Command("/usr/libexec/java_home").Output(); err == nil {
+			return strings.TrimSpace(string(out))
+		}
+	}
+	java, err := exec.LookPath("java")
+	if err != nil {
+		return ""
+	}
+	if resolved, err := filepath.EvalSymlinks(java); err == nil {
+		java = resolved
+	}
+	return filepath.Dir(filepath.Dir(java))
+}
+
+func (t *jvmTarget) name() string { return t.settings.Name }
+
+func (t *jvmTarget) detect() error {
+	if t.cacerts == "" {
+		return fmt.Errorf("no JDK found (set JAVA_HOME or java_home)")
+	}
+	if _, err := os.Stat(t.cacerts); err != nil {
+		return fmt.Errorf("no keystore at %s", t.cacerts)
+	}
+	if _, err := exec.LookPath(t.keytool); err != nil {
+		return fmt.Errorf("keytool not found")
+	}
+	return nil
+}
+
+func (t *jvmTarget) keytoolCmd(args ...string) ([]byte, error) {
+	// English output, so aliases can be parsed.
+	args = append([]string{"-J-Duser.language=en"}, args...)
+	args = append(args, "-keystore", t.cacerts, "-storepass", t.settings.StorePass)
+	out, err := exec.Command(t.keytool, args...).CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("keytool %s: %v %s", args[1], err, bytes.TrimSpace(out))
+	}
+	return out, nil
+}
+
+// aliases returns the alias of the CA on disk and those of stale mitmproxy
+// CAs, read from `keytool -list -rfc`.
+func (t *jvmTarget) aliases(disk *x509.Certificate) (string, []string, error) {
+	out, err := t.keytoolCmd("-list", "-rfc")
+	if err != nil {
+		return "", nil, err
+	}
+	var ours string
+	var stale []string
+	for _, entry := range strings.Split(string(out), "Alias name: ")[1:] {
+		alias, body, _ := strings.Cut(entry, "\n")
+		certs, err := parseCertificatesPEM([]byte(body))
+		if err != nil || len(certs) == 0 {
+			continue
+		}
+		switch {
+		case disk != nil && bytes.Equal(certs[0].Raw, disk.Raw):
+			ours = strings.TrimSpace(alias)
+		case isStaleCA(certs[0], disk):
+			stale = append(stale, strings.TrimSpace(alias))
+		}
+	}
+	return ours, stale, nil
+}
+
+func (t *jvmTarget) status(disk *x509.Certificate) trustTargetStatus {
+	s := trustTargetStatus{Name: t.name(), Type: "jvm", Location: t.cacerts}
+	if err := t.detect(); err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.Detected = true
+	ours, stale, err := t.aliases(disk)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.Installed, s.Stale = ours != "", len(stale)
+	return s
+}
+
+func (t *jvmTarget) install(disk *x509.Certificate) error {
+	ours, stale, err := t.aliases(disk)
+	if err != nil {
+		return err
+	}
+	for _, alias := range stale {
+		if _, err := t.keytoolCmd("-delete", "-alias", alias); err != nil {
+			return err
+		}
+	}
+	if ours != "" {
+		return nil
+	}
+	_, err = t.keytoolCmd("-importcert", "-noprompt", "-trustcacerts", "-alias", targetNickname(disk), "-file", getMitmCACertPEMPath())
+	return err
+}
+
+func (t *jvmTarget) remove(disk *x509.Certificate) error {
+	ours, stale, err := t.aliases(disk)
+	if err != nil {
+		return err
+	}
+	if ours != "" {
+		stale = append(stale, ours)
+	}
+	for _, alias := range stale {
+		if _, err := t.keytoolCmd("-delete", "-alias", alias); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pemBundleTarget is a file of concatenated PEM certificates, such as
+// certifi's cacert.pem in a virtualenv or a bundle a Dockerfile copies in.
+type pemBundleTarget struct {
+	settings trustTargetSettings
+	path     string
+}
+
+// pemBundleMarker precedes the CA in a bundle, for readers of the file.
+const pemBundleMarker = "# mitmproxy-controller CA "
+
+func newPEMBundleTarget(s trustTargetSettings) (trustTarget, error) {
+	if strings.TrimSpace(s.Path) == "" {
+		return nil, fmt.Errorf("path is required")
+	}
+	return &pemBundleTarget{settings: s, path: expandHomePath(s.Path)}, nil
+}
+
+func (t *pemBundleTarget) name() string { return t.settings.Name }
+
+func (t *pemBundleTarget) detect() error {
+	if _, err := os.Stat(t.path); err != nil {
+		return fmt.Errorf("no bundle at %s", t.path)
+	}
+	return nil
+}
+
+func (t *pemBundleTarget) status(disk *x509.Certificate) trustTargetStatus {
+	s := trustTargetStatus{Name: t.name(), Type: "pem_bundle", Location: t.path}
+	content, err := os.ReadFile(t.path)
+	if err != nil {
+		s.Error = t.detect().Error()
+		return s
+	}
+	s.Detected = true
+	certs, err := parseCertificatesPEM(content)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	for _, cert := range certs {
+		switch {
+		case disk != nil && bytes.Equal(cert.Raw, disk.Raw):
+			s.Installed = true
+		case isStaleCA(cert, disk):
+			s.Stale++
+		}
+	}
+	return s
+}
+
+func (t *pemBundleTarget) install(disk *x509.Certificate) error {
+	return t.rewrite(disk, true)
+}
+
+func (t *pemBundleTarget) remove(disk *x509.Certificate) error {
+	return t.rewrite(disk, false)
+}
+
+// rewrite drops mitmproxy CAs from the bundle, with their marker line, and
+// appends the CA on disk when add is set. Everything else is kept byte for
+// byte.
+func (t *pemBundleTarget) rewrite(disk *x509.Certificate, add bool) error {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(t.path)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	rest := content
+	for {
+		i := bytes.Index(rest, []byte("-----BEGIN "))
+		if i < 0 {
+			out.Write(rest)
+			break
+		}
+		block, after := pem.Decode(rest[i:])
+		if block == nil {
+			out.Write(rest)
+			break
+		}
+		prefix, raw := rest[:i], rest[i:len(rest)-len(after)]
+		rest = after
+
+		drop := false
+		if block.Type == "CERTIFICATE" {
+			if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+				drop = (disk != nil && bytes.Equal(cert.Raw, disk.Raw)) || isStaleCA(cert, disk)
+			}
+		}
+		if drop {
+			// Drop the marker line and the blank line install put before it.
+			trimmed := bytes.TrimRight(prefix, "\r\n")
+			lineStart := bytes.LastIndexByte(trimmed, '\n') + 1
+			if bytes.HasPrefix(trimmed[lineStart:], []byte(pemBundleMarker)) {
+				prefix = bytes.TrimRight(trimmed[:lineStart], "\r\n")
+				if len(prefix) > 0 {
+					prefix = append(prefix[:len(prefix):len(prefix)], '\n')
+				}
+			}
+		}
+		out.Write(prefix)
+		if !drop {
+			out.Write(raw)
+		}
+	}
+
+	if add {
+		if out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+			out.WriteString("\n")
+		}
+		fmt.Fprintf(&out, "\n%s%s\n", pemBundleMarker, certFingerprint(disk))
+		out.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: disk.Raw}))
+	}
+	if bytes.Equal(out.Bytes(), content) {
+		return nil
+	}
+
+	tmp := t.path + ".mitmproxy-controller.tmp"
+	if err := os.WriteFile(tmp, out.Bytes(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, t.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -3,92 +3,69 @@
 package main
 
 import (
-	"os"
+	"crypto/x509"
+	"encoding/base64"
 	"os/exec"
-	"path/filepath"
-	"regexp"
 	"strings"
+	"syscall"
 )
 
-func getMitmproxyCertPath() string {
-	home, _ := os.UserHomeDir()
-	return filepath.Join(home, ".mitmproxy", "mitmproxy-ca-cert.cer")
-}
-
-func getCertThumbprint() string {
-	certPath := getMitmproxyCertPath()
-	if _, err := os.Stat(certPath); os.IsNotExist(err) {
-		return ""
-	}
-
-	// Get SHA1 thumbprint of the certificate file
-	out, err := exec.Command("certutil", "-hashfile", certPath, "SHA1").Output()
-	if err != nil {
-		return ""
-	}
-
-	// Parse output - thumbprint is on second line
-	lines := strings.Split(string(out), "\n")
-	if len(lines) < 2 {
-		return ""
-	}
-
-	// Clean up the thumbprint (remove spaces, lowercase)
-	thumbprint := strings.TrimSpace(lines[1])
-	thumbprint = strings.ReplaceAll(thumbprint, " ", "")
-	return strings.ToLower(thumbprint)
-}
-
-func isCertInstalled() bool {
-	thumbprint := getCertThumbprint()
-	if thumbprint == "" {
-		return false
-	}
-
-	out, err := exec.Command("certutil", "-store", "-user", "Root").Output()
+// installedControllerCAs returns the mitmproxy CAs in the user's Root
+// store, read through PowerShell as DER so they can be fingerprinted.
+func installedControllerCAs(disk *x509.Certificate) ([]*x509.Certificate, error) {
+	script := `Get-ChildItem Cert:\CurrentUser\Root | ForEach-Object { [Convert]::ToBase64String($_.RawData) }`
+	cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	out, err := cmd.Output()
 	if err != nil {
-		return false
+		return nil, err
 	}
 
-	// Look for the thumbprint in the store output
-	// Format: "Cert Hash(sha1): xx xx xx xx..."
-	output := strings.ToLower(string(out))
-	// Normalize the store output thumbprints (remove spaces)
-	re := regexp.MustCompile(`cert hash\(sha1\):\s*([a-f0-9 ]+)`)
-	matches := re.FindAllStringSubmatch(output, -1)
-
-	for _, match := range matches {
-		if len(match) > 1 {
-			storeThumbprint := strings.ReplaceAll(match[1], " ", "")
-			storeThumbprint = strings.TrimSpace(storeThumbprint)
-			if storeThumbprint == thumbprint {
-				return true
-			}
+	var found []*x509.Certificate
+	for _, line := range strings.Fields(string(out)) {
+		der, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			continue
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			continue
+		}
+		if isControllerCA(cert, disk) {
+			found = append(found, cert)
 		}
 	}
-
-	return false
+	return found, nil
 }
 
-func isCertTrusted() bool {
-	// On Windows, if cert is in Root store, it's trusted
-	return isCertInstalled()
+// caTrustedForSSL: on Windows, if the cert is in the Root store, it's trusted.
+func caTrustedForSSL(state caTrustState) bool {
+	return state.Installed
 }
 
 func installCACertificate() string {
-	certPath := getMitmproxyCertPath()
+	certPath := getMitmCACertPEMPath()
 
-	if _, err := os.Stat(certPath); os.IsNotExist(err) {
-		return "CA cert not found. Start mitmproxy first to generate it."
+	if _, err := ensureMitmCA(); err != nil {
+		return "Failed to create CA certificate: " + err.Error()
 	}
-
-	if isCertInstalled() {
+	state, err := readCATrustState()
+	if err != nil {
+		return "Failed to read the certificate store: " + err.Error()
+	}
+	if state.Installed && len(state.Stale) == 0 {
 		return "CA certificate is already installed"
 	}
 
-	cmd := exec.Command("certutil", "-addstore", "-user", "Root", certPath)
-	if err := cmd.Run(); err != nil {
-		return "Failed to install certificate: " + err.Error()
+	if !state.Installed {
+		cmd := exec.Command("certutil", "-addstore", "-user", "Root", certPath)
+		if err := cmd.Run(); err != nil {
+			return "Failed to install certificate: " + err.Error()
+		}
+	}
+	// Replace CAs from an older confdir.
+	if err := removeStoreCertificates(state.Stale); err != nil {
+		return "CA certificate installed, but removing the old one failed: " + err.Error()
 	}
 
 	return "CA certificate installed successfully. Restart your browser."
@@ -99,21 +76,13 @@ func trustCACertificate() string {
 	return installCACertificate()
 }
 
-func removeCACertificate() string {
-	thumbprint := getCertThumbprint()
-	if thumbprint == "" {
-		return "CA cert file not found"
-	}
-
-	if !isCertInstalled() {
-		return "CA certificate is not installed"
-	}
-
-	// Delete by thumbprint for precise targeting
-	cmd := exec.Command("certutil", "-delstore", "-user", "Root", thumbprint)
-	if err := cmd.Run(); err != nil {
-		return "Failed to remove certificate: " + err.Error()
+// removeStoreCertificates deletes certificates by their SHA-1 thumbprint,
+// the hash of the certificate itself rather than of the file.
+func removeStoreCertificates(certs []*x509.Certificate) error {
+	for _, cert := range certs {
+		if err := exec.Command("certutil", "-delstore", "-user", "Root", certThumbprint(cert)).Run(); err != nil {
+			return err
+		}
 	}
-
-	return "CA certificate removed. Restart your browser."
+	return nil
 }
@@ -0,0 +1,996 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const cliUsage = `usage: mitmproxy-controller [command]
+
+Without a command the tray app is started.
+
+Commands:
+  profile list                              List service profiles
+  profile new <id> [--name <name>]          Create a profile from the template
+  profile clone <id> <new-id>               Duplicate a profile
+  profile rename <id> <new-id> [--name <name>]
+                                            Change a profile's id (and name)
+  profile delete <id>                       Move a profile to the trash folder
+  profile fork <source/id> [<new-id>]       Copy a read-only team profile into a local profile
+  profile sync [<source>]                   Clone or pull team profile sources
+  profile export <id> [-o <file>]           Write a shareable profile bundle (.zip)
+  profile import <file> [--id <id>] [--force] [--allow-hooks]
+                                            Unpack a profile bundle into the profiles folder
+  proxy restore                             Restore the proxy settings saved before the proxy was enabled
+  exec [--profile <id>] -- <command> [args...]
+                                            Run a command with proxy and CA variables for a running
+                                            instance (started first if needed); exits with its code
+  env [--shell bash|zsh|fish|powershell] [--profile <id>] [--unset]
+                                            Print statements that set (or unset) those variables
+  status [--json] [--prompt [--format <fmt>]]
+                                            Show the running controller's status; --prompt prints a
+                                            short segment such as "⚡ payments" for shell prompts
+  wireguard [--profile <id>] [--qr]         Print the client config of a running wireguard-mode
+                                            instance, with --qr also as a QR code to scan
+  cert status [--json] [--profile <id>]     Check the CA: expiry, key, installed fingerprint and SSL
+                                            trust; exits 1 unless healthy
+  cert target [list|install|remove] [--profile <id>] [<name>...]
+                                            Manage the CA in the JVM keystores and PEM bundles listed
+                                            under ca.trust_targets in settings.yaml
+  cert generate [--key-type <type>] [--days <n>] [--profile <id>]
+                                            Create the CA before the first start, in ~/.mitmproxy or
+                                            the profile's own confdir
+  cert expose [--timeout <duration>] [--png <file>] [--profile <id>]
+                                            Serve the CA (.pem, .cer, .mobileconfig) on the LAN and
+                                            print a QR code with the URL; stops after the first
+                                            download or the timeout
+  cert rotate [--key-type <type>] [--days <n>] [--profile <id>]
+                                            Replace the CA with a new one, move trust over to it and
+                                            restart the running instances; rolls back on failure
+                                            (cert commands act on the selected profile's CA unless
+                                            --profile names another)
+  doctor [--json] [--profile <id>]          Check mitmproxy, the port, the CA, the system proxy and a
+                                            test request through the proxy, with a fix for each
+                                            problem; exits 1 if a check fails
+  report-repo [<dir>]                       Tell the running controller which git repo you are in
+  rules check                               Show which profile rule matches right now
+`
+
+// runCLI handles command-line invocations and returns the process exit code.
+func runCLI(args []string) int {
+	switch args[0] {
+	case "profile", "profiles":
+		return runProfileCommand(args[1:])
+	case "proxy":
+		return runProxyCommand(args[1:])
+	case "exec":
+		return runExecCommand(args[1:])
+	case "env":
+		return runEnvCommand(args[1:])
+	case "status":
+		return runStatusCommand(args[1:])
+	case "cert":
+		return runCertCommand(args[1:])
+	case "doctor":
+		return runDoctorCommand(args[1:])
+	case "wireguard", "wg":
+		return runWireGuardCommand(args[1:])
+	case "report-repo":
+		return runReportRepoCommand(args[1:])
+	case "rules":
+		return runRulesCommand(args[1:])
+	case "help", "-h", "--help":
+		fmt.Print(cliUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", args[0], cliUsage)
+		return 2
+	}
+}
+
+func runProfileCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+
+	if err := initProfiles(); err != nil {
+		return cliError(err)
+	}
+
+	switch args[0] {
+	case "list", "ls":
+		for _, p := range listProfiles() {
+			marker := " "
+			if p.ID == selectedProfileID {
+				marker = "*"
+			}
+			suffix := ""
+			if p.ReadOnly {
+				suffix = " (read-only)"
+			}
+			fmt.Printf("%s %-24s %s%s\n", marker, p.ID, p.Name, suffix)
+		}
+		for _, warning := range profileLoadWarnings() {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+		}
+		return 0
+
+	case "new", "create":
+		fs := newCLIFlagSet("profile new")
+		name := fs.String("name", "", "display name for the profile")
+		positional, err := parseCLIFlags(fs, args[1:], 1)
+		if err != nil {
+			return cliUsageError(err)
+		}
+		profile, err := createProfile(positional[0], *name)
+		if err != nil {
+			return cliError(err)
+		}
+		fmt.Printf("Created profile %s at %s\n", profile.ID, profile.FilePath)
+		return 0
+
+	case "clone", "duplicate":
+		fs := newCLIFlagSet("profile clone")
+		positional, err := parseCLIFlags(fs, args[1:], 2)
+		if err != nil {
+			return cliUsageError(err)
+		}
+		profile, err := cloneProfile(positional[0], positional[1])
+		if err != nil {
+			return cliError(err)
+		}
+		fmt.Printf("Cloned %s to %s at %s\n", positional[0], profile.ID, profile.FilePath)
+		return 0
+
+	case "rename", "mv":
+		fs := newCLIFlagSet("profile rename")
+		name := fs.String("name", "", "new display name for the profile")
+		positional, err := parseCLIFlags(fs, args[1:], 2)
+		if err != nil {
+			return cliUsageError(err)
+		}
+		profile, err := renameProfile(positional[0], positional[1], *name)
+		if err != nil {
+			return cliError(err)
+		}
+		fmt.Printf("Renamed %s to %s at %s\n", positional[0], profile.ID, profile.FilePath)
+		return 0
+
+	case "delete", "rm":
+		fs := newCLIFlagSet("profile delete")
+		positional, err := parseCLIFlags(fs, args[1:], 1)
+		if err != nil {
+			return cliUsageError(err)
+		}
+		trashPath, err := deleteProfile(positional[0])
+		if err != nil {
+			return cliError(err)
+		}
+		fmt.Printf("Deleted %s (moved to %s)\n", positional[0], trashPath)
+		return 0
+
+	case "fork":
+		fs := newCLIFlagSet("profile fork")
+		positional, err := parseCLIFlags(fs, args[1:], -1)
+		if err != nil {
+			return cliUsageError(err)
+		}
+		if len(positional) < 1 || len(positional) > 2 {
+			return cliUsageError(fmt.Errorf("profile fork: expected <source/id> [<new-id>]"))
+		}
+		newID := ""
+		if len(positional) == 2 {
+			newID = positional[1]
+		}
+		profile, err := forkProfile(positional[0], newID)
+		if err != nil {
+			return cliError(err)
+		}
+		fmt.Printf("Forked %s to %s at %s\n", positional[0], profile.ID, profile.FilePath)
+		return 0
+
+	case "sync":
+		fs := newCLIFlagSet("profile sync")
+		positional, err := parseCLIFlags(fs, args[1:], -1)
+		if err != nil {
+			return cliUsageError(err)
+		}
+		if len(positional) > 1 {
+			return cliUsageError(fmt.Errorf("profile sync: expected at most one source name"))
+		}
+		name := ""
+		if len(positional) == 1 {
+			name = positional[0]
+		}
+		synced, err := syncProfileSources(name)
+		for _, id := range synced {
+			fmt.Printf("Synced %s\n", id)
+		}
+		if err != nil {
+			return cliError(err)
+		}
+		if len(synced) == 0 {
+			fmt.Printf("No profile sources configured in %s\n", getSettingsPath())
+		}
+		return 0
+
+	case "export":
+		fs := newCLIFlagSet("profile export")
+		out := fs.String("o", "", "output file (default <id>"+bundleFileExtension+")")
+		positional, err := parseCLIFlags(fs, args[1:], 1)
+		if err != nil {
+			return cliUsageError(err)
+		}
+		bundlePath, err := exportProfileBundle(positional[0], *out)
+		if err != nil {
+			return cliError(err)
+		}
+		fmt.Printf("Exported %s to %s\n", positional[0], bundlePath)
+		return 0
+
+	case "import":
+		fs := newCLIFlagSet("profile import")
+		id := fs.String("id", "", "import under a different profile id")
+		force := fs.Bool("force", false, "overwrite an existing profile with the same id")
+		allowHooks := fs.Bool("allow-hooks", false, "keep the profile's start/stop hooks")
+		positional, err := parseCLIFlags(fs, args[1:], 1)
+		if err != nil {
+			return cliUsageError(err)
+		}
+		profile, hooks, err := importProfileBundle(positional[0], *id, *force, *allowHooks)
+		if err != nil {
+			return cliError(err)
+		}
+		fmt.Printf("Imported %s at %s\n", profile.ID, profile.FilePath)
+		if *allowHooks {
+			for _, hook := range hooks {
+				fmt.Printf("  hook %s\n", hook)
+			}
+		}
+		for _, warning := range profile.Warnings {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+		}
+		return 0
+
+	default:
+		return cliUsageError(fmt.Errorf("unknown profile command %q", args[0]))
+	}
+}
+
+func runProxyCommand(args []string) int {
+	if len(args) != 1 || args[0] != "restore" {
+		return cliUsageError(fmt.Errorf("usage: proxy restore"))
+	}
+
+	if _, ok := loadProxySnapshot(); !ok {
+		fmt.Println("No saved proxy settings; switching the controller proxy off")
+	}
+	if err := restoreSystemProxySnapshot(); err != nil {
+		return cliError(err)
+	}
+	fmt.Println("Proxy settings restored")
+	if result := recoverTransparentRedirects(); result != "" {
+		fmt.Println(result)
+	}
+	return 0
+}
+
+func runExecCommand(args []string) int {
+	fs := newCLIFlagSet("exec")
+	profileID := fs.String("profile", "", "profile whose instance to use")
+	if err := fs.Parse(args); err != nil {
+		return cliUsageError(err)
+	}
+	command := fs.Args()
+	if len(command) == 0 {
+		return cliUsageError(fmt.Errorf("usage: exec [--profile <id>] -- <command> [args...]"))
+	}
+
+	if _, err := exec.LookPath(command[0]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 127
+	}
+
+	if err := initProfiles(); err != nil {
+		return cliError(err)
+	}
+	inst, err := findShellInstance(*profileID, true)
+	if err != nil {
+		return cliError(err)
+	}
+	if inst.stop != nil {
+		// Started by this process, so nothing else would stop it.
+		defer inst.stop()
+		fmt.Fprintf(os.Stderr, "Started %s on port %s for this command\n", inst.ProfileName, inst.ProxyPort)
+	}
+	if err := waitForProxyPort(inst.ProxyPort, 15*time.Second); err != nil {
+		return cliError(err)
+	}
+	env, err := proxyEnvironment(inst.controlInstance)
+	if err != nil {
+		return cliError(err)
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = os.Environ()
+	for _, v := range env {
+		cmd.Env = append(cmd.Env, v.Name+"="+v.Value)
+	}
+
+	// Ctrl-C reaches the child through the terminal; stay alive until it
+	// exits so its exit code is returned and our instance gets stopped.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 127
+	}
+	go func() {
+		for sig := range signals {
+			if sig != os.Interrupt {
+				_ = cmd.Process.Signal(sig)
+			}
+		}
+	}()
+	return exitCodeOf(cmd.Wait())
+}
+
+func runEnvCommand(args []string) int {
+	fs := newCLIFlagSet("env")
+	shell := fs.String("shell", defaultShell(), "bash, zsh, fish or powershell")
+	profileID := fs.String("profile", "", "profile whose instance to use")
+	unset := fs.Bool("unset", false, "print statements that remove the variables")
+	if _, err := parseCLIFlags(fs, args, 0); err != nil {
+		return cliUsageError(err)
+	}
+	*shell = strings.ToLower(*shell)
+	if *shell == "pwsh" {
+		*shell = "powershell"
+	}
+	if !containsString(shellNames, *shell) {
+		return cliUsageError(fmt.Errorf("env: unsupported shell %q (use %s)", *shell, strings.Join(shellNames, ", ")))
+	}
+
+	if *unset {
+		for _, v := range proxyEnvironmentNames {
+			fmt.Println(formatEnvUnset(*shell, v))
+		}
+		return 0
+	}
+
+	if err := initProfiles(); err != nil {
+		return cliError(err)
+	}
+	inst, err := findShellInstance(*profileID, false)
+	if err != nil {
+		return cliError(err)
+	}
+	env, err := proxyEnvironment(inst.controlInstance)
+	if err != nil {
+		return cliError(err)
+	}
+	for _, v := range env {
+		fmt.Println(formatEnvExport(*shell, v))
+	}
+	return 0
+}
+
+// runStatusCommand answers from the control socket, or from the status file
+// the controller refreshes every poll. It never probes processes itself, so
+// --prompt stays cheap enough for every prompt render.
+func runStatusCommand(args []string) int {
+	fs := newCLIFlagSet("status")
+	prompt := fs.Bool("prompt", false, "print a short prompt segment, nothing when mitmproxy is stopped")
+	format := fs.String("format", "⚡ {profile}", "prompt format: {profile}, {name}, {port}, {instances}")
+	asJSON := fs.Bool("json", false, "print the status as JSON")
+	if _, err := parseCLIFlags(fs, args, 0); err != nil {
+		return cliUsageError(err)
+	}
+
+	var status controlStatus
+	running := controlRequest("GET", "/v1/status", nil, &status) == nil
+	if !running {
+		status, running = loadStatusFile(15 * time.Second)
+	}
+
+	switch {
+	case *prompt:
+		// Prompts must never fail; print nothing instead.
+		if running && (status.MitmRunning || len(status.Instances) > 0) {
+			fmt.Println(formatPrompt(*format, status))
+		}
+		return 0
+	case *asJSON:
+		if !running {
+			return cliError(fmt.Errorf("controller is not running"))
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(status); err != nil {
+			return cliError(err)
+		}
+		return 0
+	}
+
+	if !running {
+		fmt.Println("Controller: not running")
+		return 1
+	}
+	fmt.Printf("Profile:    %s (%s)\n", status.ProfileName, status.ProfileID)
+	fmt.Printf("mitmproxy:  %s\n", runningLabel(status.MitmRunning))
+	fmt.Printf("Proxy:      %s\n", enabledLabel(status.ProxyEnabled))
+	for _, inst := range status.Instances {
+		primary := ""
+		if inst.Primary {
+			primary = " (primary)"
+		}
+		mode := ""
+		if inst.Mode != "" && inst.Mode != "regular" {
+			mode = ", " + inst.Mode + " mode"
+		}
+		fmt.Printf("Instance:   %s on port %s, PID %d%s%s\n", inst.ProfileID, inst.ProxyPort, inst.PID, mode, primary)
+	}
+	for _, drift := range status.ProxyDrift {
+		fmt.Printf("Drift:      %s\n", drift)
+	}
+	if status.AutoSwitch {
+		fmt.Printf("Rule:       %s\n", status.MatchedRule)
+	}
+	return 0
+}
+
+func runCertCommand(args []string) int {
+	if len(args) > 0 && args[0] == "status" {
+		return runCertStatus(args[1:])
+	}
+	if len(args) > 0 && args[0] == "target" {
+		return runCertTarget(args[1:])
+	}
+	if len(args) > 0 && args[0] == "expose" {
+		return runCertExpose(args[1:])
+	}
+	if len(args) == 0 || (args[0] != "generate" && args[0] != "rotate") {
+		return cliUsageError(fmt.Errorf("usage: cert status [--json] | cert target list|install|remove [<name>...] | cert expose [--timeout <duration>] | cert generate|rotate [--key-type <type>] [--days <n>] [--profile <id>]"))
+	}
+
+	loadSettingsFromDisk()
+	opts := caOptionsFromSettings()
+	fs := newCLIFlagSet("cert " + args[0])
+	keyType := fs.String("key-type", opts.KeyType, strings.Join(caKeyTypes, ", "))
+	days := fs.Int("days", opts.ValidityDays, "validity in days")
+	profileUsage := "profile whose CA to create"
+	if args[0] == "rotate" {
+		profileUsage = "profile whose CA to rotate"
+	}
+	profileID := fs.String("profile", "", profileUsage)
+	if _, err := parseCLIFlags(fs, args[1:], 0); err != nil {
+		return cliUsageError(err)
+	}
+	if *days <= 0 {
+		return cliUsageError(fmt.Errorf("cert %s: --days must be positive", args[0]))
+	}
+	opts.KeyType, opts.ValidityDays = strings.ToLower(*keyType), *days
+
+	if args[0] == "rotate" {
+		return runCertRotate(*profileID, opts)
+	}
+
+	if err := selectCertProfile(*profileID); err != nil {
+		return cliError(err)
+	}
+	if _, err := os.Stat(mitmCAKeyPath()); err == nil {
+		return cliError(fmt.Errorf("a CA already exists at %s", mitmCAKeyPath()))
+	}
+	confdir := activeConfdir()
+	if err := ensureConfdir(confdir); err != nil {
+		return cliError(err)
+	}
+	if err := generateMitmCA(confdir, opts); err != nil {
+		return cliError(err)
+	}
+	fmt.Printf("Created %s CA (valid %d days) in %s\n", opts.KeyType, opts.ValidityDays, confdir)
+	return 0
+}
+
+// selectCertProfile loads the profiles so the cert commands act on the CA
+// of the selected profile, or of profileID for this run only.
+func selectCertProfile(profileID string) error {
+	if err := initProfiles(); err != nil {
+		return err
+	}
+	if profileID == "" {
+		return nil
+	}
+	if !hasProfile(profileID) {
+		return fmt.Errorf("unknown profile %q", profileID)
+	}
+	selectedProfileID = profileID
+	return nil
+}
+
+// runCertStatus checks the CA and the trust store directly, without the
+// tray app, and exits 1 unless the CA is healthy.
+func runCertStatus(args []string) int {
+	fs := newCLIFlagSet("cert status")
+	asJSON := fs.Bool("json", false, "print the health as JSON")
+	profileID := fs.String("profile", "", "profile whose CA to check")
+	if _, err := parseCLIFlags(fs, args, 0); err != nil {
+		return cliUsageError(err)
+	}
+	if err := selectCertProfile(*profileID); err != nil {
+		return cliError(err)
+	}
+
+	health := readCAHealth()
+	if targets, err := configuredTrustTargets(); err != nil {
+		health.warn(caIssueTarget, err.Error())
+		health.Healthy = false
+	} else if len(targets) > 0 {
+		disk, _ := loadMitmCACert()
+		health.addTrustTargets(trustTargetStatuses(targets, disk))
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(health); err != nil {
+			return cliError(err)
+		}
+	} else {
+		printCAHealth(health)
+	}
+	if !health.Healthy {
+		return 1
+	}
+	return 0
+}
+
+func printCAHealth(h caHealth) {
+	fmt.Printf("Confdir:     %s\n", h.Confdir)
+	fmt.Printf("CA file:     %s\n", h.Path)
+	if !h.Present {
+		fmt.Println("CA:          not created yet")
+	} else {
+		fmt.Printf("Subject:     %s\n", h.Subject)
+		fmt.Printf("Fingerprint: %s\n", h.Fingerprint)
+		fmt.Printf("Key:         %s %d\n", h.KeyAlgorithm, h.KeySize)
+		fmt.Printf("Expires:     %s (%d days)\n", h.NotAfter.Format("2006-01-02"), h.DaysLeft)
+		fmt.Printf("Installed:   %s\n", yesLabel(h.Installed))
+		fmt.Printf("Trusted:     %s\n", yesLabel(h.TrustedForSSL))
+	}
+	for _, b := range h.Browsers {
+		fmt.Printf("Browser:     %s: %s\n", b.label(), b.statusLabel())
+	}
+	for _, t := range h.Targets {
+		name := t.Name
+		if t.Location != "" {
+			name = fmt.Sprintf("%s (%s)", t.Name, t.Location)
+		}
+		fmt.Printf("Target:      %s: %s\n", name, t.label())
+	}
+	if !h.FingerprintMatch {
+		for _, fp := range h.InstalledFingerprints {
+			fmt.Printf("In store:    %s\n", fp)
+		}
+	}
+	for _, warning := range h.Warnings {
+		fmt.Printf("Warning:     %s\n", warning)
+	}
+}
+
+// runCertTarget lists the trust targets from settings.yaml, or installs the
+// CA into them or removes it, all or the named ones.
+func runCertTarget(args []string) int {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	action := args[0]
+	if action != "list" && action != "install" && action != "remove" {
+		return cliUsageError(fmt.Errorf("usage: cert target list|install|remove [--profile <id>] [<name>...]"))
+	}
+	fs := newCLIFlagSet("cert target " + action)
+	profileID := fs.String("profile", "", "profile whose CA to use")
+	names, err := parseCLIFlags(fs, args[1:], -1)
+	if err != nil {
+		return cliUsageError(err)
+	}
+	if err := selectCertProfile(*profileID); err != nil {
+		return cliError(err)
+	}
+	targets, err := selectTrustTargets(names)
+	if err != nil {
+		return cliError(err)
+	}
+	if len(targets) == 0 {
+		return cliError(fmt.Errorf("no trust targets in settings.yaml (ca.trust_targets)"))
+	}
+
+	var disk *x509.Certificate
+	if action == "install" {
+		if _, err := ensureMitmCA(); err != nil {
+			return cliError(err)
+		}
+	}
+	if disk, err = loadMitmCACert(); err != nil && (action == "install" || !os.IsNotExist(err)) {
+		return cliError(err)
+	}
+
+	failed := false
+	for _, target := range targets {
+		switch action {
+		case "install", "remove":
+			if err := target.detect(); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", target.name(), err)
+				failed = true
+				continue
+			}
+			apply := target.install
+			if action == "remove" {
+				apply = target.remove
+			}
+			if err := apply(disk); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", target.name(), err)
+				failed = true
+				continue
+			}
+		}
+		status := target.status(disk)
+		fmt.Printf("%-12s %-10s %s\n", status.Name, status.Type, status.label())
+		if status.Location != "" {
+			fmt.Printf("%-12s %-10s %s\n", "", "", status.Location)
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// runCertExpose serves the CA to devices on the LAN from this process and
+// waits until the server stops: after a download, the timeout or Ctrl-C.
+func runCertExpose(args []string) int {
+	fs := newCLIFlagSet("cert expose")
+	timeout := fs.Duration("timeout", 0, "how long to wait for a download (default from settings.yaml, 10m)")
+	pngPath := fs.String("png", "", "also write the QR code as a PNG image")
+	profileID := fs.String("profile", "", "profile whose CA to serve")
+	if _, err := parseCLIFlags(fs, args, 0); err != nil {
+		return cliUsageError(err)
+	}
+	if err := selectCertProfile(*profileID); err != nil {
+		return cliError(err)
+	}
+	if *timeout <= 0 {
+		*timeout = caExportTimeout()
+	}
+	if _, err := ensureMitmCA(); err != nil {
+		return cliError(err)
+	}
+
+	export, err := startCAExport(activeConfdir(), *timeout, nil)
+	if err != nil {
+		return cliError(err)
+	}
+	if *pngPath != "" {
+		if err := export.writeQRPNG(*pngPath); err != nil {
+			export.stop("failed")
+			return cliError(err)
+		}
+	}
+	code, err := terminalQR(export.URL)
+	if err == nil {
+		fmt.Print(code)
+	}
+	fmt.Printf("CA:      %s\n", export.Fingerprint)
+	fmt.Printf("URL:     %s\n", export.URL)
+	fmt.Printf("Until:   %s, or the first download\n", export.ExpiresAt.Format("15:04:05"))
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		if _, ok := <-signals; ok {
+			export.stop("interrupted")
+		}
+	}()
+	fmt.Printf("Stopped: %s\n", export.wait())
+	return 0
+}
+
+// runCertRotate rotates the CA in the tray app, which owns the running
+// instances, or in this process if the tray app is not running.
+func runCertRotate(profileID string, opts caOptions) int {
+	var rotation caRotation
+	var status controlStatus
+	if err := controlRequest("GET", "/v1/status", nil, &status); err == nil {
+		req := controlRotateRequest{ProfileID: profileID, KeyType: opts.KeyType, ValidityDays: opts.ValidityDays}
+		if err := controlRequestTimeout(controlRotateTimeout, "POST", "/v1/ca/rotate", req, &rotation); err != nil {
+			return cliError(err)
+		}
+	} else {
+		if err := selectCertProfile(profileID); err != nil {
+			return cliError(err)
+		}
+		if rotation, err = rotateCA(opts); err != nil {
+			return cliError(err)
+		}
+	}
+
+	if rotation.OldFingerprint != "" {
+		fmt.Printf("Old CA:    %s\n", rotation.OldFingerprint)
+		fmt.Printf("Archived:  %s\n", rotation.Archive)
+	}
+	fmt.Printf("New CA:    %s\n", rotation.NewFingerprint)
+	if len(rotation.Restarted) > 0 {
+		fmt.Printf("Restarted: %s\n", strings.Join(rotation.Restarted, ", "))
+	}
+	for _, warning := range rotation.Warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+	}
+	return 0
+}
+
+// runDoctorCommand runs the setup checks for the selected profile, or the
+// one given, with the tray app's view of the instances when it runs.
+func runDoctorCommand(args []string) int {
+	fs := newCLIFlagSet("doctor")
+	asJSON := fs.Bool("json", false, "print the checks as JSON")
+	profileID := fs.String("profile", "", "profile to check instead of the selected one")
+	if _, err := parseCLIFlags(fs, args, 0); err != nil {
+		return cliUsageError(err)
+	}
+	if err := selectCertProfile(*profileID); err != nil {
+		return cliError(err)
+	}
+
+	var status *controlStatus
+	var current controlStatus
+	if err := controlRequest("GET", "/v1/status", nil, &current); err == nil {
+		status = &current
+		if *profileID == "" && current.ProfileID != "" && hasProfile(current.ProfileID) {
+			selectedProfileID = current.ProfileID
+		}
+	}
+
+	report := runDoctor(status)
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return cliError(err)
+		}
+	} else {
+		fmt.Printf("Profile: %s\n\n", report.ProfileID)
+		for _, check := range report.Checks {
+			fmt.Printf("%s %-13s %s\n", doctorSymbol(check.Status), check.Name, check.Detail)
+			if check.Fix != "" && check.Status != doctorPass {
+				fmt.Printf("  %-13s fix: %s\n", "", check.Fix)
+			}
+		}
+	}
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
+
+// runWireGuardCommand prints the client config of an instance the tray app
+// runs; the port is only known while it runs.
+func runWireGuardCommand(args []string) int {
+	fs := newCLIFlagSet("wireguard")
+	profileID := fs.String("profile", "", "profile whose instance to use")
+	showQR := fs.Bool("qr", false, "also print the config as a QR code")
+	if _, err := parseCLIFlags(fs, args, 0); err != nil {
+		return cliUsageError(err)
+	}
+	if err := initProfiles(); err != nil {
+		return cliError(err)
+	}
+
+	var status controlStatus
+	if err := controlRequest("GET", "/v1/status", nil, &status); err != nil {
+		return cliError(fmt.Errorf("the controller is not running"))
+	}
+	var found *controlInstance
+	for i, inst := range status.Instances {
+		if inst.Mode == "wireguard" && (inst.ProfileID == *profileID || (*profileID == "" && (inst.Primary || found == nil))) {
+			found = &status.Instances[i]
+		}
+	}
+	if found == nil {
+		return cliError(fmt.Errorf("no wireguard-mode instance running for %s", describeProfileArg(*profileID)))
+	}
+	profile, ok := getProfileByID(found.ProfileID)
+	if !ok {
+		return cliError(fmt.Errorf("profile %q not found", found.ProfileID))
+	}
+
+	config, err := wireGuardClientConfig(&mitmInstance{Profile: profile, ProxyPort: found.ProxyPort})
+	if err != nil {
+		return cliError(err)
+	}
+	fmt.Print(config)
+	if *showQR {
+		code, err := terminalQR(config)
+		if err != nil {
+			return cliError(err)
+		}
+		fmt.Println()
+		fmt.Print(code)
+	}
+	return 0
+}
+
+func runningLabel(running bool) string {
+	if running {
+		return "running"
+	}
+	return "stopped"
+}
+
+func yesLabel(yes bool) string {
+	if yes {
+		return "yes"
+	}
+	return "no"
+}
+
+func enabledLabel(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// exitCodeOf maps a child's exit status to ours, using the shell convention
+// 128+n for a child killed by signal n.
+func exitCodeOf(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return cliError(err)
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exitErr.ExitCode()
+}
+
+func runReportRepoCommand(args []string) int {
+	fs := newCLIFlagSet("report-repo")
+	positional, err := parseCLIFlags(fs, args, -1)
+	if err != nil || len(positional) > 1 {
+		return cliUsageError(fmt.Errorf("report-repo: expected at most one directory"))
+	}
+
+	dir := "."
+	if len(positional) == 1 {
+		dir = positional[0]
+	}
+
+	repo := reportedRepo{}
+	if out, err := gitOutput(dir, "rev-parse", "--show-toplevel"); err == nil {
+		repo.Path = filepath.Clean(out)
+		repo.Remote, _ = gitOutput(dir, "config", "--get", "remote.origin.url")
+	}
+
+	// Reporting an empty path tells the controller we left any repository.
+	if err := controlRequest("POST", "/v1/context", repo, nil); err != nil {
+		return cliError(err)
+	}
+	return 0
+}
+
+func runRulesCommand(args []string) int {
+	if len(args) != 1 || args[0] != "check" {
+		return cliUsageError(fmt.Errorf("usage: rules check"))
+	}
+
+	if err := initProfiles(); err != nil {
+		return cliError(err)
+	}
+	rules, interval, err := loadProfileRules()
+	if err != nil {
+		return cliError(err)
+	}
+
+	ctx := ruleContext{Network: currentNetworkInfo(), Now: time.Now()}
+	var status controlStatus
+	if err := controlRequest("GET", "/v1/status", nil, &status); err == nil {
+		ctx.Repo = status.Repo
+	}
+
+	fmt.Printf("Rules file:      %s (%d rules, every %s)\n", getRulesPath(), len(rules.Rules), interval)
+	fmt.Printf("Interface:       %s\n", ctx.Network.Interface)
+	fmt.Printf("Network service: %s\n", ctx.Network.Service)
+	fmt.Printf("Wi-Fi SSID:      %s\n", ctx.Network.SSID)
+	fmt.Printf("Reported repo:   %s\n", ctx.Repo.Path)
+
+	rule, ok, err := matchProfileRule(rules.Rules, ctx)
+	if err != nil {
+		return cliError(err)
+	}
+	if !ok {
+		fmt.Println("Matched rule:    none")
+		return 0
+	}
+	fmt.Printf("Matched rule:    %s -> %s\n", rule.Name, rule.Profile)
+	if !hasProfile(rule.Profile) {
+		fmt.Fprintf(os.Stderr, "warning: profile %q does not exist\n", rule.Profile)
+	}
+	return 0
+}
+
+func gitOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+func newCLIFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+// parseCLIFlags parses flags that may appear before or after positional
+// arguments and checks that exactly wantArgs positional arguments were given
+// (a negative wantArgs accepts any number).
+func parseCLIFlags(fs *flag.FlagSet, args []string, wantArgs int) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		if args[0] == "--" {
+			positional = append(positional, args[1:]...)
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	if wantArgs >= 0 && len(positional) != wantArgs {
+		return nil, fmt.Errorf("%s: expected %d argument(s), got %d", fs.Name(), wantArgs, len(positional))
+	}
+	return positional, nil
+}
+
+func cliError(err error) int {
+	fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	return 1
+}
+
+func cliUsageError(err error) int {
+	fmt.Fprintf(os.Stderr, "error: %v\n\n%s", err, cliUsage)
+	return 2
+}
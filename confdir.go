@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A profile can keep its own mitmproxy confdir, and so its own CA, with
+// "confdir: <name>": a throwaway CA for demos next to the long-lived one in
+// ~/.mitmproxy. Named confdirs live in the controller data directory, so
+// profiles can share one by name and renaming a profile keeps it. The
+// certificate menu and commands act on the confdir of the selected profile.
+
+func getConfdirsDirectory() string {
+	return filepath.Join(getControllerDataDirectory(), "confdirs")
+}
+
+// profileConfdir returns the confdir mitmproxy runs with for a profile.
+func profileConfdir(profile ServiceProfile) string {
+	if profile.Confdir == "" {
+		return getMitmHomeDirectory()
+	}
+	return filepath.Join(getConfdirsDirectory(), profile.Confdir)
+}
+
+// profileConfdirByID is profileConfdir for a profile id, the shared confdir
+// for unknown ids.
+func profileConfdirByID(profileID string) string {
+	if profile, ok := getProfileByID(profileID); ok {
+		return profileConfdir(profile)
+	}
+	return getMitmHomeDirectory()
+}
+
+// activeConfdir is the confdir of the selected profile, whose CA the
+// certificate menu and commands manage.
+func activeConfdir() string {
+	return profileConfdirByID(selectedProfileID)
+}
+
+// confdirName is the confdir name as shown to users: ~/.mitmproxy or the
+// name from the profile.
+func confdirName(confdir string) string {
+	if confdir == getMitmHomeDirectory() {
+		return "~/.mitmproxy"
+	}
+	return filepath.Base(confdir)
+}
+
+// caCertPEMPath is the CA certificate of a confdir.
+func caCertPEMPath(confdir string) string {
+	return filepath.Join(confdir, mitmCABasename+"-ca-cert.pem")
+}
+
+// getMitmCACertPEMPath is the certificate of the selected profile's CA.
+func getMitmCACertPEMPath() string {
+	return caCertPEMPath(activeConfdir())
+}
+
+// validateConfdirName checks a profile's confdir name; it becomes a folder
+// name.
+func validateConfdirName(name string) error {
+	if name == "" || name != sanitizeProfileID(name) {
+		return fmt.Errorf("confdir %q must use lowercase letters, digits and dashes", name)
+	}
+	return nil
+}
+
+// ensureConfdir creates a named confdir, seeded with the config.yaml of
+// ~/.mitmproxy so mitmproxy options carry over.
+func ensureConfdir(confdir string) error {
+	if _, err := os.Stat(confdir); err == nil || confdir == getMitmHomeDirectory() {
+		return os.MkdirAll(confdir, 0755)
+	}
+	if err := os.MkdirAll(confdir, 0755); err != nil {
+		return err
+	}
+	if content, err := os.ReadFile(getMitmConfigPath()); err == nil {
+		return os.WriteFile(filepath.Join(confdir, "config.yaml"), content, 0644)
+	}
+	return nil
+}
+
+// knownConfdirs returns the shared confdir and every confdir a profile uses.
+func knownConfdirs() []string {
+	seen := map[string]bool{getMitmHomeDirectory(): true}
+	dirs := []string{getMitmHomeDirectory()}
+	for _, profile := range serviceProfiles {
+		dir := profileConfdir(profile)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs[1:])
+	return dirs
+}
+
+// belongsToOtherConfdir reports whether cert is the CA of a confdir other
+// than the active one. Such a CA is another profile's, not a stale one, and
+// is left in the trust stores.
+func belongsToOtherConfdir(cert *x509.Certificate) bool {
+	active := activeConfdir()
+	for _, dir := range knownConfdirs() {
+		if dir == active {
+			continue
+		}
+		content, err := os.ReadFile(caCertPEMPath(dir))
+		if err != nil {
+			continue
+		}
+		certs, err := parseCertificatesPEM(content)
+		if err == nil && len(certs) > 0 && bytes.Equal(certs[0].Raw, cert.Raw) {
+			return true
+		}
+	}
+	return false
+}
+
+// isStaleCA reports whether a CA in a trust store is a leftover mitmproxy CA
+// that installing the active one should replace.
+func isStaleCA(cert, disk *x509.Certificate) bool {
+	return isControllerCA(cert, disk) && !belongsToOtherConfdir(cert)
+}
@@ -0,0 +1,7 @@
+//go:build darwin || linux
+
+package main
+
+// attachParentConsole is a no-op: the binary always has the terminal's
+// stdio.
+func attachParentConsole() {}
@@ -0,0 +1,46 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// attachParentProcess is ATTACH_PARENT_PROCESS, (DWORD)-1.
+const attachParentProcess = uintptr(^uint32(0))
+
+var attachConsoleProc = syscall.NewLazyDLL("kernel32.dll").NewProc("AttachConsole")
+
+// attachParentConsole binds the CLI to the console it was started from. The
+// release binary is built with -H=windowsgui and gets no console of its own,
+// so without this output is lost and exec children get invalid handles.
+// Streams redirected to a file or pipe are kept.
+func attachParentConsole() {
+	if r, _, _ := attachConsoleProc.Call(attachParentProcess); r == 0 {
+		return
+	}
+	if !isValidStdHandle(os.Stdout) {
+		if f, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0); err == nil {
+			os.Stdout = f
+		}
+	}
+	if !isValidStdHandle(os.Stderr) {
+		if f, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0); err == nil {
+			os.Stderr = f
+		}
+	}
+	if !isValidStdHandle(os.Stdin) {
+		if f, err := os.OpenFile("CONIN$", os.O_RDWR, 0); err == nil {
+			os.Stdin = f
+		}
+	}
+}
+
+func isValidStdHandle(f *os.File) bool {
+	if f == nil {
+		return false
+	}
+	_, err := syscall.GetFileType(syscall.Handle(f.Fd()))
+	return err == nil
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The control API is a small HTTP server on a unix socket in the controller
+// data directory. Shell integrations and the CLI use it to talk to the
+// running tray app.
+
+const (
+	controlSocketName = "control.sock"
+	// statusFileName mirrors the last published status for readers that
+	// cannot use the socket; it is removed when the controller exits.
+	statusFileName = "status.json"
+)
+
+// controlStatus is the snapshot served by GET /v1/status. It is refreshed by
+// updateStatus so requests never have to probe the system themselves.
+type controlStatus struct {
+	MitmRunning  bool              `json:"mitm_running"`
+	ProxyEnabled bool              `json:"proxy_enabled"`
+	ProfileID    string            `json:"profile_id"`
+	ProfileName  string            `json:"profile_name"`
+	AutoSwitch   bool              `json:"auto_switch"`
+	MatchedRule  string            `json:"matched_rule,omitempty"`
+	ProxyPort    string            `json:"proxy_port"`
+	ProxyDrift   []string          `json:"proxy_drift,omitempty"`
+	Instances    []controlInstance `json:"instances"`
+	Repo         reportedRepo      `json:"repo"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+}
+
+type controlInstance struct {
+	ProfileID   string `json:"profile_id"`
+	ProfileName string `json:"profile_name"`
+	PID         int    `json:"pid"`
+	ProxyPort   string `json:"proxy_port"`
+	Mode        string `json:"mode"`
+	WebPort     string `json:"web_port,omitempty"`
+	FlowFile    string `json:"flow_file"`
+	Primary     bool   `json:"primary"`
+}
+
+// controlStartTimeout bounds POST /v1/instances, which waits for the
+// pre_start hook and the process launch.
+const controlStartTimeout = 60 * time.Second
+
+type controlStartRequest struct {
+	ProfileID string `json:"profile_id"`
+}
+
+// controlStart hands a start request from the control API to the tray loop,
+// which owns the instance registry and the menu.
+type controlStart struct {
+	profileID string
+	reply     chan controlStartResult
+}
+
+type controlStartResult struct {
+	instance controlInstance
+	err      error
+}
+
+var controlStartC = make(chan controlStart)
+
+// controlRotateTimeout bounds POST /v1/ca/rotate, which waits for the
+// administrator prompts of the trust store changes.
+const controlRotateTimeout = 5 * time.Minute
+
+type controlRotateRequest struct {
+	ProfileID    string `json:"profile_id,omitempty"`
+	KeyType      string `json:"key_type,omitempty"`
+	ValidityDays int    `json:"validity_days,omitempty"`
+}
+
+// controlRotate hands a CA rotation to the tray loop, which stops and
+// restarts the instances.
+type controlRotate struct {
+	profileID string
+	opts      caOptions
+	reply     chan controlRotateResult
+}
+
+type controlRotateResult struct {
+	rotation caRotation
+	err      error
+}
+
+var controlRotateC = make(chan controlRotate)
+
+var (
+	controlStatusMu   sync.Mutex
+	lastControlStatus controlStatus
+	controlListener   net.Listener
+)
+
+func getControlSocketPath() string {
+	return filepath.Join(getControllerDataDirectory(), controlSocketName)
+}
+
+func getStatusFilePath() string {
+	return filepath.Join(getControllerDataDirectory(), statusFileName)
+}
+
+func publishControlStatus(status controlStatus) {
+	status.UpdatedAt = time.Now()
+	controlStatusMu.Lock()
+	lastControlStatus = status
+	controlStatusMu.Unlock()
+
+	if payload, err := json.Marshal(status); err == nil {
+		tmpPath := getStatusFilePath() + ".tmp"
+		if os.WriteFile(tmpPath, payload, 0644) == nil {
+			_ = os.Rename(tmpPath, getStatusFilePath())
+		}
+	}
+}
+
+// loadStatusFile returns the status written by a running controller, unless
+// it is older than maxAge.
+func loadStatusFile(maxAge time.Duration) (controlStatus, bool) {
+	var status controlStatus
+	content, err := os.ReadFile(getStatusFilePath())
+	if err != nil || json.Unmarshal(content, &status) != nil {
+		return status, false
+	}
+	return status, time.Since(status.UpdatedAt) <= maxAge
+}
+
+func startControlServer() error {
+	socketPath := getControlSocketPath()
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+		return err
+	}
+
+	// Refuse to steal the socket from another running controller; otherwise
+	// clear a stale socket file left behind by a crash.
+	if conn, err := net.DialTimeout("unix", socketPath, 500*time.Millisecond); err == nil {
+		conn.Close()
+		return fmt.Errorf("another controller is already listening on %s", socketPath)
+	}
+	_ = os.Remove(socketPath)
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	_ = os.Chmod(socketPath, 0600)
+	controlListener = listener
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", handleControlStatus)
+	mux.HandleFunc("/v1/context", handleControlContext)
+	mux.HandleFunc("/v1/instances", handleControlInstances)
+	mux.HandleFunc("/v1/ca/rotate", handleControlRotate)
+
+	go func() {
+		_ = http.Serve(listener, mux)
+	}()
+	return nil
+}
+
+func stopControlServer() {
+	if controlListener != nil {
+		controlListener.Close()
+		controlListener = nil
+		_ = os.Remove(getControlSocketPath())
+		_ = os.Remove(getStatusFilePath())
+	}
+}
+
+func handleControlStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	controlStatusMu.Lock()
+	status := lastControlStatus
+	controlStatusMu.Unlock()
+	status.Repo = getReportedRepo()
+
+	writeControlJSON(w, status)
+}
+
+func handleControlContext(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var repo reportedRepo
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&repo); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	repo.ReportedAt = time.Now()
+	setReportedRepo(repo)
+
+	writeControlJSON(w, repo)
+}
+
+// handleControlInstances starts the instance of a profile (the selected one
+// if profile_id is empty) unless it already runs, and returns it.
+func handleControlInstances(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req controlStartRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	start := controlStart{profileID: req.ProfileID, reply: make(chan controlStartResult, 1)}
+	select {
+	case controlStartC <- start:
+	case <-time.After(controlStartTimeout):
+		http.Error(w, "controller is busy", http.StatusServiceUnavailable)
+		return
+	}
+
+	result := <-start.reply
+	if result.err != nil {
+		http.Error(w, result.err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeControlJSON(w, result.instance)
+}
+
+// handleControlRotate rotates the CA with the options from settings.yaml,
+// overridden by the request, and returns the rotation.
+func handleControlRotate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req controlRotateRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	opts := caOptionsFromSettings()
+	if req.KeyType != "" {
+		opts.KeyType = req.KeyType
+	}
+	if req.ValidityDays > 0 {
+		opts.ValidityDays = req.ValidityDays
+	}
+
+	rotate := controlRotate{profileID: req.ProfileID, opts: opts, reply: make(chan controlRotateResult, 1)}
+	select {
+	case controlRotateC <- rotate:
+	case <-time.After(controlStartTimeout):
+		http.Error(w, "controller is busy", http.StatusServiceUnavailable)
+		return
+	}
+
+	result := <-rotate.reply
+	if result.err != nil {
+		http.Error(w, result.err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeControlJSON(w, result.rotation)
+}
+
+func newControlInstance(inst *mitmInstance) controlInstance {
+	return controlInstance{
+		ProfileID:   inst.Profile.ID,
+		ProfileName: inst.Profile.Name,
+		PID:         inst.pid(),
+		ProxyPort:   inst.ProxyPort,
+		Mode:        profileModeName(inst.Profile),
+		WebPort:     inst.WebPort,
+		FlowFile:    inst.LogPath,
+		Primary:     inst.Profile.ID == selectedProfileID,
+	}
+}
+
+func writeControlJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+// controlRequest sends a request to the running controller and decodes the
+// JSON response into out (if non-nil).
+func controlRequest(method, path string, body, out interface{}) error {
+	return controlRequestTimeout(2*time.Second, method, path, body, out)
+}
+
+func controlRequestTimeout(timeout time.Duration, method, path string, body, out interface{}) error {
+	socketPath := getControlSocketPath()
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, "http://controller"+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("controller is not running (%s)", socketPath)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return fmt.Errorf("controller returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
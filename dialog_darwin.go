@@ -0,0 +1,50 @@
+//go:build darwin
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// promptText asks the user for a single line of text. ok is false when the
+// dialog was cancelled.
+func promptText(title, message, defaultValue string) (string, bool, error) {
+	script := fmt.Sprintf(`text returned of (display dialog "%s" default answer "%s" with title "%s")`,
+		appleScriptEscape(message), appleScriptEscape(defaultValue), appleScriptEscape(title))
+
+	out, err := exec.Command("osascript", "-e", script).Output()
+	if err != nil {
+		if isAppleScriptCancel(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return strings.TrimSpace(string(out)), true, nil
+}
+
+// confirmAction shows an OK/Cancel dialog and reports whether OK was chosen.
+func confirmAction(title, message string) (bool, error) {
+	script := fmt.Sprintf(`display dialog "%s" with title "%s" with icon caution`,
+		appleScriptEscape(message), appleScriptEscape(title))
+
+	if err := exec.Command("osascript", "-e", script).Run(); err != nil {
+		if isAppleScriptCancel(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func appleScriptEscape(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return strings.ReplaceAll(value, `"`, `\"`)
+}
+
+// osascript exits with status 1 when the user presses Cancel (error -128).
+func isAppleScriptCancel(err error) bool {
+	exitErr, ok := err.(*exec.ExitError)
+	return ok && exitErr.ExitCode() == 1
+}
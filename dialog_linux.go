@@ -0,0 +1,47 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// promptText asks the user for a single line of text. ok is false when the
+// dialog was cancelled.
+func promptText(title, message, defaultValue string) (string, bool, error) {
+	out, err := exec.Command("zenity", "--entry", "--title", title, "--text", message,
+		"--entry-text", defaultValue).Output()
+	if err != nil {
+		if isZenityCancel(err) {
+			return "", false, nil
+		}
+		return "", false, zenityError(err)
+	}
+	return strings.TrimSpace(string(out)), true, nil
+}
+
+// confirmAction shows an OK/Cancel dialog and reports whether OK was chosen.
+func confirmAction(title, message string) (bool, error) {
+	if err := exec.Command("zenity", "--question", "--title", title, "--text", message).Run(); err != nil {
+		if isZenityCancel(err) {
+			return false, nil
+		}
+		return false, zenityError(err)
+	}
+	return true, nil
+}
+
+// zenity exits with status 1 when the user presses Cancel or closes the dialog.
+func isZenityCancel(err error) bool {
+	exitErr, ok := err.(*exec.ExitError)
+	return ok && exitErr.ExitCode() == 1
+}
+
+func zenityError(err error) error {
+	if _, lookErr := exec.LookPath("zenity"); lookErr != nil {
+		return fmt.Errorf("zenity is required for dialogs on Linux")
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// promptText asks the user for a single line of text. ok is false when the
+// dialog was cancelled.
+func promptText(title, message, defaultValue string) (string, bool, error) {
+	script := fmt.Sprintf(`Add-Type -AssemblyName Microsoft.VisualBasic; `+
+		`[Microsoft.VisualBasic.Interaction]::InputBox('%s', '%s', '%s')`,
+		powerShellEscape(message), powerShellEscape(title), powerShellEscape(defaultValue))
+
+	out, err := runDialogScript(script)
+	if err != nil {
+		return "", false, err
+	}
+	// InputBox returns an empty string when cancelled.
+	value := strings.TrimSpace(out)
+	return value, value != "", nil
+}
+
+// confirmAction shows an OK/Cancel dialog and reports whether OK was chosen.
+func confirmAction(title, message string) (bool, error) {
+	script := fmt.Sprintf(`Add-Type -AssemblyName System.Windows.Forms; `+
+		`[System.Windows.Forms.MessageBox]::Show('%s', '%s', 'OKCancel', 'Warning')`,
+		powerShellEscape(message), powerShellEscape(title))
+
+	out, err := runDialogScript(script)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(out) == "OK", nil
+}
+
+func runDialogScript(script string) (string, error) {
+	cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+func powerShellEscape(value string) string {
+	return strings.ReplaceAll(value, "'", "''")
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// doctor runs the checklist for "interception does not work": mitmproxy
+// installed, an instance on a free port, the CA trusted, the system proxy
+// on that port and a request actually flowing through it. Each failed
+// check carries the fix to try.
+
+const (
+	doctorPass = "pass"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+	doctorSkip = "skip"
+)
+
+// doctorFlowTimeout bounds the test request through the proxy.
+const doctorFlowTimeout = 5 * time.Second
+
+type doctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Fix    string `json:"fix,omitempty"`
+}
+
+type doctorReport struct {
+	ProfileID string        `json:"profile_id"`
+	Checks    []doctorCheck `json:"checks"`
+	OK        bool          `json:"ok"`
+}
+
+func (r *doctorReport) add(name, status, detail, fix string) {
+	r.Checks = append(r.Checks, doctorCheck{Name: name, Status: status, Detail: detail, Fix: fix})
+}
+
+// runDoctor runs every check for the selected profile. status is the tray
+// app's, nil when it is not running. OK is false if any check failed;
+// warnings do not count.
+func runDoctor(status *controlStatus) doctorReport {
+	report := doctorReport{ProfileID: selectedProfileID}
+
+	doctorMitmproxy(&report)
+	inst := doctorInstance(&report, status)
+	doctorPort(&report, inst)
+	doctorCA(&report)
+	doctorSystemProxy(&report, status, inst)
+	doctorFlow(&report, inst)
+
+	report.OK = true
+	for _, check := range report.Checks {
+		if check.Status == doctorFail {
+			report.OK = false
+		}
+	}
+	return report
+}
+
+// doctorMitmproxy looks up the binaries the controller starts: mitmweb,
+// or mitmdump without the web UI.
+func doctorMitmproxy(r *doctorReport) {
+	for _, name := range []string{"mitmweb", "mitmdump"} {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			continue
+		}
+		detail := fmt.Sprintf("%s %s (%s)", name, mitmproxyVersion(path), path)
+		if name == "mitmweb" {
+			r.add("mitmproxy", doctorPass, detail, "")
+		} else {
+			r.add("mitmproxy", doctorWarn, detail+", no mitmweb", "Install the full mitmproxy package to get the web UI")
+		}
+		return
+	}
+	r.add("mitmproxy", doctorFail, "mitmweb and mitmdump are not on PATH", "Install mitmproxy (brew install mitmproxy, pipx install mitmproxy or winget install mitmproxy) and make sure it is on PATH")
+}
+
+// mitmproxyVersion returns the version from `<binary> --version`, whose
+// first line reads "Mitmproxy: 11.0.0".
+func mitmproxyVersion(path string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "--version").Output()
+	if err != nil {
+		return "(version unknown)"
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	_, version, found := strings.Cut(line, ":")
+	if !found {
+		return strings.TrimSpace(line)
+	}
+	return strings.TrimSpace(version)
+}
+
+// doctorInstance finds the selected profile's instance in the tray app's
+// status and returns it, or nil.
+func doctorInstance(r *doctorReport, status *controlStatus) *controlInstance {
+	if status == nil {
+		if checkExistingMitmproxy() {
+			r.add("instance", doctorWarn, "controller not running; mitmproxy runs outside it", `Stop it and click "Start mitmproxy" in mitmproxy-controller so the CA, port and proxy match`)
+		} else {
+			r.add("instance", doctorFail, "controller not running", `Start mitmproxy-controller, then click "Start mitmproxy"`)
+		}
+		return nil
+	}
+	for i, inst := range status.Instances {
+		if inst.ProfileID == selectedProfileID {
+			r.add("instance", doctorPass, fmt.Sprintf("%s running (PID %d, port %s, %s mode)", inst.ProfileName, inst.PID, inst.ProxyPort, inst.Mode), "")
+			return &status.Instances[i]
+		}
+	}
+	r.add("instance", doctorFail, fmt.Sprintf("no instance running for %s", selectedProfileID), `Click "Start mitmproxy" in the tray`)
+	return nil
+}
+
+// doctorPort checks that mitmproxy can listen: the running instance holds
+// its port, otherwise the port it would take must be free.
+func doctorPort(r *doctorReport, inst *controlInstance) {
+	if inst != nil {
+		r.add("port", doctorPass, fmt.Sprintf("%s listening on %s", inst.ProfileName, net.JoinHostPort(proxyHost, inst.ProxyPort)), "")
+		return
+	}
+	port, pinned := proxyPort, false
+	if profile, ok := getSelectedProfile(); ok {
+		if p := strings.TrimSpace(profile.SetOptions["listen_port"]); p != "" {
+			port, pinned = p, true
+		}
+	}
+	switch {
+	case isPortAvailable(port, nil):
+		r.add("port", doctorPass, fmt.Sprintf("port %s is free", port), "")
+	case pinned:
+		r.add("port", doctorFail, fmt.Sprintf("pinned port %s is in use", port), "Stop the program on that port or change listen_port in the profile")
+	default:
+		r.add("port", doctorWarn, fmt.Sprintf("port %s is in use; the next free pair will be taken", port), "Stop the program on that port if it is an old mitmproxy")
+	}
+}
+
+// doctorCA checks the selected profile's CA: on disk, installed, trusted
+// and otherwise healthy.
+func doctorCA(r *doctorReport) {
+	state, err := readCATrustState()
+	health := checkCAHealth(state, err, time.Now())
+	if !health.Present {
+		detail := fmt.Sprintf("no CA at %s", health.Path)
+		if err != nil {
+			detail = fmt.Sprintf("cannot read the CA: %v", err)
+		}
+		r.add("ca file", doctorFail, detail, "Run: mitmproxy-controller cert generate (or start mitmproxy once)")
+		r.add("ca installed", doctorSkip, "no CA on disk", "")
+		r.add("ca trusted", doctorSkip, "no CA on disk", "")
+		return
+	}
+	r.add("ca file", doctorPass, fmt.Sprintf("%s (%s)", health.Path, shortFingerprint(health.Fingerprint)), "")
+
+	switch {
+	case health.Installed:
+		r.add("ca installed", doctorPass, "in the system trust store", "")
+	case len(health.InstalledFingerprints) > 0:
+		r.add("ca installed", doctorFail, "another mitmproxy CA is installed instead", `Click "Install Current CA Certificate" in the tray`)
+	default:
+		r.add("ca installed", doctorFail, "not in the system trust store", `Click "Install CA Certificate" in the tray`)
+	}
+
+	switch {
+	case health.TrustedForSSL:
+		r.add("ca trusted", doctorPass, "trusted for SSL", "")
+	case health.Installed:
+		r.add("ca trusted", doctorFail, "installed but not trusted for SSL", `Click "Trust CA Certificate" in the tray`)
+	default:
+		r.add("ca trusted", doctorSkip, "not installed", "")
+	}
+
+	for _, issue := range health.Issues {
+		fix := "Run: mitmproxy-controller cert status"
+		switch issue.Kind {
+		case caIssueMismatch, caIssueUntrusted:
+			// Reported by the checks above.
+			continue
+		case caIssueExpired, caIssueNotYetValid, caIssueExpiring, caIssueWeakKey:
+			fix = "Run: mitmproxy-controller cert rotate"
+		case caIssueBrowser:
+			fix = `Click "Trust CA Certificate in …" in the tray`
+		}
+		r.add("ca health", doctorWarn, issue.Message, fix)
+	}
+}
+
+// doctorSystemProxy checks that the OS proxy points at the instance. A
+// disabled proxy is only a warning; commands started with exec do not need
+// it.
+func doctorSystemProxy(r *doctorReport, status *controlStatus, inst *controlInstance) {
+	if !isProxyEnabled() {
+		r.add("system proxy", doctorWarn, "disabled", `Click "Enable Proxy", or point the app at the proxy with mitmproxy-controller exec`)
+		return
+	}
+	port := proxyPort
+	if status != nil && status.ProxyPort != "" {
+		port = status.ProxyPort
+	} else if inst != nil {
+		port = inst.ProxyPort
+	}
+	drift, err := checkSystemProxy(port)
+	if err != nil {
+		r.add("system proxy", doctorWarn, fmt.Sprintf("cannot read the settings: %v", err), "")
+		return
+	}
+	if len(drift) > 0 {
+		r.add("system proxy", doctorFail, strings.Join(drift, "; "), `Click "Enable Proxy" again, or set system_proxy.watchdog.on_change: reassert in settings.yaml`)
+		return
+	}
+	r.add("system proxy", doctorPass, fmt.Sprintf("points at %s", net.JoinHostPort(proxyHost, port)), "")
+}
+
+// doctorFlow sends a request to a throwaway local server through the
+// instance and checks that it arrived with the marker it was sent with.
+func doctorFlow(r *doctorReport, inst *controlInstance) {
+	if inst == nil {
+		r.add("flow", doctorSkip, "no running instance", "")
+		return
+	}
+	if profile, ok := getProfileByID(inst.ProfileID); ok && !profile.ProxyCompat {
+		r.add("flow", doctorSkip, fmt.Sprintf("%s mode does not accept proxy clients", inst.Mode), "")
+		return
+	}
+	if err := doctorFlowRequest(inst.ProxyPort); err != nil {
+		r.add("flow", doctorFail, err.Error(), "Check the mitmproxy log and the profile's allow_hosts, ignore_hosts and scripts")
+		return
+	}
+	r.add("flow", doctorPass, "test request went through the proxy", "")
+}
+
+func doctorFlowRequest(port string) error {
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	marker := hex.EncodeToString(token)
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(proxyHost, "0"))
+	if err != nil {
+		return fmt.Errorf("cannot start the test server: %w", err)
+	}
+	received := make(chan string, 1)
+	server := &http.Server{
+		ReadHeaderTimeout: doctorFlowTimeout,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			select {
+			case received <- req.URL.Path:
+			default:
+			}
+			_, _ = io.WriteString(w, marker)
+		}),
+	}
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Close()
+
+	proxyURL := &url.URL{Scheme: "http", Host: net.JoinHostPort(proxyHost, port)}
+	client := &http.Client{
+		Timeout:   doctorFlowTimeout,
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+	}
+	resp, err := client.Get(fmt.Sprintf("http://%s/mitmproxy-controller-doctor/%s", listener.Addr(), marker))
+	if err != nil {
+		return fmt.Errorf("request through %s failed: %v", proxyURL.Host, err)
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+
+	select {
+	case path := <-received:
+		if !strings.HasSuffix(path, marker) {
+			return fmt.Errorf("the test server got %s", path)
+		}
+	default:
+		return fmt.Errorf("the proxy answered %s without reaching the test server", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != marker {
+		return fmt.Errorf("the proxy answered %s with a changed body", resp.Status)
+	}
+	return nil
+}
+
+// doctorSymbol marks a check in the text output.
+func doctorSymbol(status string) string {
+	switch status {
+	case doctorPass:
+		return "✓"
+	case doctorWarn:
+		return "⚠"
+	case doctorFail:
+		return "✗"
+	}
+	return "-"
+}
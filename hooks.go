@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	hookPreStart  = "pre_start"
+	hookPostStart = "post_start"
+	hookPreStop   = "pre_stop"
+	hookPostStop  = "post_stop"
+
+	defaultHookTimeout = 30 * time.Second
+)
+
+// hookDoneC hands the continuation of a hook that ran off the tray loop back
+// to the loop, which shows the status it returns. hooksOffLoop is set by the
+// tray; without it (CLI) hooks always run inline.
+var (
+	hookDoneC    = make(chan func() string)
+	hooksOffLoop bool
+)
+
+// ProfileHook is a shell command run around mitmproxy start/stop.
+type ProfileHook struct {
+	Command string
+	Timeout time.Duration
+	Dir     string
+}
+
+type ProfileHooks struct {
+	PreStart  *ProfileHook
+	PostStart *ProfileHook
+	PreStop   *ProfileHook
+	PostStop  *ProfileHook
+}
+
+type profileHooksFile struct {
+	PreStart  *profileHookFile `yaml:"pre_start"`
+	PostStart *profileHookFile `yaml:"post_start"`
+	PreStop   *profileHookFile `yaml:"pre_stop"`
+	PostStop  *profileHookFile `yaml:"post_stop"`
+}
+
+// profileHookFile accepts either a plain command string or a mapping with
+// command, timeout and dir.
+type profileHookFile struct {
+	Command string      `yaml:"command"`
+	Timeout interface{} `yaml:"timeout"`
+	Dir     string      `yaml:"dir"`
+}
+
+func (h *profileHookFile) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		h.Command = node.Value
+		return nil
+	}
+	type plain profileHookFile
+	return node.Decode((*plain)(h))
+}
+
+// hookContext describes the capture a hook runs for. It is exported to the
+// hook process as MITM_CONTROLLER_* environment variables.
+type hookContext struct {
+	Profile   ServiceProfile
+	FlowFile  string
+	PID       int
+	ProxyPort string
+	WebPort   string
+}
+
+func parseProfileHooks(raw profileHooksFile, baseDir string) (ProfileHooks, []string) {
+	var hooks ProfileHooks
+	var warnings []string
+
+	parse := func(name string, in *profileHookFile) *ProfileHook {
+		if in == nil {
+			return nil
+		}
+		hook, err := in.resolve(baseDir)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("hook %s: %v", name, err))
+			return nil
+		}
+		return hook
+	}
+
+	hooks.PreStart = parse(hookPreStart, raw.PreStart)
+	hooks.PostStart = parse(hookPostStart, raw.PostStart)
+	hooks.PreStop = parse(hookPreStop, raw.PreStop)
+	hooks.PostStop = parse(hookPostStop, raw.PostStop)
+	return hooks, warnings
+}
+
+func (h profileHookFile) resolve(baseDir string) (*ProfileHook, error) {
+	command := strings.TrimSpace(h.Command)
+	if command == "" {
+		return nil, fmt.Errorf("command is empty")
+	}
+
+	timeout, err := parseHookTimeout(h.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := expandHomePath(strings.TrimSpace(h.Dir))
+	if dir == "" {
+		dir = baseDir
+	} else if !filepath.IsAbs(dir) {
+		dir = filepath.Join(baseDir, dir)
+	}
+
+	return &ProfileHook{Command: command, Timeout: timeout, Dir: dir}, nil
+}
+
+// parseHookTimeout accepts Go durations ("90s", "2m") or a number of seconds.
+func parseHookTimeout(value interface{}) (time.Duration, error) {
+	if value == nil {
+		return defaultHookTimeout, nil
+	}
+
+	raw := strings.TrimSpace(optionValueToString(value))
+	if seconds, err := strconv.ParseFloat(raw, 64); err == nil {
+		if seconds <= 0 {
+			return 0, fmt.Errorf("timeout must be positive")
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q", raw)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("timeout must be positive")
+	}
+	return d, nil
+}
+
+func (h ProfileHooks) get(name string) *ProfileHook {
+	switch name {
+	case hookPreStart:
+		return h.PreStart
+	case hookPostStart:
+		return h.PostStart
+	case hookPreStop:
+		return h.PreStop
+	case hookPostStop:
+		return h.PostStop
+	}
+	return nil
+}
+
+func (h ProfileHooks) any() bool {
+	return h.PreStart != nil || h.PostStart != nil || h.PreStop != nil || h.PostStop != nil
+}
+
+// runProfileHookThen runs a hook and passes its error to then. With background
+// set, in the tray, a configured hook runs in a goroutine and then runs on the
+// tray loop once it finished; the returned status says the hook is running.
+// Otherwise then runs before it returns and its status is returned.
+func runProfileHookThen(name string, hc hookContext, background bool, then func(err error) string) string {
+	if !background || !hooksOffLoop || hc.Profile.Hooks.get(name) == nil {
+		return then(runProfileHook(name, hc))
+	}
+	go func() {
+		err := runProfileHook(name, hc)
+		hookDoneC <- func() string { return then(err) }
+	}()
+	return fmt.Sprintf("%s hook of %s running…", name, hc.Profile.Name)
+}
+
+// hookFailure is a then for runProfileHookThen that only reports failures.
+func hookFailure(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// runProfileHook runs the named hook of the context's profile, if any. Output
+// is appended to hooks.log in the logs directory.
+func runProfileHook(name string, hc hookContext) error {
+	hook := hc.Profile.Hooks.get(name)
+	if hook == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hook.Timeout)
+	defer cancel()
+
+	cmd := newHookCommand(ctx, hook.Command)
+	cmd.Dir = hook.Dir
+	cmd.Env = append(os.Environ(), hookEnvironment(name, hc)...)
+	// Don't wait forever on background children that inherited the output pipe.
+	cmd.WaitDelay = 5 * time.Second
+
+	started := time.Now()
+	out, err := cmd.CombinedOutput()
+	appendHookLog(name, hc.Profile, hook, out, err, time.Since(started))
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s hook timed out after %s", name, hook.Timeout)
+	}
+	if err != nil {
+		if last := lastOutputLine(out); last != "" {
+			return fmt.Errorf("%s hook failed: %s", name, last)
+		}
+		return fmt.Errorf("%s hook failed: %v", name, err)
+	}
+	return nil
+}
+
+func hookEnvironment(name string, hc hookContext) []string {
+	env := []string{
+		"MITM_CONTROLLER_HOOK=" + name,
+		"MITM_CONTROLLER_PROFILE_ID=" + hc.Profile.ID,
+		"MITM_CONTROLLER_PROFILE_NAME=" + hc.Profile.Name,
+		"MITM_CONTROLLER_PROFILE_FILE=" + hc.Profile.FilePath,
+		"MITM_CONTROLLER_FLOW_FILE=" + hc.FlowFile,
+		"MITM_CONTROLLER_LOGS_DIR=" + getLogsDirectory(),
+		"MITM_CONTROLLER_PROXY_HOST=" + proxyHost,
+		"MITM_CONTROLLER_PROXY_PORT=" + hc.ProxyPort,
+		"MITM_CONTROLLER_WEB_PORT=" + hc.WebPort,
+		"MITM_CONTROLLER_CONFDIR=" + profileConfdir(hc.Profile),
+	}
+	if hc.PID > 0 {
+		env = append(env, "MITM_CONTROLLER_PID="+strconv.Itoa(hc.PID))
+	}
+	return env
+}
+
+func appendHookLog(name string, profile ServiceProfile, hook *ProfileHook, out []byte, runErr error, elapsed time.Duration) {
+	if err := ensureLogsDir(); err != nil {
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(logsDir, "hooks.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	result := "ok"
+	if runErr != nil {
+		result = runErr.Error()
+	}
+	fmt.Fprintf(f, "=== %s %s [%s] %q in %s (%s, %s)\n",
+		time.Now().Format(time.RFC3339), name, profile.ID, hook.Command, hook.Dir, result, elapsed.Round(time.Millisecond))
+	if len(out) > 0 {
+		f.Write(out)
+		if out[len(out)-1] != '\n' {
+			f.WriteString("\n")
+		}
+	}
+}
+
+func lastOutputLine(out []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,19 @@
+//go:build darwin
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// lookupKeychainPassword reads a generic password from the login keychain.
+// Store one with: security add-generic-password -s <service> -a <account> -w
+func lookupKeychainPassword(service, account string) (string, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w").Output()
+	if err != nil {
+		return "", fmt.Errorf("no keychain item %q for account %q", service, account)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
@@ -0,0 +1,20 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// lookupKeychainPassword reads a password from the Secret Service (GNOME
+// Keyring, KWallet). Store one with:
+// secret-tool store --label=<service> service <service> account <account>
+func lookupKeychainPassword(service, account string) (string, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", service, "account", account).Output()
+	if err != nil || len(out) == 0 {
+		return "", fmt.Errorf("no secret-tool item %q for account %q", service, account)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
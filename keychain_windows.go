@@ -0,0 +1,75 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+)
+
+const credTypeGeneric = 1
+
+var (
+	advapi32     = syscall.NewLazyDLL("advapi32.dll")
+	credReadProc = advapi32.NewProc("CredReadW")
+	credFreeProc = advapi32.NewProc("CredFree")
+)
+
+// winCredential mirrors the CREDENTIALW structure.
+type winCredential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// lookupKeychainPassword reads a generic credential from Windows Credential
+// Manager. The target is "<service>:<account>", falling back to "<service>".
+// Store one with: cmdkey /generic:<service>:<account> /user:<account> /pass
+func lookupKeychainPassword(service, account string) (string, error) {
+	for _, target := range []string{service + ":" + account, service} {
+		if password, ok := readGenericCredential(target); ok {
+			return password, nil
+		}
+	}
+	return "", fmt.Errorf("no Credential Manager entry %q for account %q", service, account)
+}
+
+func readGenericCredential(target string) (string, bool) {
+	targetPtr, err := syscall.UTF16PtrFromString(target)
+	if err != nil {
+		return "", false
+	}
+
+	var cred *winCredential
+	ret, _, _ := credReadProc.Call(uintptr(unsafe.Pointer(targetPtr)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if ret == 0 || cred == nil {
+		return "", false
+	}
+	defer credFreeProc.Call(uintptr(unsafe.Pointer(cred)))
+
+	if cred.CredentialBlobSize == 0 || cred.CredentialBlob == nil {
+		return "", true
+	}
+	blob := unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize)
+
+	// cmdkey and the Credential Manager UI store passwords as UTF-16LE.
+	if len(blob)%2 == 0 {
+		u16 := make([]uint16, len(blob)/2)
+		for i := range u16 {
+			u16[i] = uint16(blob[2*i]) | uint16(blob[2*i+1])<<8
+		}
+		return string(utf16.Decode(u16)), true
+	}
+	return string(blob), true
+}
@@ -2,6 +2,11 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/getlantern/systray"
@@ -12,24 +17,75 @@ var (
 	mStatus       *systray.MenuItem
 	mStartMitm    *systray.MenuItem
 	mStopMitm     *systray.MenuItem
+	mInstances    *systray.MenuItem
+	mStartAlong   *systray.MenuItem
 	mEnableProxy  *systray.MenuItem
 	mDisableProxy *systray.MenuItem
+	mUpstream     *systray.MenuItem
 	mProfiles     *systray.MenuItem
+	mAutoSwitch   *systray.MenuItem
+	mAutoRule     *systray.MenuItem
 	mEditProfile  *systray.MenuItem
 	mOpenScripts  *systray.MenuItem
+	mManageProfs  *systray.MenuItem
+	mNewProfile   *systray.MenuItem
+	mCloneProfile *systray.MenuItem
+	mRenameProf   *systray.MenuItem
+	mDeleteProf   *systray.MenuItem
+	mForkProfile  *systray.MenuItem
+	mSyncSources  *systray.MenuItem
+	mEditRules    *systray.MenuItem
+	mEditSettings *systray.MenuItem
 	mViewFlows    *systray.MenuItem
 	mRevealLogs   *systray.MenuItem
 	mOpenMitmHome *systray.MenuItem
 	mEditConfig   *systray.MenuItem
+	mCAHealth     *systray.MenuItem
 	mInstallCert  *systray.MenuItem
 	mRemoveCert   *systray.MenuItem
+	mRotateCert   *systray.MenuItem
+	mExposeCA     *systray.MenuItem
 )
 
 var (
 	profileItems      = map[string]*systray.MenuItem{}
+	browserTrustItems = map[string]*systray.MenuItem{}
 	profileSelectionC = make(chan string, 32)
 )
 
+// instanceMenu is the tray submenu of one running instance. systray cannot
+// remove items, so menus are hidden when the instance stops and reused when
+// the profile starts again.
+type instanceMenu struct {
+	root        *systray.MenuItem
+	status      *systray.MenuItem
+	viewFlows   *systray.MenuItem
+	revealFlows *systray.MenuItem
+	makePrimary *systray.MenuItem
+	wireGuard   *systray.MenuItem
+	stop        *systray.MenuItem
+}
+
+type instanceAction struct {
+	profileID string
+	action    string
+}
+
+const (
+	instanceActionStart     = "start"
+	instanceActionStop      = "stop"
+	instanceActionPrimary   = "primary"
+	instanceActionView      = "view"
+	instanceActionReveal    = "reveal"
+	instanceActionWireGuard = "wireguard"
+)
+
+var (
+	instanceMenus   = map[string]*instanceMenu{}
+	alongsideItems  = map[string]*systray.MenuItem{}
+	instanceActionC = make(chan instanceAction, 32)
+)
+
 // Track cert state for click handler
 var (
 	certInstalled bool
@@ -37,16 +93,51 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		attachParentConsole()
+		os.Exit(runCLI(os.Args[1:]))
+	}
 	systray.Run(onReady, onExit)
 }
 
+// pollState is the OS state read once per status poll and handed to the
+// reconcilers, so a tick runs each query once.
+type pollState struct {
+	Network networkInfo
+	// OwnsProxy is set when this process enabled the system proxy.
+	OwnsProxy bool
+	Marker    proxyMarker
+	// MitmRunning is isMitmproxyRunning at the time of the poll.
+	MitmRunning bool
+}
+
+func readPollState() pollState {
+	poll := pollState{Network: currentNetworkInfo(), MitmRunning: isMitmproxyRunning()}
+	if marker, ok := loadProxyMarker(); ok && marker.PID == os.Getpid() {
+		poll.OwnsProxy, poll.Marker = true, marker
+	}
+	return poll
+}
+
 func onReady() {
 	systray.SetTitle("⚡")
 	systray.SetTooltip("mitmproxy Controller")
+	hooksOffLoop = true
 
 	if err := initProfiles(); err != nil {
 		fmt.Printf("Failed to initialize profiles: %v\n", err)
 	}
+	autoSwitch.enabled = loadControllerState().AutoSwitchEnabled
+	staleProxyResult := recoverStaleProxy()
+	if result := reconcilePACProxy(readPollState()); result != "" {
+		staleProxyResult = result
+	}
+	if result := recoverTransparentRedirects(); result != "" {
+		staleProxyResult = result
+	}
+	if err := startControlServer(); err != nil {
+		fmt.Printf("Failed to start control API: %v\n", err)
+	}
 
 	mStatus = systray.AddMenuItem("Status: Checking...", "Current status")
 	mStatus.Disable()
@@ -55,30 +146,50 @@ func onReady() {
 
 	mStartMitm = systray.AddMenuItem("Start mitmproxy", "Start mitmproxy process")
 	mStopMitm = systray.AddMenuItem("Stop mitmproxy", "Stop mitmproxy process")
+	mInstances = systray.AddMenuItem("Instances", "mitmproxy instances running side by side")
+	mStartAlong = mInstances.AddSubMenuItem("Start Profile Alongside", "Run another profile on its own ports")
 
 	systray.AddSeparator()
 
 	mEnableProxy = systray.AddMenuItem("Enable System Proxy", "Route traffic through mitmproxy")
 	mDisableProxy = systray.AddMenuItem("Disable System Proxy", "Disable system proxy")
+	mUpstream = systray.AddMenuItem("Upstream: direct", "Upstream proxy used by the running mitmproxy")
+	mUpstream.Disable()
 
 	systray.AddSeparator()
 
 	mProfiles = systray.AddMenuItem("Service Profile", "Select active service profile")
 	syncProfileSubmenu()
+	mAutoSwitch = systray.AddMenuItemCheckbox("Automatic Profile Switching", "Select profiles automatically from rules.yaml", autoSwitch.enabled)
+	mAutoRule = systray.AddMenuItem("Rule: not evaluated yet", "Rule that selected the current profile")
+	mAutoRule.Disable()
 	mEditProfile = systray.AddMenuItem("Edit Active Profile", "Open active service profile file")
 	mOpenScripts = systray.AddMenuItem("Open Active Scripts Folder", "Open folder for active profile scripts")
+	mManageProfs = systray.AddMenuItem("Manage Profiles", "Create, duplicate, rename or delete profiles")
+	mNewProfile = mManageProfs.AddSubMenuItem("New Profile...", "Create a new profile from the template")
+	mCloneProfile = mManageProfs.AddSubMenuItem("Duplicate Active Profile...", "Copy the active profile under a new id")
+	mRenameProf = mManageProfs.AddSubMenuItem("Rename Active Profile...", "Change the active profile's id")
+	mDeleteProf = mManageProfs.AddSubMenuItem("Delete Active Profile", "Move the active profile to the trash folder")
+	mForkProfile = mManageProfs.AddSubMenuItem("Fork Active Team Profile...", "Copy the active read-only profile into an editable local profile")
+	mSyncSources = mManageProfs.AddSubMenuItem("Sync Team Profiles", "Pull profile sources configured in settings.yaml")
+	mEditRules = mManageProfs.AddSubMenuItem("Edit Profile Rules", "Open rules.yaml used by automatic profile switching")
 
 	systray.AddSeparator()
 
 	mViewFlows = systray.AddMenuItem("View Flows (Web UI)", "Open mitmweb interface in browser")
 	mRevealLogs = systray.AddMenuItem("Reveal Logs Folder", "Open logs folder in file manager")
-	mOpenMitmHome = systray.AddMenuItem("Open mitmproxy Home Folder", "Open ~/.mitmproxy folder in file manager")
-	mEditConfig = systray.AddMenuItem("Edit mitmproxy Config", "Open ~/.mitmproxy/config.yaml in your default editor")
+	mOpenMitmHome = systray.AddMenuItem("Open mitmproxy Home Folder", "Open the selected profile's mitmproxy folder in file manager")
+	mEditConfig = systray.AddMenuItem("Edit mitmproxy Config", "Open the selected profile's mitmproxy config.yaml in your default editor")
+	mEditSettings = systray.AddMenuItem("Edit Controller Settings", "Open mitmproxy-controller settings.yaml in your default editor")
 
 	systray.AddSeparator()
 
+	mCAHealth = systray.AddMenuItem("CA: not created yet", "mitmproxy CA key, expiry and trust")
+	mCAHealth.Disable()
 	mInstallCert = systray.AddMenuItem("Install CA Certificate", "Install mitmproxy CA cert for HTTPS interception")
 	mRemoveCert = systray.AddMenuItem("Remove CA Certificate", "Remove mitmproxy CA cert from system")
+	mRotateCert = systray.AddMenuItem("Rotate CA Certificate…", "Replace the mitmproxy CA with a new one and trust it")
+	mExposeCA = systray.AddMenuItem(caExportMenuTitle(), "Serve the CA on the LAN with a QR code for phones and other machines")
 
 	systray.AddSeparator()
 
@@ -89,7 +200,12 @@ func onReady() {
 	mQuit := systray.AddMenuItem("Quit", "Quit the app")
 
 	// Update status initially
+	evaluateAutoSwitch(false, currentNetworkInfo())
 	updateStatus()
+	if staleProxyResult != "" {
+		mStatus.SetTitle(staleProxyResult)
+	}
+	watchShutdownSignals()
 
 	// Single goroutine handles both periodic polling and menu clicks
 	// This ensures thread-safe access to systray UI
@@ -100,11 +216,57 @@ func onReady() {
 		for {
 			select {
 			case <-ticker.C:
+				poll := readPollState()
+				if result := evaluateAutoSwitch(false, poll.Network); result != "" {
+					mStatus.SetTitle(result)
+				}
+				if result := reconcileProxyServices(poll); result != "" {
+					mStatus.SetTitle(result)
+				}
+				if result := reconcilePACProxy(poll); result != "" {
+					mStatus.SetTitle(result)
+				}
+				if result := reconcileSystemProxy(poll); result != "" {
+					mStatus.SetTitle(result)
+				}
+				updateStatus()
+
+			case <-rulesTriggerC:
+				if result := evaluateAutoSwitch(true, currentNetworkInfo()); result != "" {
+					mStatus.SetTitle(result)
+				}
+				updateStatus()
+
+			case <-mAutoSwitch.ClickedCh:
+				enabled := !mAutoSwitch.Checked()
+				if err := setAutoSwitchEnabled(enabled); err != nil {
+					mStatus.SetTitle(fmt.Sprintf("Failed to save auto switching state: %v", err))
+				}
+				if enabled {
+					mAutoSwitch.Check()
+					if result := evaluateAutoSwitch(true, currentNetworkInfo()); result != "" {
+						mStatus.SetTitle(result)
+					}
+				} else {
+					mAutoSwitch.Uncheck()
+				}
 				updateStatus()
 
+			case <-mEditRules.ClickedCh:
+				rulesPath, err := ensureRulesFileExists()
+				if err != nil {
+					mStatus.SetTitle(fmt.Sprintf("Failed to prepare rules: %v", err))
+					continue
+				}
+				if err := openFile(rulesPath); err != nil {
+					mStatus.SetTitle(fmt.Sprintf("Failed to open rules: %v", err))
+					continue
+				}
+				mStatus.SetTitle("Opened rules.yaml")
+
 			case <-mStartMitm.ClickedCh:
 				disableAllActions()
-				mStatus.SetTitle(startMitmproxy())
+				mStatus.SetTitle(startMitmInBackground())
 				updateStatus()
 
 			case <-mStopMitm.ClickedCh:
@@ -126,6 +288,33 @@ func onReady() {
 				mStatus.SetTitle(applyProfileSelection(profileID))
 				updateStatus()
 
+			case action := <-instanceActionC:
+				mStatus.SetTitle(handleInstanceAction(action))
+				updateStatus()
+
+			case start := <-controlStartC:
+				if result := startInstanceForControl(start); result != "" {
+					mStatus.SetTitle(result)
+				}
+				updateStatus()
+
+			case continuation := <-hookDoneC:
+				if result := continuation(); result != "" {
+					mStatus.SetTitle(result)
+				}
+				updateStatus()
+
+			case rotate := <-controlRotateC:
+				rotation, err := rotateProfileCA(rotate.profileID, rotate.opts)
+				if err != nil {
+					mStatus.SetTitle(fmt.Sprintf("Failed to rotate CA: %v", err))
+				} else {
+					mStatus.SetTitle(rotation.summary())
+				}
+				rotate.reply <- controlRotateResult{rotation: rotation, err: err}
+				invalidateCATrustState()
+				updateStatus()
+
 			case <-mEditProfile.ClickedCh:
 				profilePath := selectedProfilePath()
 				if profilePath == "" {
@@ -136,6 +325,10 @@ func onReady() {
 					mStatus.SetTitle(fmt.Sprintf("Failed to open profile: %v", err))
 					continue
 				}
+				if p, ok := getSelectedProfile(); ok && p.ReadOnly {
+					mStatus.SetTitle("Opened read-only team profile (fork it to make changes)")
+					continue
+				}
 				mStatus.SetTitle("Opened active profile")
 
 			case <-mOpenScripts.ClickedCh:
@@ -150,6 +343,37 @@ func onReady() {
 				}
 				mStatus.SetTitle("Opened scripts folder")
 
+			case <-mNewProfile.ClickedCh:
+				mStatus.SetTitle(newProfileFromTray())
+				syncProfileSubmenu()
+				updateStatus()
+
+			case <-mCloneProfile.ClickedCh:
+				mStatus.SetTitle(cloneProfileFromTray())
+				syncProfileSubmenu()
+				updateStatus()
+
+			case <-mRenameProf.ClickedCh:
+				mStatus.SetTitle(renameProfileFromTray())
+				syncProfileSubmenu()
+				updateStatus()
+
+			case <-mDeleteProf.ClickedCh:
+				mStatus.SetTitle(deleteProfileFromTray())
+				syncProfileSubmenu()
+				updateStatus()
+
+			case <-mForkProfile.ClickedCh:
+				mStatus.SetTitle(forkProfileFromTray())
+				syncProfileSubmenu()
+				updateStatus()
+
+			case <-mSyncSources.ClickedCh:
+				mStatus.SetTitle("Syncing team profiles...")
+				mStatus.SetTitle(syncProfileSourcesFromTray())
+				syncProfileSubmenu()
+				updateStatus()
+
 			case <-mViewFlows.ClickedCh:
 				if isWebUIAvailable() {
 					openURL(getWebUIURL())
@@ -168,7 +392,7 @@ func onReady() {
 					mStatus.SetTitle(fmt.Sprintf("Failed to open mitmproxy home: %v", err))
 					continue
 				}
-				mStatus.SetTitle("Opened ~/.mitmproxy")
+				mStatus.SetTitle("Opened " + confdirName(mitmHomeDir))
 
 			case <-mEditConfig.ClickedCh:
 				configPath, err := ensureMitmConfigExists()
@@ -182,18 +406,46 @@ func onReady() {
 				}
 				mStatus.SetTitle("Opened config.yaml")
 
+			case <-mEditSettings.ClickedCh:
+				settingsPath, err := ensureSettingsFileExists()
+				if err != nil {
+					mStatus.SetTitle(fmt.Sprintf("Failed to prepare settings: %v", err))
+					continue
+				}
+				if err := openFile(settingsPath); err != nil {
+					mStatus.SetTitle(fmt.Sprintf("Failed to open settings: %v", err))
+					continue
+				}
+				mStatus.SetTitle("Opened settings.yaml")
+
 			case <-mInstallCert.ClickedCh:
 				if certInstalled && !certTrusted {
-					mStatus.SetTitle(trustCACertificate())
+					mStatus.SetTitle(trustCACertificate() + installTrustTargets())
 				} else {
-					mStatus.SetTitle(installCACertificate())
+					mStatus.SetTitle(installCACertificate() + installTrustTargets())
 				}
+				invalidateCATrustState()
 				updateStatus()
 
 			case <-mRemoveCert.ClickedCh:
-				mStatus.SetTitle(removeCACertificate())
+				mStatus.SetTitle(removeCACertificate() + removeTrustTargets())
+				invalidateCATrustState()
 				updateStatus()
 
+			case <-mRotateCert.ClickedCh:
+				mStatus.SetTitle(rotateCAFromTray())
+				invalidateCATrustState()
+				updateStatus()
+
+			case <-mExposeCA.ClickedCh:
+				mStatus.SetTitle(toggleCAExportFromTray())
+				mExposeCA.SetTitle(caExportMenuTitle())
+
+			case reason := <-caExportDoneC:
+				caExportCurrent = nil
+				mExposeCA.SetTitle(caExportMenuTitle())
+				mStatus.SetTitle("CA export stopped: " + reason)
+
 			case <-mRefresh.ClickedCh:
 				if err := loadProfilesFromDisk(); err != nil {
 					mStatus.SetTitle(fmt.Sprintf("Failed to refresh profiles: %v", err))
@@ -217,13 +469,14 @@ func syncProfileSubmenu() {
 	for _, profile := range profiles {
 		p := profile
 		visibleIDs[p.ID] = true
+		title := profileMenuTitle(p)
 		item, ok := profileItems[p.ID]
 		if !ok {
-			item = mProfiles.AddSubMenuItemCheckbox(p.Name, p.ID, p.ID == selectedProfileID)
+			item = mProfiles.AddSubMenuItemCheckbox(title, p.ID, p.ID == selectedProfileID)
 			profileItems[p.ID] = item
 			wireProfileSelection(p.ID, item)
 		} else {
-			item.SetTitle(p.Name)
+			item.SetTitle(title)
 			item.Show()
 		}
 
@@ -232,15 +485,33 @@ func syncProfileSubmenu() {
 		} else {
 			item.Uncheck()
 		}
+
+		alongside, ok := alongsideItems[p.ID]
+		if !ok {
+			alongside = mStartAlong.AddSubMenuItem(title, "Start "+p.ID+" on its own ports")
+			alongsideItems[p.ID] = alongside
+			wireInstanceAction(p.ID, instanceActionStart, alongside)
+		} else {
+			alongside.SetTitle(title)
+			alongside.Show()
+		}
 	}
 
 	for id, item := range profileItems {
 		if !visibleIDs[id] {
 			item.Hide()
+			alongsideItems[id].Hide()
 		}
 	}
 }
 
+func profileMenuTitle(p ServiceProfile) string {
+	if p.ReadOnly {
+		return fmt.Sprintf("%s / %s (read-only)", p.Source, p.Name)
+	}
+	return p.Name
+}
+
 func wireProfileSelection(id string, menuItem *systray.MenuItem) {
 	go func() {
 		for range menuItem.ClickedCh {
@@ -252,35 +523,381 @@ func wireProfileSelection(id string, menuItem *systray.MenuItem) {
 	}()
 }
 
+func wireInstanceAction(id, action string, menuItem *systray.MenuItem) {
+	go func() {
+		for range menuItem.ClickedCh {
+			select {
+			case instanceActionC <- instanceAction{profileID: id, action: action}:
+			default:
+			}
+		}
+	}()
+}
+
+func syncProfileChecks() {
+	for id, item := range profileItems {
+		if id == selectedProfileID {
+			item.Check()
+		} else {
+			item.Uncheck()
+		}
+	}
+}
+
+// applyProfileSelection makes profileID the primary profile. A profile that
+// already runs alongside is promoted as is; otherwise the running primary
+// instance is replaced by the new profile.
 func applyProfileSelection(profileID string) string {
 	if profileID == selectedProfileID {
 		return fmt.Sprintf("Service profile already selected: %s", selectedProfileName())
 	}
 
+	previousID := selectedProfileID
+	previousRunning := isMitmproxyRunning()
+
 	if err := setSelectedProfile(profileID); err != nil {
 		return fmt.Sprintf("Failed to select profile: %v", err)
 	}
+	syncProfileChecks()
 
-	for id, item := range profileItems {
+	name := selectedProfileName()
+	if _, running := getInstance(profileID); running {
+		return fmt.Sprintf("Profile %s is now primary%s", name, repointSystemProxy())
+	}
+	if previousRunning {
+		stopResult := stopMitmFor(previousID)
+		startResult := startMitmproxy()
+		return fmt.Sprintf("Profile %s applied (%s, %s)%s", name, stopResult, startResult, repointSystemProxy())
+	}
+
+	return fmt.Sprintf("Selected profile: %s%s", name, repointSystemProxy())
+}
+
+// repointSystemProxy re-applies a system proxy set by the controller after
+// the primary profile changed, moving it to the primary instance's port and
+// its bypass hosts. It returns a status suffix.
+func repointSystemProxy() string {
+	if !controllerOwnsSystemProxy() {
+		return ""
+	}
+	previous, _ := loadProxyMarker()
+	port := systemProxyPort()
+	if err := snapshotSystemProxy(); err != nil {
+		return fmt.Sprintf(" | failed to save proxy settings: %v", err)
+	}
+	if err := enableSystemProxy(); err != nil {
+		return fmt.Sprintf(" | failed to move system proxy: %v", err)
+	}
+	_ = markProxyEnabled()
+	if previous.Port == port {
+		return ""
+	}
+	return fmt.Sprintf(" | system proxy now on port %s", port)
+}
+
+func handleInstanceAction(action instanceAction) string {
+	if action.action == instanceActionStart {
+		if err := loadProfilesFromDisk(); err != nil {
+			return fmt.Sprintf("Failed to load profiles: %v", err)
+		}
+		profile, ok := getProfileByID(action.profileID)
+		if !ok {
+			return fmt.Sprintf("Profile %s not found", action.profileID)
+		}
+		return startProfileInstanceInBackground(profile, nil)
+	}
+
+	inst, running := getInstance(action.profileID)
+	if !running {
+		return fmt.Sprintf("Profile %s is not running", action.profileID)
+	}
+
+	switch action.action {
+	case instanceActionStop:
+		return stopProfileInstanceInBackground(action.profileID)
+	case instanceActionPrimary:
+		if err := setSelectedProfile(action.profileID); err != nil {
+			return fmt.Sprintf("Failed to select profile: %v", err)
+		}
+		syncProfileChecks()
+		return fmt.Sprintf("Profile %s is now primary%s", inst.Profile.Name, repointSystemProxy())
+	case instanceActionView:
+		if err := openURL(inst.webUIURL()); err != nil {
+			return fmt.Sprintf("Failed to open web UI: %v", err)
+		}
+		return fmt.Sprintf("Opened web UI of %s", inst.Profile.Name)
+	case instanceActionReveal:
+		if err := revealInFileManager(filepath.Dir(inst.LogPath)); err != nil {
+			return fmt.Sprintf("Failed to open logs folder: %v", err)
+		}
+		return fmt.Sprintf("Flows of %s: %s", inst.Profile.Name, filepath.Base(inst.LogPath))
+	case instanceActionWireGuard:
+		configPath, qrPath, err := writeWireGuardClientFiles(inst)
+		if err != nil {
+			return fmt.Sprintf("Failed to write WireGuard config: %v", err)
+		}
+		_ = openFile(configPath)
+		if err := openFile(qrPath); err != nil {
+			return fmt.Sprintf("Failed to open WireGuard QR code: %v", err)
+		}
+		return fmt.Sprintf("WireGuard client config of %s: %s", inst.Profile.Name, configPath)
+	}
+	return ""
+}
+
+// startInstanceForControl starts an instance requested through the control
+// API (exec, env) and returns the status to show. The reply is sent once the
+// instance runs, after a pre_start hook that ran off the tray loop.
+func startInstanceForControl(start controlStart) string {
+	if err := loadProfilesFromDisk(); err != nil {
+		start.reply <- controlStartResult{err: fmt.Errorf("failed to load profiles: %w", err)}
+		return ""
+	}
+	profileID := start.profileID
+	if profileID == "" {
+		profileID = selectedProfileID
+	}
+	profile, ok := getProfileByID(profileID)
+	if !ok {
+		start.reply <- controlStartResult{err: fmt.Errorf("profile %s not found", profileID)}
+		return ""
+	}
+
+	return startProfileInstanceInBackground(profile, func(result string) string {
+		if inst, running := getInstance(profile.ID); running {
+			start.reply <- controlStartResult{instance: newControlInstance(inst)}
+		} else {
+			start.reply <- controlStartResult{err: fmt.Errorf("%s", result)}
+		}
+		return result
+	})
+}
+
+func syncInstanceMenus(running []*mitmInstance) {
+	visible := make(map[string]bool, len(running))
+	for _, inst := range running {
+		id := inst.Profile.ID
+		visible[id] = true
+
+		menu, ok := instanceMenus[id]
+		if !ok {
+			menu = &instanceMenu{root: mInstances.AddSubMenuItem(id, "Running instance of "+id)}
+			menu.status = menu.root.AddSubMenuItem("", "Instance status")
+			menu.status.Disable()
+			menu.viewFlows = menu.root.AddSubMenuItem("View Flows (Web UI)", "Open this instance's mitmweb interface")
+			menu.revealFlows = menu.root.AddSubMenuItem("Reveal Flow File", "Open the folder with this instance's flow file")
+			menu.makePrimary = menu.root.AddSubMenuItem("Make Primary", "Select this profile and point the system proxy at it")
+			menu.wireGuard = menu.root.AddSubMenuItem("Show WireGuard Client Config", "Open the client configuration and its QR code")
+			menu.stop = menu.root.AddSubMenuItem("Stop", "Stop this instance")
+			wireInstanceAction(id, instanceActionView, menu.viewFlows)
+			wireInstanceAction(id, instanceActionReveal, menu.revealFlows)
+			wireInstanceAction(id, instanceActionPrimary, menu.makePrimary)
+			wireInstanceAction(id, instanceActionWireGuard, menu.wireGuard)
+			wireInstanceAction(id, instanceActionStop, menu.stop)
+			instanceMenus[id] = menu
+		}
+
+		title := fmt.Sprintf("%s — port %s", inst.Profile.Name, inst.ProxyPort)
 		if id == selectedProfileID {
-			item.Check()
+			title += " (primary)"
+			menu.makePrimary.Disable()
 		} else {
-			item.Uncheck()
+			menu.makePrimary.Enable()
+		}
+		menu.root.SetTitle(title)
+		menu.root.Show()
+		menu.status.SetTitle(inst.statusLine())
+		if inst.UsingWeb && inst.Profile.WebUICompat {
+			menu.viewFlows.Enable()
+		} else {
+			menu.viewFlows.Disable()
+		}
+		if profileModeName(inst.Profile) == "wireguard" {
+			menu.wireGuard.Show()
+		} else {
+			menu.wireGuard.Hide()
 		}
 	}
 
-	name := selectedProfileName()
-	if isMitmproxyRunning() {
-		stopResult := stopMitmproxy()
+	for id, menu := range instanceMenus {
+		if !visible[id] {
+			menu.root.Hide()
+		}
+	}
+	for id, item := range alongsideItems {
+		if visible[id] {
+			item.Disable()
+		} else {
+			item.Enable()
+		}
+	}
+	mInstances.SetTitle(fmt.Sprintf("Instances: %d running", len(running)))
+}
+
+func newProfileFromTray() string {
+	id, ok, err := promptText("New Profile", "Profile id (letters, digits and dashes):", "")
+	if err != nil {
+		return fmt.Sprintf("Failed to create profile: %v", err)
+	}
+	if !ok {
+		return "Profile creation cancelled"
+	}
+
+	profile, err := createProfile(id, "")
+	if err != nil {
+		return fmt.Sprintf("Failed to create profile: %v", err)
+	}
+	if err := openFile(profile.FilePath); err != nil {
+		return fmt.Sprintf("Created profile %s (failed to open: %v)", profile.ID, err)
+	}
+	return fmt.Sprintf("Created profile %s", profile.ID)
+}
+
+func cloneProfileFromTray() string {
+	source, ok := getSelectedProfile()
+	if !ok {
+		return "No active profile found"
+	}
+
+	id, ok, err := promptText("Duplicate Profile", fmt.Sprintf("New id for the copy of %s:", source.Name), source.ID+"-copy")
+	if err != nil {
+		return fmt.Sprintf("Failed to duplicate profile: %v", err)
+	}
+	if !ok {
+		return "Duplicate cancelled"
+	}
+
+	profile, err := cloneProfile(source.ID, id)
+	if err != nil {
+		return fmt.Sprintf("Failed to duplicate profile: %v", err)
+	}
+	if err := openFile(profile.FilePath); err != nil {
+		return fmt.Sprintf("Duplicated %s to %s (failed to open: %v)", source.ID, profile.ID, err)
+	}
+	return fmt.Sprintf("Duplicated %s to %s", source.ID, profile.ID)
+}
+
+func renameProfileFromTray() string {
+	source, ok := getSelectedProfile()
+	if !ok {
+		return "No active profile found"
+	}
+	if source.ID == defaultProfileID {
+		return "The default profile cannot be renamed"
+	}
+
+	id, ok, err := promptText("Rename Profile", fmt.Sprintf("New id for %s:", source.Name), source.ID)
+	if err != nil {
+		return fmt.Sprintf("Failed to rename profile: %v", err)
+	}
+	if !ok || sanitizeProfileID(id) == source.ID {
+		return "Rename cancelled"
+	}
+
+	profile, err := renameProfile(source.ID, id, "")
+	if err != nil {
+		return fmt.Sprintf("Failed to rename profile: %v", err)
+	}
+	renameInstance(source.ID, profile.ID)
+	return fmt.Sprintf("Renamed %s to %s", source.ID, profile.ID)
+}
+
+func deleteProfileFromTray() string {
+	source, ok := getSelectedProfile()
+	if !ok {
+		return "No active profile found"
+	}
+	if source.ID == defaultProfileID {
+		return "The default profile cannot be deleted"
+	}
+
+	confirmed, err := confirmAction("Delete Profile",
+		fmt.Sprintf("Delete profile %s? The file is moved to the trash folder.", source.Name))
+	if err != nil {
+		return fmt.Sprintf("Failed to delete profile: %v", err)
+	}
+	if !confirmed {
+		return "Delete cancelled"
+	}
+
+	wasRunning := isMitmproxyRunning()
+	if _, err := deleteProfile(source.ID); err != nil {
+		return fmt.Sprintf("Failed to delete profile: %v", err)
+	}
+
+	result := fmt.Sprintf("Deleted %s, selected %s", source.Name, selectedProfileName())
+	if wasRunning {
+		stopResult := stopMitmFor(source.ID)
 		startResult := startMitmproxy()
-		return fmt.Sprintf("Profile %s applied (%s, %s)", name, stopResult, startResult)
+		result = fmt.Sprintf("%s (%s, %s)", result, stopResult, startResult)
+	}
+	return result
+}
+
+func forkProfileFromTray() string {
+	source, ok := getSelectedProfile()
+	if !ok {
+		return "No active profile found"
+	}
+	if !source.ReadOnly {
+		return "Active profile is already editable"
 	}
 
-	return fmt.Sprintf("Selected profile: %s", name)
+	defaultID := source.ID[strings.LastIndex(source.ID, "/")+1:]
+	id, ok, err := promptText("Fork Team Profile", fmt.Sprintf("Local id for the fork of %s:", source.ID), defaultID)
+	if err != nil {
+		return fmt.Sprintf("Failed to fork profile: %v", err)
+	}
+	if !ok {
+		return "Fork cancelled"
+	}
+
+	profile, err := forkProfile(source.ID, id)
+	if err != nil {
+		return fmt.Sprintf("Failed to fork profile: %v", err)
+	}
+	if err := openFile(profile.FilePath); err != nil {
+		return fmt.Sprintf("Forked %s to %s (failed to open: %v)", source.ID, profile.ID, err)
+	}
+	return fmt.Sprintf("Forked %s to %s", source.ID, profile.ID)
+}
+
+func syncProfileSourcesFromTray() string {
+	synced, err := syncProfileSources("")
+	if err != nil {
+		return fmt.Sprintf("Failed to sync team profiles: %v", err)
+	}
+	if len(synced) == 0 {
+		return "No team profile sources configured (see settings.yaml)"
+	}
+	return fmt.Sprintf("Synced team profiles: %s", strings.Join(synced, ", "))
 }
 
 func onExit() {
-	// Cleanup if needed
+	if result := releaseSystemProxy(); result != "" {
+		fmt.Println(result)
+	}
+	stopPACServer()
+	stopControlServer()
+	// Redirect rules must not outlive the process that can remove them.
+	for _, inst := range runningInstances() {
+		_ = releaseInstanceMode(inst)
+	}
+}
+
+// watchShutdownSignals restores the system proxy on SIGINT/SIGTERM before
+// the tray quits. A second signal terminates immediately.
+func watchShutdownSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		if result := releaseSystemProxy(); result != "" {
+			fmt.Println(result)
+		}
+		systray.Quit()
+	}()
 }
 
 func disableAllActions() {
@@ -293,27 +910,52 @@ func disableAllActions() {
 func updateStatus() {
 	mitmRunning := isMitmproxyRunning()
 	proxyEnabled := isProxyEnabled()
+	proxyState := "Enabled"
+	if proxyEnabled && isControllerPACActive() {
+		proxyState = "PAC"
+	}
 	profileName := selectedProfileName()
 	proxyCompatible, webCompatible := selectedProfileCompatibility()
 	warnings := selectedProfileWarnings()
 	loadWarnings := profileLoadWarnings()
+	caState, caErr := cachedCATrustState()
 
-	// Update status text and icon
-	var statusText string
+	health := checkCAHealth(caState, caErr, time.Now())
+
+	// Update status text and icon; CA warnings add a warning sign
+	var icon, statusText string
 	if mitmRunning && proxyEnabled {
-		systray.SetTitle("🟢")
-		statusText = "mitmproxy: Running | Proxy: Enabled"
+		icon = "🟢"
+		statusText = "mitmproxy: Running | Proxy: " + proxyState
 	} else if mitmRunning {
-		systray.SetTitle("🟡")
+		icon = "🟡"
 		statusText = "mitmproxy: Running | Proxy: Disabled"
 	} else if proxyEnabled {
-		systray.SetTitle("🟠")
-		statusText = "mitmproxy: Stopped | Proxy: Enabled"
+		icon = "🟠"
+		statusText = "mitmproxy: Stopped | Proxy: " + proxyState
 	} else {
-		systray.SetTitle("⚫")
+		icon = "⚫"
 		statusText = "mitmproxy: Stopped | Proxy: Disabled"
 	}
+	if summary := health.statusSummary(); summary != "" {
+		systray.SetTitle(icon + "⚠")
+		systray.SetTooltip("mitmproxy Controller | " + summary)
+	} else {
+		systray.SetTitle(icon)
+		systray.SetTooltip("mitmproxy Controller")
+	}
 	statusText = fmt.Sprintf("%s | Profile: %s", statusText, profileName)
+	running := runningInstances()
+	if len(running) > 1 {
+		statusText = fmt.Sprintf("%s | Instances: %d", statusText, len(running))
+	}
+	drift := proxyDrift()
+	if len(drift) > 0 {
+		statusText = fmt.Sprintf("%s | Proxy changed externally: %s", statusText, drift[0])
+	}
+	if summary := health.statusSummary(); summary != "" {
+		statusText += " | " + summary
+	}
 	if len(warnings) > 0 {
 		statusText = fmt.Sprintf("%s | Warnings: %d", statusText, len(warnings))
 	}
@@ -322,6 +964,15 @@ func updateStatus() {
 	}
 	mStatus.SetTitle(statusText)
 	mProfiles.SetTitle(fmt.Sprintf("Service Profile: %s", profileName))
+	if p, ok := getSelectedProfile(); ok && p.ReadOnly {
+		mForkProfile.Enable()
+		mRenameProf.Disable()
+		mDeleteProf.Disable()
+	} else {
+		mForkProfile.Disable()
+		mRenameProf.Enable()
+		mDeleteProf.Enable()
+	}
 
 	// Enable/disable menu items based on current state
 	if mitmRunning {
@@ -335,14 +986,58 @@ func updateStatus() {
 	if !proxyCompatible {
 		mEnableProxy.Disable()
 		mDisableProxy.Disable()
+	} else if len(drift) > 0 {
+		mEnableProxy.SetTitle("Re-apply System Proxy")
+		mEnableProxy.Enable()
+		mDisableProxy.Enable()
 	} else if proxyEnabled {
+		mEnableProxy.SetTitle("Enable System Proxy")
 		mEnableProxy.Disable()
 		mDisableProxy.Enable()
 	} else {
+		mEnableProxy.SetTitle("Enable System Proxy")
 		mEnableProxy.Enable()
 		mDisableProxy.Disable()
 	}
 
+	if autoSwitch.enabled {
+		mAutoRule.SetTitle(autoSwitchMenuTitle())
+		mAutoRule.Show()
+	} else {
+		mAutoRule.Hide()
+	}
+
+	syncInstanceMenus(running)
+	// With more than one profile the menu offers "Start Profile Alongside"
+	// even before anything runs.
+	if len(running) > 0 || len(listProfiles()) > 1 {
+		mInstances.Show()
+	} else {
+		mInstances.Hide()
+	}
+
+	status := controlStatus{
+		MitmRunning:  mitmRunning,
+		ProxyEnabled: proxyEnabled,
+		ProfileID:    selectedProfileID,
+		ProfileName:  profileName,
+		AutoSwitch:   autoSwitch.enabled,
+		MatchedRule:  autoSwitch.matchedDesc,
+		ProxyPort:    systemProxyPort(),
+		ProxyDrift:   drift,
+	}
+	for _, inst := range running {
+		status.Instances = append(status.Instances, newControlInstance(inst))
+	}
+	publishControlStatus(status)
+
+	if inst, ok := primaryInstance(); ok {
+		mUpstream.SetTitle(fmt.Sprintf("Upstream: %s", inst.Upstream))
+		mUpstream.Show()
+	} else {
+		mUpstream.Hide()
+	}
+
 	// View Flows only available when mitmweb is running
 	if isWebUIAvailable() && webCompatible {
 		mViewFlows.Enable()
@@ -350,11 +1045,29 @@ func updateStatus() {
 		mViewFlows.Disable()
 	}
 
-	// Update cert menu items based on installation and trust status
-	certInstalled = isCertInstalled()
-	certTrusted = isCertTrusted()
-
-	if certTrusted {
+	// Update cert menu items based on installation and trust status of the
+	// CA on disk, identified by fingerprint, in the system store and in
+	// every browser profile with its own NSS database
+	certInstalled = caErr == nil && caState.Installed
+	certTrusted = certInstalled && health.TrustedForSSL
+	untrustedBrowsers := caState.untrustedBrowsers()
+
+	mCAHealth.SetTitle(health.menuTitle())
+	syncBrowserTrustMenus(caState.Browsers)
+	mRemoveCert.SetTitle("Remove CA Certificate")
+	if caErr == nil && caState.mismatch() {
+		mInstallCert.SetTitle("⚠ Install Current CA Certificate (installed one differs)")
+		mInstallCert.Enable()
+		mRemoveCert.SetTitle("Remove Old CA Certificate")
+		mRemoveCert.Enable()
+	} else if certTrusted && len(untrustedBrowsers) > 0 {
+		mInstallCert.SetTitle(fmt.Sprintf("Trust CA Certificate in %s", untrustedBrowsers[0].label()))
+		if len(untrustedBrowsers) > 1 {
+			mInstallCert.SetTitle(fmt.Sprintf("Trust CA Certificate in %d Browser Profiles", len(untrustedBrowsers)))
+		}
+		mInstallCert.Enable()
+		mRemoveCert.Enable()
+	} else if certTrusted {
 		mInstallCert.SetTitle("CA Certificate ✓ Trusted")
 		mInstallCert.Disable()
 		mRemoveCert.Enable()
@@ -366,6 +1079,38 @@ func updateStatus() {
 		mInstallCert.SetTitle("Install CA Certificate")
 		mInstallCert.Enable()
 		mRemoveCert.Disable()
+		for _, b := range caState.Browsers {
+			if b.Installed {
+				mRemoveCert.Enable()
+			}
+		}
+	}
+}
+
+// syncBrowserTrustMenus lists the CA's state per browser profile below the
+// CA item; items of profiles that went away are hidden.
+func syncBrowserTrustMenus(browsers []browserTrust) {
+	visible := make(map[string]bool, len(browsers))
+	for _, b := range browsers {
+		visible[b.Path] = true
+		item, ok := browserTrustItems[b.Path]
+		if !ok {
+			item = mCAHealth.AddSubMenuItem("", b.Path)
+			item.Disable()
+			browserTrustItems[b.Path] = item
+		}
+		item.SetTitle(fmt.Sprintf("%s: %s", b.label(), b.statusLabel()))
+		item.Show()
+	}
+	for path, item := range browserTrustItems {
+		if !visible[path] {
+			item.Hide()
+		}
+	}
+	if len(browsers) > 0 {
+		mCAHealth.Enable()
+	} else {
+		mCAHealth.Disable()
 	}
 }
 
@@ -378,17 +1123,23 @@ func stopMitmproxy() string {
 }
 
 func enableProxy() string {
+	if err := snapshotSystemProxy(); err != nil {
+		return fmt.Sprintf("Failed to save current proxy settings: %v", err)
+	}
 	err := enableSystemProxy()
 	if err != nil {
 		return fmt.Sprintf("Failed to enable proxy: %v", err)
 	}
+	if err := markProxyEnabled(); err != nil {
+		return fmt.Sprintf("Proxy enabled (failed to record it: %v)", err)
+	}
 	return "Proxy enabled"
 }
 
 func disableProxy() string {
-	err := disableSystemProxy()
+	err := restoreSystemProxySnapshot()
 	if err != nil {
 		return fmt.Sprintf("Failed to disable proxy: %v", err)
 	}
-	return "Proxy disabled"
+	return "Proxy disabled, previous settings restored"
 }
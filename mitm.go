@@ -1,12 +1,18 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,18 +20,48 @@ const (
 	proxyHost   = "127.0.0.1"
 	proxyPort   = "8899"
 	webUIPort   = "8898"
-	webPassword = "mitmcontroller"
 	maxLogFiles = 10
+	// maxInstancePortPairs bounds the search for free ports when several
+	// profiles run side by side (8899/8898, 8901/8900, ...).
+	maxInstancePortPairs = 50
 )
 
+// mitmInstance is one managed mitmproxy process. Instances are keyed by
+// profile id, so a profile runs at most once; the instance of the selected
+// profile is the primary one the system proxy points at.
+type mitmInstance struct {
+	Profile   ServiceProfile
+	ProxyPort string
+	WebPort   string
+	WebToken  string
+	LogPath   string
+	UsingWeb  bool
+	Upstream  resolvedUpstream
+	StartedAt time.Time
+	process   *os.Process
+	// stopping is set by stopProfileInstance, which runs the stop hooks
+	// itself. Guarded by instancesMu.
+	stopping bool
+}
+
 var (
-	mitmProcess    *os.Process
-	mitmCmd        *exec.Cmd
-	currentLogPath string
-	logsDir        string
-	usingMitmweb   bool
+	instancesMu sync.Mutex
+	instances   = map[string]*mitmInstance{}
+	// starting holds instances waiting for their pre_start hook; their
+	// ports are taken.
+	starting = map[string]*mitmInstance{}
+	logsDir  string
 )
 
+// instanceOptionKeys are set per instance by the controller; profile values
+// for them are folded into the instance instead of being passed through.
+var instanceOptionKeys = map[string]bool{
+	"confdir":      true,
+	"listen_port":  true,
+	"web_port":     true,
+	"web_password": true,
+}
+
 func init() {
 	logsDir = getLogsDir()
 }
@@ -42,9 +78,10 @@ func ensureLogsDir() error {
 	return os.MkdirAll(logsDir, 0755)
 }
 
-func generateLogFilename() string {
+func generateLogFilename(profileID string) string {
 	timestamp := time.Now().Format("20060102-150405")
-	return filepath.Join(logsDir, fmt.Sprintf("flows-%s.mitm", timestamp))
+	name := strings.ReplaceAll(profileID, "/", "-")
+	return filepath.Join(logsDir, fmt.Sprintf("flows-%s-%s.mitm", name, timestamp))
 }
 
 func cleanupOldLogs() {
@@ -75,100 +112,472 @@ func cleanupOldLogs() {
 	}
 }
 
+func (inst *mitmInstance) pid() int {
+	return inst.process.Pid
+}
+
+func (inst *mitmInstance) binary() string {
+	if inst.UsingWeb {
+		return "mitmweb"
+	}
+	return "mitmdump"
+}
+
+func (inst *mitmInstance) webUIURL() string {
+	return fmt.Sprintf("http://%s:%s/?token=%s", proxyHost, inst.WebPort, inst.WebToken)
+}
+
+func (inst *mitmInstance) hookContext() hookContext {
+	hc := hookContext{
+		Profile:   inst.Profile,
+		FlowFile:  inst.LogPath,
+		ProxyPort: inst.ProxyPort,
+		WebPort:   inst.WebPort,
+	}
+	if inst.process != nil {
+		hc.PID = inst.process.Pid
+	}
+	return hc
+}
+
+// statusLine is shown in the instance's tray submenu.
+func (inst *mitmInstance) statusLine() string {
+	line := fmt.Sprintf("%s (PID %d) | proxy :%s", inst.binary(), inst.pid(), inst.ProxyPort)
+	if mode := profileModeName(inst.Profile); mode != "regular" {
+		line = fmt.Sprintf("%s (PID %d) | %s :%s", inst.binary(), inst.pid(), mode, inst.ProxyPort)
+	}
+	if inst.UsingWeb {
+		line = fmt.Sprintf("%s | web :%s", line, inst.WebPort)
+	}
+	return fmt.Sprintf("%s | up %s", line, time.Since(inst.StartedAt).Round(time.Second))
+}
+
+func getInstance(profileID string) (*mitmInstance, bool) {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+	inst, ok := instances[profileID]
+	if ok && !isProcessAlive(inst.process) {
+		delete(instances, profileID)
+		return nil, false
+	}
+	return inst, ok
+}
+
+// runningInstances returns the live instances, oldest first.
+func runningInstances() []*mitmInstance {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+
+	list := make([]*mitmInstance, 0, len(instances))
+	for id, inst := range instances {
+		if !isProcessAlive(inst.process) {
+			delete(instances, id)
+			continue
+		}
+		list = append(list, inst)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartedAt.Before(list[j].StartedAt)
+	})
+	return list
+}
+
+func primaryInstance() (*mitmInstance, bool) {
+	return getInstance(selectedProfileID)
+}
+
+// markInstanceStopping flags an instance as stopped by the controller and
+// reports whether it already was.
+func markInstanceStopping(inst *mitmInstance) bool {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+	was := inst.stopping
+	inst.stopping = true
+	return was
+}
+
+func clearInstanceStopping(inst *mitmInstance) {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+	inst.stopping = false
+}
+
+func removeInstance(inst *mitmInstance) {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+	for id, candidate := range instances {
+		if candidate == inst {
+			delete(instances, id)
+		}
+	}
+}
+
+// renameInstance keeps a running instance attached to its profile after the
+// profile id changed.
+func renameInstance(oldID, newID string) {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+	if inst, ok := instances[oldID]; ok {
+		delete(instances, oldID)
+		inst.Profile.ID = newID
+		instances[newID] = inst
+	}
+}
+
 func startMitm() string {
+	profile, errResult := selectedProfileForStart()
+	if errResult != "" {
+		return errResult
+	}
+	return startProfileInstance(profile)
+}
+
+// startMitmInBackground starts the primary instance for the tray's Start
+// click, see startProfileInstanceInBackground.
+func startMitmInBackground() string {
+	profile, errResult := selectedProfileForStart()
+	if errResult != "" {
+		return errResult
+	}
+	return startProfileInstanceInBackground(profile, nil)
+}
+
+func selectedProfileForStart() (ServiceProfile, string) {
 	if err := loadProfilesFromDisk(); err != nil {
-		return fmt.Sprintf("Failed to load profiles: %v", err)
+		return ServiceProfile{}, fmt.Sprintf("Failed to load profiles: %v", err)
 	}
 	activeProfile, ok := getSelectedProfile()
 	if !ok {
-		return "No active profile found"
+		return ServiceProfile{}, "No active profile found"
 	}
+	return activeProfile, ""
+}
+
+// startProfileInstance starts an instance and returns once it runs or
+// failed, running pre_start inline. Profile switches, CA rotation and exec
+// go on with the instance right away.
+func startProfileInstance(profile ServiceProfile) string {
+	return startProfileInstanceThen(profile, false, nil)
+}
+
+// startProfileInstanceInBackground starts an instance for the tray. pre_start
+// runs off the tray loop and the start continues on the loop once it
+// finished; until then the returned status says the hook runs. done, if set,
+// gets the final status and returns the one to show.
+func startProfileInstanceInBackground(profile ServiceProfile, done func(result string) string) string {
+	return startProfileInstanceThen(profile, true, done)
+}
 
-	if mitmProcess != nil {
-		if isProcessAlive(mitmProcess) {
-			return "mitmproxy is already running"
+func startProfileInstanceThen(profile ServiceProfile, background bool, done func(string) string) string {
+	finish := func(result string) string {
+		if done != nil {
+			return done(result)
 		}
-		mitmProcess = nil
+		return result
+	}
+
+	if inst, running := getInstance(profile.ID); running {
+		return finish(fmt.Sprintf("%s is already running on port %s", profile.Name, inst.ProxyPort))
+	}
+	if isInstanceStarting(profile.ID) {
+		return finish(fmt.Sprintf("%s is already starting", profile.Name))
 	}
 
 	if err := ensureLogsDir(); err != nil {
-		return fmt.Sprintf("Failed to create logs directory: %v", err)
+		return finish(fmt.Sprintf("Failed to create logs directory: %v", err))
 	}
 
 	cleanupOldLogs()
 
-	currentLogPath = generateLogFilename()
+	// Create the CA with the configured key type before mitmproxy would
+	// create its default one.
+	if _, err := ensureConfdirCA(profileConfdir(profile)); err != nil {
+		return finish(fmt.Sprintf("Failed to create CA certificate: %v", err))
+	}
 
-	var cmd *exec.Cmd
-	if _, err := exec.LookPath("mitmweb"); err == nil {
-		args, buildErr := buildMitmArgs(true, currentLogPath, activeProfile)
-		if buildErr != nil {
-			return fmt.Sprintf("Failed to build mitmweb command: %v", buildErr)
-		}
-		cmd = exec.Command("mitmweb", args...)
-		usingMitmweb = true
-	} else {
-		args, buildErr := buildMitmArgs(false, currentLogPath, activeProfile)
-		if buildErr != nil {
-			return fmt.Sprintf("Failed to build mitmdump command: %v", buildErr)
+	upstream, err := resolveUpstream(profile)
+	if err != nil {
+		return finish(fmt.Sprintf("Failed to resolve upstream proxy: %v", err))
+	}
+
+	listenPort, webPort, err := allocateInstancePorts(profile)
+	if err != nil {
+		return finish(fmt.Sprintf("Failed to start %s: %v", profile.Name, err))
+	}
+
+	token := strings.TrimSpace(profile.SetOptions["web_password"])
+	if token == "" {
+		if token, err = newWebToken(); err != nil {
+			return finish(fmt.Sprintf("Failed to generate web UI token: %v", err))
 		}
-		cmd = exec.Command("mitmdump", args...)
-		usingMitmweb = false
 	}
 
+	inst := &mitmInstance{
+		Profile:   profile,
+		ProxyPort: listenPort,
+		WebPort:   webPort,
+		WebToken:  token,
+		LogPath:   generateLogFilename(profile.ID),
+		Upstream:  upstream,
+	}
+	if _, err := exec.LookPath("mitmweb"); err == nil {
+		inst.UsingWeb = true
+	}
+
+	args, err := buildMitmArgs(inst)
+	if err != nil {
+		return finish(fmt.Sprintf("Failed to build %s command: %v", inst.binary(), err))
+	}
+	cmd := exec.Command(inst.binary(), args...)
 	configureMitmCmd(cmd)
+	if env := upstreamEnv(profile, upstream); env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
 
+	setInstanceStarting(inst, true)
+	return runProfileHookThen(hookPreStart, inst.hookContext(), background, func(err error) string {
+		defer setInstanceStarting(inst, false)
+		if err != nil {
+			return finish(fmt.Sprintf("Start aborted: %v", err))
+		}
+		return finish(launchInstance(inst, cmd))
+	})
+}
+
+// launchInstance starts mitmproxy for an instance whose pre_start hook
+// passed.
+func launchInstance(inst *mitmInstance, cmd *exec.Cmd) string {
+	if err := prepareInstanceMode(inst); err != nil {
+		return fmt.Sprintf("Failed to start %s: %v", inst.Profile.Name, err)
+	}
 	if err := cmd.Start(); err != nil {
-		currentLogPath = ""
+		_ = releaseInstanceMode(inst)
 		return fmt.Sprintf("Failed to start mitmproxy: %v", err)
 	}
 
-	mitmProcess = cmd.Process
-	mitmCmd = cmd
+	inst.process = cmd.Process
+	inst.StartedAt = time.Now()
+	instancesMu.Lock()
+	instances[inst.Profile.ID] = inst
+	instancesMu.Unlock()
 
 	go func() {
 		_ = cmd.Wait()
-		mitmProcess = nil
-		mitmCmd = nil
+		removeInstance(inst)
+		_ = releaseInstanceMode(inst)
+		// mitmproxy exited on its own: post_stop still runs, its result
+		// ends up in hooks.log only.
+		if !markInstanceStopping(inst) {
+			_ = runProfileHook(hookPostStop, inst.hookContext())
+		}
 	}()
 
-	mode := "mitmdump"
-	if usingMitmweb {
-		mode = "mitmweb"
+	result := fmt.Sprintf("%s started (PID: %d, port %s) | profile: %s", inst.binary(), inst.pid(), inst.ProxyPort, inst.Profile.Name)
+	if hookResult := runProfileHookThen(hookPostStart, inst.hookContext(), true, hookFailure); hookResult != "" {
+		result = fmt.Sprintf("%s | %s", result, hookResult)
+	}
+	return result
+}
+
+func isInstanceStarting(profileID string) bool {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+	_, ok := starting[profileID]
+	return ok
+}
+
+func setInstanceStarting(inst *mitmInstance, on bool) {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+	if on {
+		starting[inst.Profile.ID] = inst
+	} else if starting[inst.Profile.ID] == inst {
+		delete(starting, inst.Profile.ID)
 	}
-	return fmt.Sprintf("%s started (PID: %d) | profile: %s", mode, cmd.Process.Pid, activeProfile.Name)
 }
 
+// stopMitm stops the primary instance for the tray's Stop click; pre_stop
+// runs off the tray loop.
 func stopMitm() string {
-	if mitmProcess != nil {
-		if err := mitmProcess.Kill(); err != nil {
-			return fmt.Sprintf("Failed to kill mitmproxy: %v", err)
-		}
-		mitmProcess = nil
-		mitmCmd = nil
+	return stopMitmForThen(selectedProfileID, true)
+}
+
+// stopMitmFor stops the instance of a profile. Without any managed instance it
+// falls back to killing a mitmproxy started elsewhere.
+func stopMitmFor(profileID string) string {
+	return stopMitmForThen(profileID, false)
+}
+
+func stopMitmForThen(profileID string, background bool) string {
+	if _, running := getInstance(profileID); running {
+		return stopProfileInstanceThen(profileID, background)
+	}
+	if len(runningInstances()) == 0 && killExistingMitmproxy() {
 		return "mitmproxy stopped"
 	}
+	return "No mitmproxy process found"
+}
 
-	if killExistingMitmproxy() {
-		return "mitmproxy stopped"
+// stopProfileInstance stops an instance and returns once it is gone,
+// running pre_stop inline.
+func stopProfileInstance(profileID string) string {
+	return stopProfileInstanceThen(profileID, false)
+}
+
+// stopProfileInstanceInBackground stops an instance for the tray: pre_stop
+// runs off the tray loop and the stop continues on the loop afterwards.
+func stopProfileInstanceInBackground(profileID string) string {
+	return stopProfileInstanceThen(profileID, true)
+}
+
+func stopProfileInstanceThen(profileID string, background bool) string {
+	inst, running := getInstance(profileID)
+	if !running {
+		return fmt.Sprintf("No running instance for profile %s", profileID)
+	}
+	if markInstanceStopping(inst) {
+		return fmt.Sprintf("mitmproxy for profile %s is already stopping", inst.Profile.Name)
 	}
 
-	return "No mitmproxy process found"
+	hc := inst.hookContext()
+	return runProfileHookThen(hookPreStop, hc, background, func(err error) string {
+		var hookErrs []string
+		if err != nil {
+			hookErrs = append(hookErrs, err.Error())
+		}
+		// A process that already exited counts as stopped; otherwise the
+		// instance stays registered and can be stopped again.
+		if err := inst.process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			clearInstanceStopping(inst)
+			return fmt.Sprintf("Failed to kill mitmproxy: %v", err)
+		}
+		removeInstance(inst)
+		if err := releaseInstanceMode(inst); err != nil {
+			hookErrs = append(hookErrs, err.Error())
+		}
+
+		if hookResult := runProfileHookThen(hookPostStop, hc, true, hookFailure); hookResult != "" {
+			hookErrs = append(hookErrs, hookResult)
+		}
+		result := fmt.Sprintf("mitmproxy stopped | profile: %s", inst.Profile.Name)
+		if len(hookErrs) > 0 {
+			return fmt.Sprintf("%s | %s", result, strings.Join(hookErrs, " | "))
+		}
+		return result
+	})
 }
 
+// isMitmproxyRunning reports whether the primary instance runs. Without any
+// managed instance it falls back to detecting a mitmproxy started elsewhere.
 func isMitmproxyRunning() bool {
-	if mitmProcess != nil && isProcessAlive(mitmProcess) {
+	if _, ok := primaryInstance(); ok {
 		return true
 	}
-	return checkExistingMitmproxy()
+	return len(runningInstances()) == 0 && checkExistingMitmproxy()
+}
+
+// allocateInstancePorts returns the proxy and web ports for a new instance.
+// Ports pinned with listen_port/web_port in the profile win; otherwise the
+// first free pair from the defaults upwards is used.
+func allocateInstancePorts(profile ServiceProfile) (string, string, error) {
+	used := map[string]string{}
+	for _, inst := range runningInstances() {
+		used[inst.ProxyPort] = inst.Profile.Name
+		used[inst.WebPort] = inst.Profile.Name
+	}
+	instancesMu.Lock()
+	for _, inst := range starting {
+		used[inst.ProxyPort] = inst.Profile.Name
+		used[inst.WebPort] = inst.Profile.Name
+	}
+	instancesMu.Unlock()
+
+	pinnedProxy := strings.TrimSpace(profile.SetOptions["listen_port"])
+	pinnedWeb := strings.TrimSpace(profile.SetOptions["web_port"])
+	for _, port := range []string{pinnedProxy, pinnedWeb} {
+		if owner, taken := used[port]; port != "" && taken {
+			return "", "", fmt.Errorf("port %s is already used by profile %s", port, owner)
+		}
+	}
+	if pinnedProxy != "" && pinnedWeb != "" {
+		return pinnedProxy, pinnedWeb, nil
+	}
+
+	baseProxy, _ := strconv.Atoi(proxyPort)
+	baseWeb, _ := strconv.Atoi(webUIPort)
+	for i := 0; i < maxInstancePortPairs; i++ {
+		listenPort, webPort := pinnedProxy, pinnedWeb
+		if listenPort == "" {
+			listenPort = strconv.Itoa(baseProxy + 2*i)
+			if !isPortAvailable(listenPort, used) {
+				continue
+			}
+		}
+		if webPort == "" {
+			webPort = strconv.Itoa(baseWeb + 2*i)
+			if !isPortAvailable(webPort, used) {
+				continue
+			}
+		}
+		if listenPort != webPort {
+			return listenPort, webPort, nil
+		}
+	}
+	return "", "", fmt.Errorf("no free ports found from %s upwards", proxyPort)
+}
+
+func isPortAvailable(port string, used map[string]string) bool {
+	if _, taken := used[port]; taken {
+		return false
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(proxyHost, port))
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+// isControllerProxyPort reports whether a system proxy on proxyHost:port was
+// set by the controller: a running instance or any port it could allocate.
+func isControllerProxyPort(port string) bool {
+	for _, inst := range runningInstances() {
+		if inst.ProxyPort == port {
+			return true
+		}
+	}
+	base, _ := strconv.Atoi(proxyPort)
+	n, err := strconv.Atoi(port)
+	return err == nil && n >= base && n < base+2*maxInstancePortPairs && (n-base)%2 == 0
+}
+
+// systemProxyPort is the port the OS proxy points at: the primary instance's,
+// or the default port while it is not running.
+func systemProxyPort() string {
+	if inst, ok := primaryInstance(); ok {
+		return inst.ProxyPort
+	}
+	return proxyPort
+}
+
+func newWebToken() (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
 }
 
 func getWebUIURL() string {
-	return fmt.Sprintf("http://%s:%s/?token=%s", proxyHost, webUIPort, webPassword)
+	if inst, ok := primaryInstance(); ok {
+		return inst.webUIURL()
+	}
+	return ""
 }
 
 func isWebUIAvailable() bool {
-	return usingMitmweb && isMitmproxyRunning()
+	inst, ok := primaryInstance()
+	return ok && inst.UsingWeb
 }
 
 func getLogsDirectory() string {
@@ -176,7 +585,10 @@ func getLogsDirectory() string {
 }
 
 func getCurrentLogPath() string {
-	return currentLogPath
+	if inst, ok := primaryInstance(); ok {
+		return inst.LogPath
+	}
+	return ""
 }
 
 func getMitmHomeDirectory() string {
@@ -187,14 +599,16 @@ func getMitmHomeDirectory() string {
 	return filepath.Join(home, ".mitmproxy")
 }
 
+// ensureMitmHomeDirectoryExists creates the selected profile's confdir,
+// ~/.mitmproxy unless the profile has its own.
 func ensureMitmHomeDirectoryExists() (string, error) {
-	mitmHomeDir := getMitmHomeDirectory()
+	mitmHomeDir := activeConfdir()
 	absPath, err := filepath.Abs(mitmHomeDir)
 	if err == nil {
 		mitmHomeDir = absPath
 	}
 
-	if err := os.MkdirAll(mitmHomeDir, 0755); err != nil {
+	if err := ensureConfdir(mitmHomeDir); err != nil {
 		return "", err
 	}
 	return mitmHomeDir, nil
@@ -225,23 +639,30 @@ func ensureMitmConfigExists() (string, error) {
 	return "", err
 }
 
-func buildMitmArgs(useWebUI bool, logPath string, profile ServiceProfile) ([]string, error) {
+func buildMitmArgs(inst *mitmInstance) ([]string, error) {
+	profile := inst.Profile
 	args := []string{
-		"--set", "confdir=" + getMitmHomeDirectory(),
-		"--set", "listen_host=" + proxyHost,
-		"--set", "listen_port=" + proxyPort,
+		"--set", "confdir=" + profileConfdir(profile),
+		"--set", "listen_host=" + modeListenHost(profile),
+		"--set", "listen_port=" + inst.ProxyPort,
 	}
 
-	if useWebUI {
+	if inst.UsingWeb {
 		args = append(args,
 			"--set", "web_host="+proxyHost,
-			"--set", "web_port="+webUIPort,
-			"--set", "web_password="+webPassword,
+			"--set", "web_port="+inst.WebPort,
+			"--set", "web_password="+inst.WebToken,
 			"--no-web-open-browser",
 		)
 	}
 
-	if profile.Mode != "" {
+	upstreamMode, err := upstreamArgs(profile, inst.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	if len(upstreamMode) > 0 {
+		args = append(args, upstreamMode...)
+	} else if profile.Mode != "" {
 		args = append(args, "--mode", profile.Mode)
 	}
 
@@ -259,13 +680,15 @@ func buildMitmArgs(useWebUI bool, logPath string, profile ServiceProfile) ([]str
 	sort.Strings(keys)
 
 	for _, key := range keys {
-		if strings.EqualFold(strings.TrimSpace(key), "confdir") {
+		if instanceOptionKeys[strings.ToLower(strings.TrimSpace(key))] {
 			continue
 		}
 		value := profile.SetOptions[key]
 		args = append(args, "--set", fmt.Sprintf("%s=%s", key, value))
 	}
+	// Repeated --set values extend a list option such as ignore_hosts.
+	args = append(args, ignoreHostsArgs(bypassHostsFor(profile))...)
 
-	args = append(args, "-w", logPath)
+	args = append(args, "-w", inst.LogPath)
 	return args, nil
 }
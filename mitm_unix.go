@@ -1,8 +1,9 @@
-//go:build darwin
+//go:build darwin || linux
 
 package main
 
 import (
+	"context"
 	"os"
 	"os/exec"
 	"strconv"
@@ -14,6 +15,21 @@ func configureMitmCmd(cmd *exec.Cmd) {
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 }
 
+// newHookCommand runs a hook through the user's shell in its own process
+// group so a timeout also stops any children it spawned.
+func newHookCommand(ctx context.Context, command string) *exec.Cmd {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	cmd := exec.CommandContext(ctx, shell, "-c", command)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return cmd
+}
+
 func isProcessAlive(p *os.Process) bool {
 	return p.Signal(syscall.Signal(0)) == nil
 }
@@ -3,15 +3,29 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"syscall"
 )
 
 func configureMitmCmd(cmd *exec.Cmd) {
 	// No special configuration needed for Windows
 }
 
+// newHookCommand runs a hook through cmd.exe. On timeout the whole process
+// tree is terminated with taskkill.
+func newHookCommand(ctx context.Context, command string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "cmd", "/C", command)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	cmd.Cancel = func() error {
+		return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+	}
+	return cmd
+}
+
 func isProcessAlive(p *os.Process) bool {
 	// On Windows, FindProcess always succeeds, so we try to signal
 	// But Signal(0) doesn't work the same way on Windows
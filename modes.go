@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"rsc.io/qr"
+)
+
+// Profiles can run mitmproxy in a mode other than the regular proxy
+// ("mode: transparent", "mode: wireguard", ...). The controller prepares what
+// such a mode needs around the process: redirect rules for transparent mode
+// on Linux, and keys plus a client configuration for wireguard mode.
+
+// wireGuardKeysFile is the file mitmproxy reads its WireGuard keys from when
+// the mode names no other path.
+const wireGuardKeysFile = "wireguard.conf"
+
+// transparentSettings is the "transparent:" block of a profile. Rules only
+// apply to traffic of the given user, cgroup or incoming interface, never to
+// mitmproxy itself.
+type transparentSettings struct {
+	User      string `yaml:"user"`
+	Cgroup    string `yaml:"cgroup"`
+	Interface string `yaml:"interface"`
+	Ports     []int  `yaml:"ports"`
+	Backend   string `yaml:"backend"`
+}
+
+// wireGuardSettings is the "wireguard:" block of a profile.
+type wireGuardSettings struct {
+	Endpoint string `yaml:"endpoint"`
+}
+
+type wireGuardKeys struct {
+	ServerKey string `json:"server_key"`
+	ClientKey string `json:"client_key"`
+}
+
+// parseMode splits a mitmproxy mode spec such as "wireguard:~/wg.conf@51821"
+// into the mode name, its data and a custom listen port.
+func parseMode(spec string) (name, data, port string) {
+	spec = strings.TrimSpace(spec)
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		if _, err := strconv.Atoi(spec[i+1:]); err == nil {
+			spec, port = spec[:i], spec[i+1:]
+		}
+	}
+	name, data, _ = strings.Cut(spec, ":")
+	return strings.ToLower(name), data, port
+}
+
+func profileModeName(profile ServiceProfile) string {
+	name, _, _ := parseMode(profile.Mode)
+	if name == "" {
+		return "regular"
+	}
+	return name
+}
+
+// modeAcceptsProxyClients reports whether clients reach the instance as an
+// HTTP proxy, which the system proxy, PAC routes, exec and env rely on.
+func modeAcceptsProxyClients(mode string) bool {
+	switch mode {
+	case "", "regular", "upstream":
+		return true
+	}
+	return false
+}
+
+// modeListenHost is the listen_host an instance gets unless the profile pins
+// one: wireguard clients and transparent gateways connect from other hosts.
+func modeListenHost(profile ServiceProfile) string {
+	switch profileModeName(profile) {
+	case "wireguard":
+		return ""
+	case "transparent":
+		if profile.Transparent.Interface != "" {
+			return ""
+		}
+	}
+	return proxyHost
+}
+
+// modeWarnings describes settings that do not fit the profile's mode.
+func modeWarnings(profile ServiceProfile) []string {
+	mode := profileModeName(profile)
+	var warnings []string
+	if !modeAcceptsProxyClients(mode) {
+		warnings = append(warnings, fmt.Sprintf("system proxy not used in %s mode", mode))
+	}
+	if mode == "transparent" {
+		t := profile.Transparent
+		switch {
+		case runtime.GOOS == "darwin":
+			warnings = append(warnings, "transparent mode: configure pf yourself, redirect rules are only managed on Linux")
+		case runtime.GOOS == "linux" && t.User == "" && t.Cgroup == "" && t.Interface == "":
+			warnings = append(warnings, "transparent mode needs transparent.user, transparent.cgroup or transparent.interface")
+		}
+	} else if !isZeroTransparent(profile.Transparent) {
+		warnings = append(warnings, "transparent settings only apply with mode: transparent")
+	}
+	if mode != "wireguard" && profile.WireGuard.Endpoint != "" {
+		warnings = append(warnings, "wireguard settings only apply with mode: wireguard")
+	}
+	return warnings
+}
+
+func isZeroTransparent(t transparentSettings) bool {
+	return t.User == "" && t.Cgroup == "" && t.Interface == "" && len(t.Ports) == 0 && t.Backend == ""
+}
+
+// prepareInstanceMode runs before mitmproxy starts.
+func prepareInstanceMode(inst *mitmInstance) error {
+	switch profileModeName(inst.Profile) {
+	case "wireguard":
+		_, err := ensureWireGuardKeys(inst.Profile)
+		return err
+	case "transparent":
+		return setupTransparentRedirect(inst)
+	}
+	return nil
+}
+
+// releaseInstanceMode undoes prepareInstanceMode once the instance stopped
+// or exited on its own. It is safe to call more than once.
+func releaseInstanceMode(inst *mitmInstance) error {
+	// An instance that exited after the profile was started again must not
+	// remove the rules of the new one.
+	if current, running := getInstance(inst.Profile.ID); running && current != inst {
+		return nil
+	}
+	if profileModeName(inst.Profile) == "transparent" {
+		return teardownTransparentRedirect(inst.Profile.ID, inst.ProxyPort)
+	}
+	return nil
+}
+
+// wireGuardKeysPath is where mitmproxy reads the keys of a wireguard
+// profile: the path in the mode spec, or wireguard.conf in its confdir.
+func wireGuardKeysPath(profile ServiceProfile) string {
+	if _, data, _ := parseMode(profile.Mode); data != "" {
+		return expandHomePath(data)
+	}
+	return filepath.Join(profileConfdir(profile), wireGuardKeysFile)
+}
+
+// ensureWireGuardKeys loads the key file, creating it in mitmproxy's format
+// first so the client configuration is known before mitmproxy runs.
+func ensureWireGuardKeys(profile ServiceProfile) (wireGuardKeys, error) {
+	path := wireGuardKeysPath(profile)
+	if content, err := os.ReadFile(path); err == nil {
+		var keys wireGuardKeys
+		if err := json.Unmarshal(content, &keys); err != nil || keys.ServerKey == "" || keys.ClientKey == "" {
+			return wireGuardKeys{}, fmt.Errorf("%s is not a mitmproxy WireGuard key file", path)
+		}
+		return keys, nil
+	} else if !os.IsNotExist(err) {
+		return wireGuardKeys{}, err
+	}
+
+	server, err := newWireGuardPrivateKey()
+	if err != nil {
+		return wireGuardKeys{}, err
+	}
+	client, err := newWireGuardPrivateKey()
+	if err != nil {
+		return wireGuardKeys{}, err
+	}
+	keys := wireGuardKeys{ServerKey: server, ClientKey: client}
+	content, err := json.MarshalIndent(keys, "", "    ")
+	if err != nil {
+		return wireGuardKeys{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return wireGuardKeys{}, err
+	}
+	if err := os.WriteFile(path, append(content, '\n'), 0600); err != nil {
+		return wireGuardKeys{}, err
+	}
+	return keys, nil
+}
+
+func newWireGuardPrivateKey() (string, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key.Bytes()), nil
+}
+
+func wireGuardPublicKey(privateKey string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid WireGuard key: %w", err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid WireGuard key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// wireGuardClientConfig is the configuration a phone or another machine
+// imports to send its traffic through the instance.
+func wireGuardClientConfig(inst *mitmInstance) (string, error) {
+	keys, err := ensureWireGuardKeys(inst.Profile)
+	if err != nil {
+		return "", err
+	}
+	serverPublic, err := wireGuardPublicKey(keys.ServerKey)
+	if err != nil {
+		return "", err
+	}
+
+	port := inst.ProxyPort
+	if _, _, custom := parseMode(inst.Profile.Mode); custom != "" {
+		port = custom
+	}
+	host := inst.Profile.WireGuard.Endpoint
+	if host == "" {
+		host = lanAddress()
+	}
+
+	return fmt.Sprintf(`[Interface]
+PrivateKey = %s
+Address = 10.0.0.1/32
+DNS = 10.0.0.53
+
+[Peer]
+PublicKey = %s
+AllowedIPs = 0.0.0.0/0
+Endpoint = %s
+`, keys.ClientKey, serverPublic, net.JoinHostPort(host, port)), nil
+}
+
+// lanAddress returns the address other devices on the network most likely
+// reach this machine at: the source address of the default route.
+func lanAddress() string {
+	if conn, err := net.Dial("udp", "192.0.2.1:9"); err == nil {
+		defer conn.Close()
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && !addr.IP.IsLoopback() {
+			return addr.IP.String()
+		}
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && ipNet.IP.IsPrivate() {
+			return ipNet.IP.String()
+		}
+	}
+	return proxyHost
+}
+
+// writeWireGuardClientFiles writes the client configuration and its QR code
+// next to the controller state and returns both paths.
+func writeWireGuardClientFiles(inst *mitmInstance) (string, string, error) {
+	config, err := wireGuardClientConfig(inst)
+	if err != nil {
+		return "", "", err
+	}
+	code, err := qr.Encode(config, qr.L)
+	if err != nil {
+		return "", "", err
+	}
+
+	dir := filepath.Join(getControllerDataDirectory(), "wireguard")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+	base := filepath.Join(dir, strings.ReplaceAll(inst.Profile.ID, "/", "-"))
+	if err := os.WriteFile(base+".conf", []byte(config), 0600); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(base+".png", code.PNG(), 0600); err != nil {
+		return "", "", err
+	}
+	return base + ".conf", base + ".png", nil
+}
+
+// terminalQR renders text as a QR code with half-block characters, two
+// modules per line, light modules drawn so it scans on dark terminals.
+func terminalQR(text string) (string, error) {
+	code, err := qr.Encode(text, qr.L)
+	if err != nil {
+		return "", err
+	}
+	const quiet = 2
+	light := func(x, y int) bool {
+		if x < 0 || y < 0 || x >= code.Size || y >= code.Size {
+			return true
+		}
+		return !code.Black(x, y)
+	}
+
+	var b strings.Builder
+	for y := -quiet; y < code.Size+quiet; y += 2 {
+		for x := -quiet; x < code.Size+quiet; x++ {
+			top, bottom := light(x, y), light(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
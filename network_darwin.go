@@ -0,0 +1,46 @@
+//go:build darwin
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// currentNetworkInfo describes the network the default route goes through.
+func currentNetworkInfo() networkInfo {
+	info := networkInfo{Interface: getDefaultRouteInterface()}
+	if info.Interface == "" {
+		return info
+	}
+
+	if service, err := getActiveNetworkService(); err == nil {
+		info.Service = service
+	}
+	info.SSID = getWiFiSSID(info.Interface)
+	return info
+}
+
+func getWiFiSSID(iface string) string {
+	// "Current Wi-Fi Network: CorpWiFi", or an error line for non-Wi-Fi ports.
+	out, err := exec.Command("networksetup", "-getairportnetwork", iface).Output()
+	if err == nil {
+		if _, ssid, ok := strings.Cut(strings.TrimSpace(string(out)), "Network: "); ok {
+			return strings.TrimSpace(ssid)
+		}
+	}
+
+	// Newer macOS releases no longer report the SSID above; the DHCP summary
+	// still carries it as "  SSID : CorpWiFi".
+	out, err = exec.Command("ipconfig", "getsummary", iface).Output()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, ok := strings.Cut(line, " : ")
+		if ok && strings.TrimSpace(key) == "SSID" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
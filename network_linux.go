@@ -0,0 +1,76 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// currentNetworkInfo describes the network the default route goes through.
+// Service is the active NetworkManager connection of that interface.
+func currentNetworkInfo() networkInfo {
+	info := networkInfo{Interface: getDefaultRouteInterface()}
+	if info.Interface == "" {
+		return info
+	}
+	info.Service = getActiveConnectionName(info.Interface)
+	info.SSID = getWiFiSSID(info.Interface)
+	return info
+}
+
+// getDefaultRouteInterface reads /proc/net/route, where the default route has
+// destination 00000000:
+//
+//	Iface	Destination	Gateway 	Flags	...
+//	wlp2s0	00000000	0102A8C0	0003	...
+func getDefaultRouteInterface() string {
+	content, err := os.ReadFile("/proc/net/route")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(content), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[1] == "00000000" {
+			return fields[0]
+		}
+	}
+	return ""
+}
+
+func getActiveConnectionName(iface string) string {
+	// "Office Wi-Fi:wlp2s0" per line; colons in names are escaped as "\:".
+	out, err := exec.Command("nmcli", "-t", "-f", "NAME,DEVICE", "connection", "show", "--active").Output()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.ReplaceAll(line, `\:`, "\x00")
+		name, device, ok := strings.Cut(line, ":")
+		if ok && device == iface {
+			return strings.ReplaceAll(name, "\x00", ":")
+		}
+	}
+	return ""
+}
+
+func getWiFiSSID(iface string) string {
+	if out, err := exec.Command("iwgetid", "-r", iface).Output(); err == nil {
+		if ssid := strings.TrimSpace(string(out)); ssid != "" {
+			return ssid
+		}
+	}
+
+	// "yes:CorpWiFi" for the connected network
+	out, err := exec.Command("nmcli", "-t", "-f", "ACTIVE,SSID", "device", "wifi", "list", "ifname", iface).Output()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if ssid, ok := strings.CutPrefix(line, "yes:"); ok {
+			return strings.ReplaceAll(ssid, `\:`, ":")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,64 @@
+//go:build windows
+
+package main
+
+import (
+	"net"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// currentNetworkInfo describes the network the default route goes through.
+func currentNetworkInfo() networkInfo {
+	info := networkInfo{Interface: getDefaultRouteInterface()}
+	info.Service = info.Interface
+	info.SSID = getWiFiSSID()
+	return info
+}
+
+// getDefaultRouteInterface finds the interface that owns the local address
+// used for outbound traffic. Dialing UDP sends no packets.
+func getDefaultRouteInterface() string {
+	conn, err := net.Dial("udp", "192.0.2.1:9")
+	if err != nil {
+		return ""
+	}
+	localIP := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(localIP) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
+
+func getWiFiSSID() string {
+	cmd := exec.Command("netsh", "wlan", "show", "interfaces")
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+
+	// "    SSID                   : CorpWiFi" (skip the BSSID line)
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if ok && strings.TrimSpace(key) == "SSID" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,19 @@
+//go:build linux
+
+package main
+
+import (
+	"os/exec"
+)
+
+func openURL(url string) error {
+	return exec.Command("xdg-open", url).Start()
+}
+
+func revealInFileManager(path string) error {
+	return exec.Command("xdg-open", path).Start()
+}
+
+func openFile(path string) error {
+	return exec.Command("xdg-open", path).Start()
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In PAC mode (system_proxy.mode: pac) the OS is pointed at a proxy
+// auto-config file served by the controller instead of a static proxy. Only
+// hosts listed in a profile's intercept_hosts go through mitmproxy; all other
+// traffic goes DIRECT, or to the proxy that was configured before ours.
+
+const (
+	defaultPACPort = 8897
+	pacFilePath    = "/proxy.pac"
+)
+
+var (
+	pacMu        sync.Mutex
+	pacScript    string
+	pacListener  net.Listener
+	pacPortInUse string
+)
+
+func pacModeEnabled() bool {
+	return strings.EqualFold(strings.TrimSpace(appSettings.SystemProxy.Mode), "pac")
+}
+
+func pacPort() string {
+	if port := appSettings.SystemProxy.PACPort; port > 0 {
+		return strconv.Itoa(port)
+	}
+	return strconv.Itoa(defaultPACPort)
+}
+
+// isControllerPACURL reports whether an auto-proxy URL points at our PAC
+// server, regardless of the version parameter.
+func isControllerPACURL(rawURL string) bool {
+	return strings.HasPrefix(rawURL, "http://"+net.JoinHostPort(proxyHost, pacPort())+pacFilePath)
+}
+
+// isControllerPACActive reports whether the OS currently uses our PAC file.
+func isControllerPACActive() bool {
+	url, enabled, err := readSystemAutoProxy()
+	return err == nil && enabled && isControllerPACURL(url)
+}
+
+// controllerOwnsSystemProxy reports whether the OS proxy currently points at
+// the controller, either statically or through our PAC file.
+func controllerOwnsSystemProxy() bool {
+	if current, err := readSystemWebProxy(); err == nil && current.Enabled && current.isController() {
+		return true
+	}
+	return isControllerPACActive()
+}
+
+// preparePACProxy starts the PAC server if needed, publishes the script for
+// the current profiles and returns the URL to configure. The URL carries a
+// hash of the script so the OS and browsers reload it when routes change.
+func preparePACProxy() (string, error) {
+	if err := startPACServer(); err != nil {
+		return "", err
+	}
+	script := generatePACScript()
+	sum := sha256.Sum256([]byte(script))
+
+	pacMu.Lock()
+	pacScript = script
+	pacMu.Unlock()
+
+	return fmt.Sprintf("http://%s%s?v=%s", net.JoinHostPort(proxyHost, pacPort()), pacFilePath, hex.EncodeToString(sum[:4])), nil
+}
+
+func startPACServer() error {
+	pacMu.Lock()
+	defer pacMu.Unlock()
+
+	port := pacPort()
+	if pacListener != nil {
+		if pacPortInUse == port {
+			return nil
+		}
+		pacListener.Close()
+		pacListener = nil
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(proxyHost, port))
+	if err != nil {
+		return fmt.Errorf("failed to serve PAC file on port %s: %w", port, err)
+	}
+	pacListener = listener
+	pacPortInUse = port
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(pacFilePath, handlePACFile)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	return nil
+}
+
+func stopPACServer() {
+	pacMu.Lock()
+	defer pacMu.Unlock()
+	if pacListener != nil {
+		pacListener.Close()
+		pacListener = nil
+	}
+}
+
+func handlePACFile(w http.ResponseWriter, r *http.Request) {
+	pacMu.Lock()
+	script := pacScript
+	pacMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write([]byte(script))
+}
+
+// pacRoute sends the hosts of one profile to its mitmproxy instance.
+type pacRoute struct {
+	profile ServiceProfile
+	port    string
+}
+
+// pacRoutes lists the primary profile followed by the instances running
+// alongside it that declare intercept_hosts and accept proxy clients.
+func pacRoutes() []pacRoute {
+	primary, _ := getSelectedProfile()
+	routes := []pacRoute{{profile: primary, port: systemProxyPort()}}
+	for _, inst := range runningInstances() {
+		if inst.Profile.ID != primary.ID && len(inst.Profile.InterceptHosts) > 0 && inst.Profile.ProxyCompat {
+			routes = append(routes, pacRoute{profile: inst.Profile, port: inst.ProxyPort})
+		}
+	}
+	return routes
+}
+
+// generatePACScript builds the PAC file: bypass hosts first, then each
+// profile's intercept_hosts. Without intercept_hosts on the primary profile
+// everything else goes through it, like the static proxy.
+func generatePACScript() string {
+	direct := "DIRECT"
+	if snapshot, ok := loadProxySnapshot(); ok {
+		if previous := snapshot.Config.webProxy(); previous.Enabled && previous.Host != "" && !previous.isController() {
+			direct = fmt.Sprintf("PROXY %s; DIRECT", net.JoinHostPort(previous.Host, previous.Port))
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("// Generated by mitmproxy-controller; changes are overwritten.\n")
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\thost = host.toLowerCase();\n")
+
+	for _, host := range systemBypassHosts() {
+		if condition := pacHostCondition(host); condition != "" {
+			fmt.Fprintf(&b, "\tif (%s) return %s;\n", condition, strconv.Quote(direct))
+		}
+	}
+
+	fallback := direct
+	for i, route := range pacRoutes() {
+		proxy := strconv.Quote("PROXY " + net.JoinHostPort(proxyHost, route.port))
+		if i == 0 && len(route.profile.InterceptHosts) == 0 {
+			fallback = "PROXY " + net.JoinHostPort(proxyHost, route.port)
+			continue
+		}
+
+		var conditions []string
+		for _, host := range route.profile.InterceptHosts {
+			if condition := pacHostCondition(host); condition != "" {
+				conditions = append(conditions, condition)
+			}
+		}
+		if len(conditions) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\t// %s\n", route.profile.Name)
+		fmt.Fprintf(&b, "\tif (%s) return %s;\n", strings.Join(conditions, " ||\n\t\t"), proxy)
+	}
+
+	fmt.Fprintf(&b, "\treturn %s;\n", strconv.Quote(fallback))
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// pacHostCondition converts a host entry (example.com, *.example.com,
+// 10.0.0.0/8, <local>) into a PAC expression. IPv6 ranges are skipped.
+func pacHostCondition(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	switch {
+	case host == "":
+		return ""
+	case host == "<local>":
+		return "isPlainHostName(host)"
+	case strings.Contains(host, "/"):
+		_, network, err := net.ParseCIDR(host)
+		if err != nil || network.IP.To4() == nil {
+			return ""
+		}
+		// Only match IP literals; isInNet would resolve every hostname.
+		return fmt.Sprintf(`/^\d+\.\d+\.\d+\.\d+$/.test(host) && isInNet(host, %q, %q)`,
+			network.IP.String(), net.IP(network.Mask).String())
+	default:
+		return fmt.Sprintf("shExpMatch(host, %s)", strconv.Quote(host))
+	}
+}
+
+// pacReconciled is the PAC port and script reconcilePACProxy last checked
+// the OS settings against. Only the tray loop touches it.
+var pacReconciled string
+
+// reconcilePACProxy runs at launch and on every status poll. While the OS
+// uses our PAC file it keeps the server running (also after adopting a proxy
+// left behind by a crash) and, when the routes changed (a profile started
+// alongside, the primary moved), publishes the new script under a new URL.
+// The OS settings are only read when the script or its port changed; the
+// watchdog notices when something else rewrites them.
+func reconcilePACProxy(poll pollState) string {
+	if !poll.OwnsProxy {
+		pacReconciled = ""
+		return ""
+	}
+	key := pacPort() + "\n" + generatePACScript()
+	if key == pacReconciled {
+		return ""
+	}
+	current, enabled, err := readSystemAutoProxy()
+	if err != nil {
+		return ""
+	}
+	if !enabled || !isControllerPACURL(current) {
+		pacReconciled = key
+		return ""
+	}
+
+	url, err := preparePACProxy()
+	if err != nil {
+		return fmt.Sprintf("Failed to update PAC file: %v", err)
+	}
+	if url == current {
+		pacReconciled = key
+		return ""
+	}
+	if err := enableSystemProxy(); err != nil {
+		return fmt.Sprintf("Failed to update PAC file: %v", err)
+	}
+	pacReconciled = key
+	return "PAC file updated"
+}
@@ -17,28 +17,45 @@ const (
 )
 
 type ServiceProfile struct {
-	ID          string            `yaml:"id"`
-	Name        string            `yaml:"name"`
-	Scripts     []string          `yaml:"scripts"`
-	SetOptions  map[string]string `yaml:"set_options"`
-	Mode        string            `yaml:"mode,omitempty"`
-	FilePath    string            `yaml:"-"`
-	ScriptPaths []string          `yaml:"-"`
-	Warnings    []string          `yaml:"-"`
-	ProxyCompat bool              `yaml:"-"`
-	WebUICompat bool              `yaml:"-"`
+	ID             string              `yaml:"id"`
+	Name           string              `yaml:"name"`
+	Scripts        []string            `yaml:"scripts"`
+	SetOptions     map[string]string   `yaml:"set_options"`
+	Mode           string              `yaml:"mode,omitempty"`
+	Upstream       string              `yaml:"upstream,omitempty"`
+	BypassHosts    []string            `yaml:"bypass_hosts,omitempty"`
+	InterceptHosts []string            `yaml:"intercept_hosts,omitempty"`
+	Transparent    transparentSettings `yaml:"transparent,omitempty"`
+	WireGuard      wireGuardSettings   `yaml:"wireguard,omitempty"`
+	Confdir        string              `yaml:"confdir,omitempty"`
+	Hooks          ProfileHooks        `yaml:"-"`
+	FilePath       string              `yaml:"-"`
+	Source         string              `yaml:"-"`
+	ReadOnly       bool                `yaml:"-"`
+	ScriptPaths    []string            `yaml:"-"`
+	Warnings       []string            `yaml:"-"`
+	ProxyCompat    bool                `yaml:"-"`
+	WebUICompat    bool                `yaml:"-"`
 }
 
 type profileFile struct {
-	ID         string                 `yaml:"id"`
-	Name       string                 `yaml:"name"`
-	Scripts    []string               `yaml:"scripts"`
-	SetOptions map[string]interface{} `yaml:"set_options"`
-	Mode       string                 `yaml:"mode"`
+	ID             string                 `yaml:"id"`
+	Name           string                 `yaml:"name"`
+	Scripts        []string               `yaml:"scripts"`
+	SetOptions     map[string]interface{} `yaml:"set_options"`
+	Mode           string                 `yaml:"mode"`
+	Upstream       string                 `yaml:"upstream"`
+	BypassHosts    []string               `yaml:"bypass_hosts"`
+	InterceptHosts []string               `yaml:"intercept_hosts"`
+	Transparent    transparentSettings    `yaml:"transparent"`
+	WireGuard      wireGuardSettings      `yaml:"wireguard"`
+	Confdir        string                 `yaml:"confdir"`
+	Hooks          profileHooksFile       `yaml:"hooks"`
 }
 
 type controllerState struct {
 	SelectedProfileID string `json:"selected_profile_id"`
+	AutoSwitchEnabled bool   `json:"auto_switch_enabled,omitempty"`
 }
 
 var (
@@ -78,6 +95,8 @@ func initProfiles() error {
 }
 
 func loadProfilesFromDisk() error {
+	loadSettingsFromDisk()
+
 	profiles, warnings, err := discoverProfiles()
 	if err != nil {
 		return err
@@ -96,7 +115,26 @@ func discoverProfiles() ([]ServiceProfile, []string, error) {
 		return nil, nil, err
 	}
 
-	entries, err := os.ReadDir(getProfilesDirectory())
+	profiles, warnings, err := discoverProfilesIn(getProfilesDirectory())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(profiles) == 0 {
+		profiles = append(profiles, makeFallbackDefaultProfile())
+	}
+
+	sourceProfiles, sourceWarnings := discoverSourceProfiles()
+	profiles = append(profiles, sourceProfiles...)
+	warnings = append(warnings, settingsWarnings...)
+	warnings = append(warnings, sourceWarnings...)
+
+	sortProfiles(profiles)
+	return profiles, warnings, nil
+}
+
+func discoverProfilesIn(dir string) ([]ServiceProfile, []string, error) {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -114,7 +152,7 @@ func discoverProfiles() ([]ServiceProfile, []string, error) {
 			continue
 		}
 
-		filePath := filepath.Join(getProfilesDirectory(), entry.Name())
+		filePath := filepath.Join(dir, entry.Name())
 		profile, err := loadProfileFile(filePath)
 		if err != nil {
 			warnings = append(warnings, fmt.Sprintf("%s: %v", entry.Name(), err))
@@ -123,11 +161,6 @@ func discoverProfiles() ([]ServiceProfile, []string, error) {
 		profiles = append(profiles, profile)
 	}
 
-	if len(profiles) == 0 {
-		profiles = append(profiles, makeFallbackDefaultProfile())
-	}
-
-	sortProfiles(profiles)
 	return profiles, warnings, nil
 }
 
@@ -178,12 +211,18 @@ func loadProfileFile(filePath string) (ServiceProfile, error) {
 	}
 
 	p := ServiceProfile{
-		ID:         id,
-		Name:       name,
-		Scripts:    normalizeStringSlice(parsed.Scripts),
-		SetOptions: make(map[string]string),
-		Mode:       strings.TrimSpace(parsed.Mode),
-		FilePath:   filePath,
+		ID:             id,
+		Name:           name,
+		Scripts:        normalizeStringSlice(parsed.Scripts),
+		SetOptions:     make(map[string]string),
+		Mode:           strings.TrimSpace(parsed.Mode),
+		Upstream:       strings.TrimSpace(parsed.Upstream),
+		BypassHosts:    normalizeStringSlice(parsed.BypassHosts),
+		InterceptHosts: normalizeStringSlice(parsed.InterceptHosts),
+		Transparent:    parsed.Transparent,
+		WireGuard:      parsed.WireGuard,
+		Confdir:        strings.TrimSpace(parsed.Confdir),
+		FilePath:       filePath,
 	}
 
 	for key, value := range parsed.SetOptions {
@@ -195,6 +234,10 @@ func loadProfileFile(filePath string) (ServiceProfile, error) {
 	}
 
 	populateProfileDerivedFields(&p)
+
+	hooks, hookWarnings := parseProfileHooks(parsed.Hooks, filepath.Dir(filePath))
+	p.Hooks = hooks
+	p.Warnings = append(p.Warnings, hookWarnings...)
 	return p, nil
 }
 
@@ -233,20 +276,39 @@ func populateProfileDerivedFields(profile *ServiceProfile) {
 		}
 	}
 
-	profile.ProxyCompat = isOptionCompatible(profile.SetOptions, "listen_host", proxyHost) &&
-		isOptionCompatible(profile.SetOptions, "listen_port", proxyPort)
-	profile.WebUICompat = isOptionCompatible(profile.SetOptions, "web_host", proxyHost) &&
-		isOptionCompatible(profile.SetOptions, "web_port", webUIPort) &&
-		isOptionCompatible(profile.SetOptions, "web_password", webPassword)
+	// listen_port, web_port and web_password pin the instance's ports and
+	// token; only a different host or a mode without proxy clients breaks the
+	// tray actions.
+	profile.ProxyCompat = isOptionCompatible(profile.SetOptions, "listen_host", modeListenHost(*profile)) &&
+		modeAcceptsProxyClients(profileModeName(*profile))
+	profile.WebUICompat = isOptionCompatible(profile.SetOptions, "web_host", proxyHost)
 
-	if !profile.ProxyCompat {
-		profile.Warnings = append(profile.Warnings, "proxy actions disabled (listen_host/listen_port override)")
+	if !isOptionCompatible(profile.SetOptions, "listen_host", modeListenHost(*profile)) {
+		profile.Warnings = append(profile.Warnings, "proxy actions disabled (listen_host override)")
 	}
+	profile.Warnings = append(profile.Warnings, modeWarnings(*profile)...)
 	if !profile.WebUICompat {
-		profile.Warnings = append(profile.Warnings, "web UI action disabled (web host/port/password override)")
+		profile.Warnings = append(profile.Warnings, "web UI action disabled (web_host override)")
+	}
+	if profileOwnsMode(*profile) && profile.Upstream != "" {
+		profile.Warnings = append(profile.Warnings, "upstream ignored because mode is set")
+	}
+	for _, host := range profile.BypassHosts {
+		if _, ok := ignoreHostPattern(host); !ok {
+			profile.Warnings = append(profile.Warnings, fmt.Sprintf("bypass host %q only applies to the system proxy", host))
+		}
+	}
+	if len(profile.InterceptHosts) > 0 && !pacModeEnabled() {
+		profile.Warnings = append(profile.Warnings, "intercept_hosts only apply with system_proxy.mode: pac")
 	}
 	if _, hasConfdir := profile.SetOptions["confdir"]; hasConfdir {
-		profile.Warnings = append(profile.Warnings, "confdir override ignored in profile set_options")
+		profile.Warnings = append(profile.Warnings, "confdir override ignored in profile set_options (use confdir: <name>)")
+	}
+	if profile.Confdir != "" {
+		if err := validateConfdirName(profile.Confdir); err != nil {
+			profile.Warnings = append(profile.Warnings, err.Error()+"; using ~/.mitmproxy")
+			profile.Confdir = ""
+		}
 	}
 }
 
@@ -269,6 +331,19 @@ func sanitizeProfileID(raw string) string {
 	return normalized
 }
 
+// normalizeProfileRef sanitizes a profile reference that may carry a source
+// namespace, e.g. "team/payments".
+func normalizeProfileRef(raw string) string {
+	parts := strings.Split(strings.TrimSpace(raw), "/")
+	out := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if id := sanitizeProfileID(part); id != "" {
+			out = append(out, id)
+		}
+	}
+	return strings.Join(out, "/")
+}
+
 func normalizeStringSlice(values []string) []string {
 	out := make([]string, 0, len(values))
 	for _, v := range values {
@@ -315,35 +390,28 @@ func sortProfiles(profiles []ServiceProfile) {
 		if profiles[j].ID == defaultProfileID {
 			return false
 		}
+		if profiles[i].Source != profiles[j].Source {
+			return profiles[i].Source < profiles[j].Source
+		}
 		return strings.ToLower(profiles[i].Name) < strings.ToLower(profiles[j].Name)
 	})
 }
 
-func loadSelectedProfileID() string {
-	statePath := getStatePath()
-	content, err := os.ReadFile(statePath)
-	if err != nil {
-		return defaultProfileID
-	}
-
+func loadControllerState() controllerState {
 	var state controllerState
-	if err := json.Unmarshal(content, &state); err != nil {
-		return defaultProfileID
-	}
-
-	id := sanitizeProfileID(state.SelectedProfileID)
-	if id == "" {
-		return defaultProfileID
+	content, err := os.ReadFile(getStatePath())
+	if err != nil {
+		return state
 	}
-	return id
+	_ = json.Unmarshal(content, &state)
+	return state
 }
 
-func saveSelectedProfileID(profileID string) error {
+func saveControllerState(state controllerState) error {
 	if err := os.MkdirAll(getControllerDataDirectory(), 0755); err != nil {
 		return err
 	}
 
-	state := controllerState{SelectedProfileID: profileID}
 	payload, err := json.MarshalIndent(state, "", "  ")
 	if err != nil {
 		return err
@@ -352,6 +420,20 @@ func saveSelectedProfileID(profileID string) error {
 	return os.WriteFile(getStatePath(), payload, 0644)
 }
 
+func loadSelectedProfileID() string {
+	id := normalizeProfileRef(loadControllerState().SelectedProfileID)
+	if id == "" {
+		return defaultProfileID
+	}
+	return id
+}
+
+func saveSelectedProfileID(profileID string) error {
+	state := loadControllerState()
+	state.SelectedProfileID = profileID
+	return saveControllerState(state)
+}
+
 func listProfiles() []ServiceProfile {
 	out := make([]ServiceProfile, len(serviceProfiles))
 	copy(out, serviceProfiles)
@@ -377,7 +459,7 @@ func getSelectedProfile() (ServiceProfile, bool) {
 }
 
 func setSelectedProfile(profileID string) error {
-	profileID = sanitizeProfileID(profileID)
+	profileID = normalizeProfileRef(profileID)
 	if profileID == "" {
 		return fmt.Errorf("invalid profile id")
 	}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	bundleFormatVersion = 1
+	bundleManifestName  = "manifest.json"
+	bundleProfileName   = "profile.yaml"
+	bundleScriptsDir    = "scripts"
+	bundleFileExtension = ".mitmprofile.zip"
+	maxBundleEntrySize  = 64 << 20
+
+	// Imported scripts live in <profiles>/scripts/<profile id>/.
+	importedScriptsDir = "scripts"
+)
+
+type bundleManifest struct {
+	FormatVersion int          `json:"format_version"`
+	ProfileID     string       `json:"profile_id"`
+	ProfileName   string       `json:"profile_name"`
+	CreatedAt     time.Time    `json:"created_at"`
+	Files         []bundleFile `json:"files"`
+}
+
+type bundleFile struct {
+	Path     string `json:"path"`
+	SHA256   string `json:"sha256"`
+	Size     int64  `json:"size"`
+	Original string `json:"original,omitempty"`
+}
+
+// exportProfileBundle writes the profile, its resolved scripts and a manifest
+// into a single zip archive. The bundled profile refers to its scripts by
+// paths relative to the archive root.
+func exportProfileBundle(profileID, outPath string) (string, error) {
+	if err := loadProfilesFromDisk(); err != nil {
+		return "", err
+	}
+
+	profile, ok := getProfileByID(normalizeProfileRef(profileID))
+	if !ok {
+		return "", fmt.Errorf("profile %q not found", profileID)
+	}
+
+	if outPath == "" {
+		outPath = profile.ID + bundleFileExtension
+	}
+	if abs, err := filepath.Abs(outPath); err == nil {
+		outPath = abs
+	}
+
+	manifest := bundleManifest{
+		FormatVersion: bundleFormatVersion,
+		ProfileID:     profile.ID,
+		ProfileName:   profile.Name,
+		CreatedAt:     time.Now().UTC(),
+	}
+	entries := make(map[string][]byte)
+
+	usedNames := make(map[string]bool)
+	bundledScripts := make([]string, 0, len(profile.ScriptPaths))
+	for i, scriptPath := range profile.ScriptPaths {
+		content, err := os.ReadFile(scriptPath)
+		if err != nil {
+			return "", fmt.Errorf("profile %q has unreadable script %q: %w", profile.Name, scriptPath, err)
+		}
+
+		name := uniqueBundleName(filepath.Base(scriptPath), usedNames)
+		entryPath := path.Join(bundleScriptsDir, name)
+		entries[entryPath] = content
+		bundledScripts = append(bundledScripts, entryPath)
+
+		file := newBundleFile(entryPath, content)
+		if i < len(profile.Scripts) {
+			file.Original = profile.Scripts[i]
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	doc, err := readProfileDocument(profile)
+	if err != nil {
+		return "", err
+	}
+	setProfileDocumentScripts(doc, bundledScripts)
+	profileContent, err := encodeProfileDocument(doc)
+	if err != nil {
+		return "", err
+	}
+	entries[bundleProfileName] = profileContent
+	manifest.Files = append([]bundleFile{newBundleFile(bundleProfileName, profileContent)}, manifest.Files...)
+
+	manifestContent, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(outPath), ".mitmprofile-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	zw := zip.NewWriter(tmpFile)
+	if err := writeBundleEntry(zw, bundleManifestName, manifestContent); err != nil {
+		tmpFile.Close()
+		return "", err
+	}
+	for _, file := range manifest.Files {
+		if err := writeBundleEntry(zw, file.Path, entries[file.Path]); err != nil {
+			tmpFile.Close()
+			return "", err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		tmpFile.Close()
+		return "", err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(tmpFile.Name(), outPath); err != nil {
+		return "", err
+	}
+	return outPath, nil
+}
+
+// importProfileBundle unpacks a bundle created by exportProfileBundle into the
+// profiles directory. Scripts are placed under scripts/<id>/ and the profile's
+// script paths are rewritten to point there. Hooks are dropped unless
+// allowHooks is set; the returned strings describe the hooks of the bundle.
+func importProfileBundle(bundlePath, overrideID string, force, allowHooks bool) (ServiceProfile, []string, error) {
+	if err := loadProfilesFromDisk(); err != nil {
+		return ServiceProfile{}, nil, err
+	}
+
+	zr, err := zip.OpenReader(bundlePath)
+	if err != nil {
+		return ServiceProfile{}, nil, err
+	}
+	defer zr.Close()
+
+	contents, manifest, err := readVerifiedBundle(&zr.Reader)
+	if err != nil {
+		return ServiceProfile{}, nil, fmt.Errorf("%s: %w", filepath.Base(bundlePath), err)
+	}
+
+	// Profiles exported from a source are imported without their namespace.
+	id := sanitizeProfileID(path.Base(manifest.ProfileID))
+	if overrideID != "" {
+		id = sanitizeProfileID(overrideID)
+	}
+	if id == "" {
+		return ServiceProfile{}, nil, fmt.Errorf("bundle has no usable profile id")
+	}
+
+	existing, exists := getProfileByID(id)
+	scriptsDir := filepath.Join(getProfilesDirectory(), importedScriptsDir, id)
+	_, statErr := os.Stat(profileFilePathForID(id))
+	fileExists := statErr == nil
+	if (exists || fileExists) && !force {
+		return ServiceProfile{}, nil, fmt.Errorf("profile %q already exists (use --force to overwrite)", id)
+	}
+
+	doc, err := parseProfileDocument(contents[bundleProfileName], bundleProfileName)
+	if err != nil {
+		return ServiceProfile{}, nil, err
+	}
+	hooks, err := importBundleHooks(doc, allowHooks)
+	if err != nil {
+		return ServiceProfile{}, nil, err
+	}
+
+	var scriptFiles []bundleFile
+	for _, file := range manifest.Files {
+		if strings.HasPrefix(file.Path, bundleScriptsDir+"/") {
+			scriptFiles = append(scriptFiles, file)
+		}
+	}
+
+	// Everything is written to a staging folder first; the current profile
+	// and scripts are swapped out only once that worked, and trashed last.
+	if err := ensureProfilesDirectory(); err != nil {
+		return ServiceProfile{}, nil, err
+	}
+	staging, err := os.MkdirTemp(getProfilesDirectory(), ".import-"+id+"-")
+	if err != nil {
+		return ServiceProfile{}, nil, err
+	}
+	keepStaging := false
+	defer func() {
+		if !keepStaging {
+			_ = os.RemoveAll(staging)
+		}
+	}()
+	stagedScripts := filepath.Join(staging, "scripts")
+	stagedProfile := filepath.Join(staging, "profile.yaml")
+
+	rewritten := make([]string, 0, len(scriptFiles))
+	for _, file := range scriptFiles {
+		rel := strings.TrimPrefix(file.Path, bundleScriptsDir+"/")
+		dest := filepath.Join(stagedScripts, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return ServiceProfile{}, nil, err
+		}
+		if err := os.WriteFile(dest, contents[file.Path], 0644); err != nil {
+			return ServiceProfile{}, nil, err
+		}
+		rewritten = append(rewritten, path.Join(importedScriptsDir, id, rel))
+	}
+
+	setProfileDocumentValue(doc, "id", id)
+	setProfileDocumentScripts(doc, rewritten)
+	profileContent, err := encodeProfileDocument(doc)
+	if err != nil {
+		return ServiceProfile{}, nil, err
+	}
+	if err := os.WriteFile(stagedProfile, profileContent, 0644); err != nil {
+		return ServiceProfile{}, nil, err
+	}
+	if _, err := loadProfileFile(stagedProfile); err != nil {
+		return ServiceProfile{}, nil, fmt.Errorf("generated profile is invalid: %w", err)
+	}
+
+	profilePath := profileFilePathForID(id)
+	oldProfile := filepath.Join(staging, "old-profile"+filepath.Ext(profilePath))
+	oldScripts := filepath.Join(staging, "old-scripts")
+	if exists {
+		profilePath = existing.FilePath
+		oldProfile = filepath.Join(staging, "old-profile"+filepath.Ext(existing.FilePath))
+	}
+	hadProfile := exists || fileExists
+	_, statErr = os.Stat(scriptsDir)
+	hadScripts := statErr == nil
+
+	// Swap: move the current files into the staging folder, then the new
+	// ones into place, undoing the moves if a step fails.
+	if hadScripts {
+		if err := os.Rename(scriptsDir, oldScripts); err != nil {
+			return ServiceProfile{}, nil, err
+		}
+	}
+	rollback := func() {
+		_ = os.RemoveAll(scriptsDir)
+		if hadScripts {
+			_ = os.Rename(oldScripts, scriptsDir)
+		}
+	}
+	if len(scriptFiles) > 0 {
+		if err := os.MkdirAll(filepath.Dir(scriptsDir), 0755); err != nil {
+			rollback()
+			return ServiceProfile{}, nil, err
+		}
+		if err := os.Rename(stagedScripts, scriptsDir); err != nil {
+			rollback()
+			return ServiceProfile{}, nil, err
+		}
+	}
+	if hadProfile {
+		if err := os.Rename(profilePath, oldProfile); err != nil {
+			rollback()
+			return ServiceProfile{}, nil, err
+		}
+	}
+	if err := os.Rename(stagedProfile, profileFilePathForID(id)); err != nil {
+		if hadProfile {
+			_ = os.Rename(oldProfile, profilePath)
+		}
+		rollback()
+		return ServiceProfile{}, nil, err
+	}
+
+	// The import is done; replaced files that cannot be trashed stay in the
+	// staging folder rather than being deleted.
+	var trashErrs []string
+	if exists {
+		old := existing
+		old.FilePath = oldProfile
+		if _, err := moveProfileFileToTrash(old); err != nil {
+			trashErrs = append(trashErrs, err.Error())
+		}
+	}
+	if hadScripts {
+		if err := moveScriptsDirToTrash(id, oldScripts); err != nil {
+			trashErrs = append(trashErrs, err.Error())
+		}
+	}
+	keepStaging = len(trashErrs) > 0
+
+	imported, err := loadProfileFile(profileFilePathForID(id))
+	if err != nil {
+		return ServiceProfile{}, nil, err
+	}
+	if err := loadProfilesFromDisk(); err != nil {
+		return ServiceProfile{}, nil, err
+	}
+	if keepStaging {
+		imported.Warnings = append(imported.Warnings, fmt.Sprintf("replaced files left in %s: %s", staging, strings.Join(trashErrs, "; ")))
+	}
+	if len(hooks) > 0 && !allowHooks {
+		imported.Warnings = append(imported.Warnings, fmt.Sprintf("hooks not imported (use --allow-hooks to keep them): %s", strings.Join(hooks, "; ")))
+	}
+	return imported, hooks, nil
+}
+
+// importBundleHooks lists the hooks of a bundled profile as "name: command"
+// and removes them from doc unless allowHooks is set: a bundle from someone
+// else should not run commands on the next start without being asked to. A
+// relative hook dir would point somewhere else once the profile sits in the
+// profiles folder, so it is rejected.
+func importBundleHooks(doc *yaml.Node, allowHooks bool) ([]string, error) {
+	mapping := doc.Content[0]
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value != "hooks" {
+			continue
+		}
+		var raw profileHooksFile
+		if err := mapping.Content[i+1].Decode(&raw); err != nil {
+			return nil, fmt.Errorf("%s: hooks: %w", bundleProfileName, err)
+		}
+
+		var hooks []string
+		for _, hook := range []struct {
+			name string
+			file *profileHookFile
+		}{
+			{hookPreStart, raw.PreStart},
+			{hookPostStart, raw.PostStart},
+			{hookPreStop, raw.PreStop},
+			{hookPostStop, raw.PostStop},
+		} {
+			if hook.file == nil {
+				continue
+			}
+			dir := strings.TrimSpace(hook.file.Dir)
+			if allowHooks && dir != "" && !filepath.IsAbs(expandHomePath(dir)) {
+				return nil, fmt.Errorf("hook %s: relative dir %q cannot be imported; make it absolute or remove it", hook.name, dir)
+			}
+			hooks = append(hooks, fmt.Sprintf("%s: %s", hook.name, strings.TrimSpace(hook.file.Command)))
+		}
+		if !allowHooks {
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+		}
+		return hooks, nil
+	}
+	return nil, nil
+}
+
+// readVerifiedBundle loads every manifest entry from the archive and checks
+// its size and SHA-256 hash. Entries that are not listed in the manifest or
+// that would escape the extraction directory are rejected.
+func readVerifiedBundle(zr *zip.Reader) (map[string][]byte, bundleManifest, error) {
+	var manifest bundleManifest
+
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if !isSafeBundlePath(f.Name) {
+			return nil, manifest, fmt.Errorf("unsafe path %q in bundle", f.Name)
+		}
+		files[f.Name] = f
+	}
+
+	manifestFile, ok := files[bundleManifestName]
+	if !ok {
+		return nil, manifest, fmt.Errorf("missing %s", bundleManifestName)
+	}
+	manifestContent, err := readBundleEntry(manifestFile)
+	if err != nil {
+		return nil, manifest, err
+	}
+	if err := json.Unmarshal(manifestContent, &manifest); err != nil {
+		return nil, manifest, fmt.Errorf("invalid %s: %w", bundleManifestName, err)
+	}
+	if manifest.FormatVersion != bundleFormatVersion {
+		return nil, manifest, fmt.Errorf("unsupported bundle format version %d", manifest.FormatVersion)
+	}
+
+	contents := make(map[string][]byte, len(manifest.Files))
+	for _, entry := range manifest.Files {
+		f, ok := files[entry.Path]
+		if !ok {
+			return nil, manifest, fmt.Errorf("manifest lists missing file %q", entry.Path)
+		}
+		content, err := readBundleEntry(f)
+		if err != nil {
+			return nil, manifest, err
+		}
+		if int64(len(content)) != entry.Size || hashBytes(content) != strings.ToLower(entry.SHA256) {
+			return nil, manifest, fmt.Errorf("hash mismatch for %q", entry.Path)
+		}
+		contents[entry.Path] = content
+	}
+
+	for name := range files {
+		if _, listed := contents[name]; !listed && name != bundleManifestName {
+			return nil, manifest, fmt.Errorf("file %q is not listed in the manifest", name)
+		}
+	}
+	if _, ok := contents[bundleProfileName]; !ok {
+		return nil, manifest, fmt.Errorf("missing %s", bundleProfileName)
+	}
+	return contents, manifest, nil
+}
+
+func readBundleEntry(f *zip.File) ([]byte, error) {
+	if f.UncompressedSize64 > maxBundleEntrySize {
+		return nil, fmt.Errorf("bundle entry %q is too large", f.Name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, maxBundleEntrySize+1))
+}
+
+func writeBundleEntry(zw *zip.Writer, name string, content []byte) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, bytes.NewReader(content))
+	return err
+}
+
+func isSafeBundlePath(name string) bool {
+	if name == "" || strings.Contains(name, `\`) || path.IsAbs(name) {
+		return false
+	}
+	cleaned := path.Clean(name)
+	return cleaned == name && cleaned != ".." && !strings.HasPrefix(cleaned, "../")
+}
+
+func newBundleFile(entryPath string, content []byte) bundleFile {
+	return bundleFile{Path: entryPath, SHA256: hashBytes(content), Size: int64(len(content))}
+}
+
+func hashBytes(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func uniqueBundleName(name string, used map[string]bool) string {
+	candidate := name
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; used[candidate]; i++ {
+		candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	used[candidate] = true
+	return candidate
+}
+
+func moveScriptsDirToTrash(profileID, scriptsDir string) error {
+	trashDir := filepath.Join(getTrashDirectory(), "scripts")
+	if err := os.MkdirAll(trashDir, 0755); err != nil {
+		return err
+	}
+	timestamp := time.Now().Format("20060102-150405")
+	return os.Rename(scriptsDir, filepath.Join(trashDir, fmt.Sprintf("%s-%s", profileID, timestamp)))
+}
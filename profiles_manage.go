@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const newProfileTemplate = `# Service profile for mitmproxy-controller.
+# See PROFILES_UX.md for the full schema.
+id: %s
+name: %s
+
+# Addon scripts passed to mitmproxy as "-s <path>".
+# Relative paths are resolved from this file's directory.
+scripts: []
+
+# Extra mitmproxy options passed as "--set key=value".
+set_options: {}
+
+# Optional mitmproxy mode passed as "--mode", e.g. "upstream:http://host:port".
+# mode: regular
+
+# mode: transparent redirects traffic without a proxy setting. On Linux the
+# controller installs the redirect rules for a user, a cgroup or traffic
+# arriving on an interface (which also turns on forwarding) and removes them
+# on stop.
+# transparent:
+#   user: testrunner            # or a uid
+#   cgroup: /mitm.slice         # cgroup v2 path
+#   interface: eth1             # act as gateway for this interface
+#   ports: [80, 443]
+#   backend: auto               # auto, nftables or iptables
+
+# mode: wireguard lets phones and other machines connect with a WireGuard
+# client; the tray shows the client config and a QR code.
+# wireguard:
+#   endpoint: 192.168.1.20      # address clients connect to (default: LAN address)
+
+# A CA of its own: mitmproxy runs with a confdir named like this in the
+# controller data folder instead of ~/.mitmproxy. Profiles with the same name
+# share it. The certificate menu acts on the selected profile's CA.
+# confdir: demo
+
+# Hosts that skip the proxy, added to the controller-wide list. Written to the
+# OS bypass list and to mitmproxy's ignore_hosts.
+# bypass_hosts:
+#   - "*.zoom.us"
+#   - sso.example.com
+
+# Hosts sent to mitmproxy when system_proxy.mode is pac; everything else goes
+# DIRECT. Without it the PAC file sends all traffic through this profile.
+# intercept_hosts:
+#   - "*.example.dev"
+#   - api.example.com
+`
+
+func getTrashDirectory() string {
+	return filepath.Join(getControllerDataDirectory(), "trash")
+}
+
+func profileFilePathForID(profileID string) string {
+	return filepath.Join(getProfilesDirectory(), profileID+".yaml")
+}
+
+func createProfile(rawID, name string) (ServiceProfile, error) {
+	if err := loadProfilesFromDisk(); err != nil {
+		return ServiceProfile{}, err
+	}
+
+	id, err := validateNewProfileID(rawID)
+	if err != nil {
+		return ServiceProfile{}, err
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = id
+	}
+
+	content := fmt.Sprintf(newProfileTemplate, quoteYAMLScalar(id), quoteYAMLScalar(name))
+	return writeNewProfileFile(id, []byte(content))
+}
+
+func cloneProfile(sourceID, rawNewID string) (ServiceProfile, error) {
+	if err := loadProfilesFromDisk(); err != nil {
+		return ServiceProfile{}, err
+	}
+
+	source, ok := getProfileByID(normalizeProfileRef(sourceID))
+	if !ok {
+		return ServiceProfile{}, fmt.Errorf("profile %q not found", sourceID)
+	}
+
+	return copyProfile(source, rawNewID, fmt.Sprintf("%s (copy)", source.Name))
+}
+
+func copyProfile(source ServiceProfile, rawNewID, name string) (ServiceProfile, error) {
+	id, err := validateNewProfileID(rawNewID)
+	if err != nil {
+		return ServiceProfile{}, err
+	}
+
+	doc, err := readProfileDocument(source)
+	if err != nil {
+		return ServiceProfile{}, err
+	}
+	setProfileDocumentValue(doc, "id", id)
+	setProfileDocumentValue(doc, "name", name)
+
+	// The copy lives next to the source file only when both share the profiles
+	// directory; otherwise relative script paths have to be pinned first.
+	if filepath.Dir(source.FilePath) != getProfilesDirectory() {
+		setProfileDocumentScripts(doc, source.ScriptPaths)
+	}
+
+	content, err := encodeProfileDocument(doc)
+	if err != nil {
+		return ServiceProfile{}, err
+	}
+	return writeNewProfileFile(id, content)
+}
+
+func renameProfile(oldID, rawNewID, newName string) (ServiceProfile, error) {
+	if err := loadProfilesFromDisk(); err != nil {
+		return ServiceProfile{}, err
+	}
+
+	oldID = normalizeProfileRef(oldID)
+	if oldID == defaultProfileID {
+		return ServiceProfile{}, fmt.Errorf("the default profile cannot be renamed")
+	}
+	source, ok := getProfileByID(oldID)
+	if !ok {
+		return ServiceProfile{}, fmt.Errorf("profile %q not found", oldID)
+	}
+	if source.ReadOnly {
+		return ServiceProfile{}, fmt.Errorf("profile %q is read-only; fork it first", oldID)
+	}
+
+	newID := sanitizeProfileID(rawNewID)
+	if newID == "" {
+		return ServiceProfile{}, fmt.Errorf("invalid profile id %q", rawNewID)
+	}
+	if newID != oldID {
+		if _, err := validateNewProfileID(newID); err != nil {
+			return ServiceProfile{}, err
+		}
+	}
+
+	doc, err := readProfileDocument(source)
+	if err != nil {
+		return ServiceProfile{}, err
+	}
+	setProfileDocumentValue(doc, "id", newID)
+	if newName = strings.TrimSpace(newName); newName != "" {
+		setProfileDocumentValue(doc, "name", newName)
+	}
+
+	content, err := encodeProfileDocument(doc)
+	if err != nil {
+		return ServiceProfile{}, err
+	}
+
+	newPath := profileFilePathForID(newID)
+	if err := os.WriteFile(newPath, content, 0644); err != nil {
+		return ServiceProfile{}, err
+	}
+	if newPath != source.FilePath {
+		if err := os.Remove(source.FilePath); err != nil {
+			_ = os.Remove(newPath)
+			return ServiceProfile{}, err
+		}
+	}
+
+	wasSelected := selectedProfileID == oldID
+	if err := loadProfilesFromDisk(); err != nil {
+		return ServiceProfile{}, err
+	}
+	if wasSelected {
+		if err := setSelectedProfile(newID); err != nil {
+			return ServiceProfile{}, err
+		}
+	}
+
+	renamed, ok := getProfileByID(newID)
+	if !ok {
+		return ServiceProfile{}, fmt.Errorf("renamed profile %q could not be loaded", newID)
+	}
+	return renamed, nil
+}
+
+// deleteProfile moves the profile file into the trash folder and returns the
+// path it was moved to.
+func deleteProfile(profileID string) (string, error) {
+	if err := loadProfilesFromDisk(); err != nil {
+		return "", err
+	}
+
+	profileID = normalizeProfileRef(profileID)
+	if profileID == defaultProfileID {
+		return "", fmt.Errorf("the default profile cannot be deleted")
+	}
+	profile, ok := getProfileByID(profileID)
+	if !ok {
+		return "", fmt.Errorf("profile %q not found", profileID)
+	}
+	if profile.ReadOnly {
+		return "", fmt.Errorf("profile %q is read-only; remove it from its source instead", profileID)
+	}
+
+	trashPath, err := moveProfileFileToTrash(profile)
+	if err != nil {
+		return "", err
+	}
+
+	wasSelected := selectedProfileID == profileID
+	if err := loadProfilesFromDisk(); err != nil {
+		return trashPath, err
+	}
+	if wasSelected {
+		if err := setSelectedProfile(defaultProfileID); err != nil {
+			return trashPath, err
+		}
+	}
+	return trashPath, nil
+}
+
+func moveProfileFileToTrash(profile ServiceProfile) (string, error) {
+	trashDir := filepath.Join(getTrashDirectory(), "profiles")
+	if err := os.MkdirAll(trashDir, 0755); err != nil {
+		return "", err
+	}
+
+	timestamp := time.Now().Format("20060102-150405")
+	trashPath := filepath.Join(trashDir, fmt.Sprintf("%s-%s%s", profile.ID, timestamp, filepath.Ext(profile.FilePath)))
+	if err := os.Rename(profile.FilePath, trashPath); err != nil {
+		return "", err
+	}
+	return trashPath, nil
+}
+
+func validateNewProfileID(rawID string) (string, error) {
+	id := sanitizeProfileID(rawID)
+	if id == "" {
+		return "", fmt.Errorf("invalid profile id %q", rawID)
+	}
+	if hasProfile(id) {
+		return "", fmt.Errorf("profile %q already exists", id)
+	}
+	if _, err := os.Stat(profileFilePathForID(id)); err == nil {
+		return "", fmt.Errorf("profile file %s already exists", profileFilePathForID(id))
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	return id, nil
+}
+
+func writeNewProfileFile(id string, content []byte) (ServiceProfile, error) {
+	if err := ensureProfilesDirectory(); err != nil {
+		return ServiceProfile{}, err
+	}
+
+	path := profileFilePathForID(id)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return ServiceProfile{}, err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		_ = os.Remove(path)
+		return ServiceProfile{}, err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(path)
+		return ServiceProfile{}, err
+	}
+
+	profile, err := loadProfileFile(path)
+	if err != nil {
+		_ = os.Remove(path)
+		return ServiceProfile{}, fmt.Errorf("generated profile is invalid: %w", err)
+	}
+
+	if err := loadProfilesFromDisk(); err != nil {
+		return ServiceProfile{}, err
+	}
+	return profile, nil
+}
+
+// readProfileDocument parses a profile file as a YAML node tree so that edits
+// keep the user's comments and key order intact.
+func readProfileDocument(profile ServiceProfile) (*yaml.Node, error) {
+	content, err := os.ReadFile(profile.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	return parseProfileDocument(content, profile.FilePath)
+}
+
+func parseProfileDocument(content []byte, source string) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: profile is not a YAML mapping", source)
+	}
+	return &doc, nil
+}
+
+func encodeProfileDocument(doc *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func setProfileDocumentValue(doc *yaml.Node, key, value string) {
+	mapping := doc.Content[0]
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			node := mapping.Content[i+1]
+			node.Kind = yaml.ScalarNode
+			node.Tag = "!!str"
+			node.Style = 0
+			node.Content = nil
+			node.Value = value
+			return
+		}
+	}
+	mapping.Content = append(mapping.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value},
+	)
+}
+
+func setProfileDocumentScripts(doc *yaml.Node, scripts []string) {
+	list := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	if len(scripts) == 0 {
+		list.Style = yaml.FlowStyle
+	}
+	for _, script := range scripts {
+		list.Content = append(list.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: script})
+	}
+
+	mapping := doc.Content[0]
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == "scripts" {
+			list.HeadComment = mapping.Content[i+1].HeadComment
+			mapping.Content[i+1] = list
+			return
+		}
+	}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "scripts"}, list)
+}
+
+func quoteYAMLScalar(value string) string {
+	out, err := yaml.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%q", value)
+	}
+	return strings.TrimSpace(string(out))
+}
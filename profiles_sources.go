@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// profileSource is an additional, read-only location to load profiles from:
+// either a local directory or a git remote cloned into the controller data
+// directory.
+type profileSource struct {
+	Name   string `yaml:"name"`
+	Path   string `yaml:"path,omitempty"`
+	Git    string `yaml:"git,omitempty"`
+	Branch string `yaml:"branch,omitempty"`
+	Subdir string `yaml:"subdir,omitempty"`
+	// Pull runs "git pull" on sync for path sources that are git checkouts.
+	Pull bool `yaml:"pull,omitempty"`
+	// AllowHooks runs the hooks of the source's profiles. They are shell
+	// commands from someone else's repository, so they are off by default.
+	AllowHooks bool `yaml:"allow_hooks,omitempty"`
+}
+
+func getSourcesDirectory() string {
+	return filepath.Join(getControllerDataDirectory(), "sources")
+}
+
+func (s profileSource) id() string {
+	return sanitizeProfileID(s.Name)
+}
+
+// checkoutDir is where the source's files live on disk: the configured path,
+// or the managed clone for git sources.
+func (s profileSource) checkoutDir() string {
+	if s.Git != "" {
+		return filepath.Join(getSourcesDirectory(), s.id())
+	}
+	path := expandHomePath(strings.TrimSpace(s.Path))
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return path
+}
+
+func (s profileSource) profilesDir() string {
+	if s.Subdir == "" {
+		return s.checkoutDir()
+	}
+	return filepath.Join(s.checkoutDir(), filepath.FromSlash(s.Subdir))
+}
+
+func configuredProfileSources() ([]profileSource, []string) {
+	sources := make([]profileSource, 0, len(appSettings.ProfileSources))
+	warnings := make([]string, 0)
+	seen := make(map[string]bool)
+
+	for _, source := range appSettings.ProfileSources {
+		id := source.id()
+		switch {
+		case id == "":
+			warnings = append(warnings, fmt.Sprintf("profile source %q: name is empty", source.Name))
+		case source.Path == "" && source.Git == "":
+			warnings = append(warnings, fmt.Sprintf("profile source %q: set either path or git", source.Name))
+		case source.Path != "" && source.Git != "":
+			warnings = append(warnings, fmt.Sprintf("profile source %q: path and git are mutually exclusive", source.Name))
+		case seen[id]:
+			warnings = append(warnings, fmt.Sprintf("profile source %q: duplicate name", source.Name))
+		default:
+			seen[id] = true
+			sources = append(sources, source)
+		}
+	}
+	return sources, warnings
+}
+
+// discoverSourceProfiles loads the profiles of every configured source and
+// namespaces their IDs as "<source>/<id>".
+func discoverSourceProfiles() ([]ServiceProfile, []string) {
+	sources, warnings := configuredProfileSources()
+	profiles := make([]ServiceProfile, 0)
+
+	for _, source := range sources {
+		dir := source.profilesDir()
+		if _, err := os.Stat(dir); err != nil {
+			if source.Git != "" && os.IsNotExist(err) {
+				warnings = append(warnings, fmt.Sprintf("profile source %q has not been synced yet", source.Name))
+			} else {
+				warnings = append(warnings, fmt.Sprintf("profile source %q: %v", source.Name, err))
+			}
+			continue
+		}
+
+		found, loadWarnings, err := discoverProfilesIn(dir)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("profile source %q: %v", source.Name, err))
+			continue
+		}
+		for _, warning := range loadWarnings {
+			warnings = append(warnings, fmt.Sprintf("%s/%s", source.id(), warning))
+		}
+
+		for _, p := range found {
+			p.ID = source.id() + "/" + p.ID
+			p.Source = source.id()
+			p.ReadOnly = true
+			if p.Hooks.any() && !source.AllowHooks {
+				p.Hooks = ProfileHooks{}
+				warnings = append(warnings, fmt.Sprintf("%s: hooks ignored; set allow_hooks: true on profile source %q to run them", p.ID, source.Name))
+			}
+			profiles = append(profiles, p)
+		}
+	}
+	return profiles, warnings
+}
+
+// syncProfileSources clones or fast-forwards git sources (and path sources
+// with pull enabled). An empty name syncs every source.
+func syncProfileSources(name string) ([]string, error) {
+	loadSettingsFromDisk()
+	sources, _ := configuredProfileSources()
+
+	var synced []string
+	var failures []string
+	for _, source := range sources {
+		if name != "" && source.id() != sanitizeProfileID(name) {
+			continue
+		}
+		if err := syncProfileSource(source); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", source.id(), err))
+			continue
+		}
+		synced = append(synced, source.id())
+	}
+
+	if name != "" && len(synced) == 0 && len(failures) == 0 {
+		return nil, fmt.Errorf("profile source %q not found", name)
+	}
+	if err := loadProfilesFromDisk(); err != nil {
+		return synced, err
+	}
+	if len(failures) > 0 {
+		return synced, fmt.Errorf("sync failed for %s", strings.Join(failures, "; "))
+	}
+	return synced, nil
+}
+
+func syncProfileSource(source profileSource) error {
+	dir := source.checkoutDir()
+
+	if source.Git == "" {
+		if !source.Pull {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+			return fmt.Errorf("%s is not a git checkout", dir)
+		}
+		return runGit(dir, "pull", "--ff-only")
+	}
+
+	// The branch goes to git as an argument; "--" guards the URL below.
+	if strings.HasPrefix(source.Branch, "-") {
+		return fmt.Errorf("invalid branch %q", source.Branch)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		if err := os.MkdirAll(getSourcesDirectory(), 0755); err != nil {
+			return err
+		}
+		args := []string{"clone", "--depth", "1"}
+		if source.Branch != "" {
+			args = append(args, "--branch", source.Branch)
+		}
+		args = append(args, "--", source.Git, dir)
+		return runGit("", args...)
+	}
+
+	if source.Branch != "" {
+		if err := runGit(dir, "fetch", "--depth", "1", "origin", source.Branch); err != nil {
+			return err
+		}
+		return runGit(dir, "reset", "--hard", "FETCH_HEAD")
+	}
+	return runGit(dir, "pull", "--ff-only")
+}
+
+func runGit(dir string, args ...string) error {
+	if _, err := exec.LookPath("git"); err != nil {
+		return fmt.Errorf("git not found in PATH")
+	}
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(string(out))
+		if msg == "" {
+			return fmt.Errorf("git %s: %w", args[0], err)
+		}
+		lines := strings.Split(msg, "\n")
+		return fmt.Errorf("git %s: %s", args[0], lines[len(lines)-1])
+	}
+	return nil
+}
+
+// forkProfile copies a read-only source profile into the local profiles
+// directory. Script paths are pinned to the source checkout so the fork keeps
+// working without copying the scripts.
+func forkProfile(sourceID, rawNewID string) (ServiceProfile, error) {
+	if err := loadProfilesFromDisk(); err != nil {
+		return ServiceProfile{}, err
+	}
+
+	source, ok := getProfileByID(normalizeProfileRef(sourceID))
+	if !ok {
+		return ServiceProfile{}, fmt.Errorf("profile %q not found", sourceID)
+	}
+	if rawNewID == "" {
+		rawNewID = source.ID[strings.LastIndex(source.ID, "/")+1:]
+	}
+
+	return copyProfile(source, rawNewID, source.Name)
+}
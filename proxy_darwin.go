@@ -9,38 +9,176 @@ import (
 )
 
 func enableSystemProxy() error {
-	service, err := getActiveNetworkService()
+	services, err := proxyTargetServices()
+	if err != nil {
+		return err
+	}
+	// Services changed earlier (e.g. after a network change) keep following
+	// the primary instance even if they are no longer selected.
+	originalBypass := map[string][]string{}
+	if snapshot, ok := loadProxySnapshot(); ok {
+		for _, settings := range snapshot.Config.Services {
+			services = appendUnique(services, settings.Service)
+			originalBypass[settings.Service] = settings.BypassDomains
+		}
+	}
+
+	var failed []string
+	for _, service := range services {
+		if err := applyControllerProxy(service, originalBypass[service]); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// applyControllerProxy points a service at the controller according to
+// system_proxy.mode: the PAC file or the primary instance directly.
+func applyControllerProxy(service string, originalBypass []string) error {
+	if !pacModeEnabled() {
+		return setServiceProxy(service, originalBypass)
+	}
+	pacURL, err := preparePACProxy()
 	if err != nil {
 		return err
 	}
+	return setServicePAC(service, pacURL)
+}
+
+// setServicePAC configures the auto-proxy URL and switches the static
+// proxies off, since they would take precedence over the PAC file.
+func setServicePAC(service, pacURL string) error {
+	if err := runNetworksetup("-setautoproxyurl", service, pacURL); err != nil {
+		return fmt.Errorf("failed to set auto proxy URL on %s: %w", service, err)
+	}
+	if err := runNetworksetup("-setautoproxystate", service, "on"); err != nil {
+		return fmt.Errorf("failed to enable auto proxy on %s: %w", service, err)
+	}
+	exec.Command("networksetup", "-setwebproxystate", service, "off").Run()
+	exec.Command("networksetup", "-setsecurewebproxystate", service, "off").Run()
+	return nil
+}
 
-	if err := exec.Command("networksetup", "-setwebproxy", service, proxyHost, proxyPort).Run(); err != nil {
-		return fmt.Errorf("failed to set HTTP proxy: %w", err)
+// setServiceProxy points a service at the primary instance. Bypass hosts are
+// added to the domains the service bypassed before we changed it.
+func setServiceProxy(service string, originalBypass []string) error {
+	port := systemProxyPort()
+	if err := exec.Command("networksetup", "-setwebproxy", service, proxyHost, port).Run(); err != nil {
+		return fmt.Errorf("failed to set HTTP proxy on %s: %w", service, err)
 	}
 
-	if err := exec.Command("networksetup", "-setsecurewebproxy", service, proxyHost, proxyPort).Run(); err != nil {
-		return fmt.Errorf("failed to set HTTPS proxy: %w", err)
+	if err := exec.Command("networksetup", "-setsecurewebproxy", service, proxyHost, port).Run(); err != nil {
+		return fmt.Errorf("failed to set HTTPS proxy on %s: %w", service, err)
 	}
 
 	// Explicitly enable the proxy state
 	exec.Command("networksetup", "-setwebproxystate", service, "on").Run()
 	exec.Command("networksetup", "-setsecurewebproxystate", service, "on").Run()
 
+	// Leaving PAC mode: our PAC file must not stay in charge.
+	if pacURL, enabled, _ := readServiceAutoProxy(service); enabled && isControllerPACURL(pacURL) {
+		exec.Command("networksetup", "-setautoproxystate", service, "off").Run()
+	}
+
+	bypass := mergeHostLists(originalBypass, systemBypassHosts())
+	if len(bypass) == 0 {
+		bypass = []string{"Empty"}
+	}
+	if err := runNetworksetup(append([]string{"-setproxybypassdomains", service}, bypass...)...); err != nil {
+		return fmt.Errorf("failed to set bypass domains on %s: %w", service, err)
+	}
+
 	return nil
 }
 
 func disableSystemProxy() error {
-	service, err := getActiveNetworkService()
+	services, err := proxyTargetServices()
 	if err != nil {
 		return err
 	}
 
-	exec.Command("networksetup", "-setwebproxystate", service, "off").Run()
-	exec.Command("networksetup", "-setsecurewebproxystate", service, "off").Run()
+	for _, service := range services {
+		exec.Command("networksetup", "-setwebproxystate", service, "off").Run()
+		exec.Command("networksetup", "-setsecurewebproxystate", service, "off").Run()
+		if pacURL, enabled, _ := readServiceAutoProxy(service); enabled && isControllerPACURL(pacURL) {
+			exec.Command("networksetup", "-setautoproxystate", service, "off").Run()
+		}
+	}
 
 	return nil
 }
 
+// proxyTargetServices resolves system_proxy.services: the active service
+// (default), every enabled service, or the enabled services matching a list
+// of names (wildcards allowed).
+func proxyTargetServices() ([]string, error) {
+	selection := appSettings.SystemProxy.Services
+	if !selection.All && len(selection.Names) == 0 {
+		service, err := getActiveNetworkService()
+		if err != nil {
+			return nil, err
+		}
+		return []string{service}, nil
+	}
+
+	available, err := listNetworkServices()
+	if err != nil {
+		return nil, err
+	}
+	if selection.All {
+		return available, nil
+	}
+
+	var services []string
+	for _, service := range available {
+		for _, pattern := range selection.Names {
+			if globMatch(pattern, service) {
+				services = append(services, service)
+				break
+			}
+		}
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("no enabled network service matches system_proxy.services %v", selection.Names)
+	}
+	return services, nil
+}
+
+// listNetworkServices returns the enabled network services. Output of
+// "networksetup -listallnetworkservices":
+//
+//	An asterisk (*) denotes that a network service is disabled.
+//	Wi-Fi
+//	*Thunderbolt Bridge
+func listNetworkServices() ([]string, error) {
+	out, err := exec.Command("networksetup", "-listallnetworkservices").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list network services: %w", err)
+	}
+
+	var services []string
+	for i, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if i == 0 || line == "" || strings.HasPrefix(line, "*") {
+			continue
+		}
+		services = append(services, line)
+	}
+	return services, nil
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, existing := range values {
+		if existing == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
 func isProxyEnabled() bool {
 	service, err := getActiveNetworkService()
 	if err != nil {
@@ -48,25 +186,106 @@ func isProxyEnabled() bool {
 	}
 
 	out, _ := exec.Command("networksetup", "-getwebproxy", service).Output()
-	return strings.Contains(string(out), "Enabled: Yes")
+	return strings.Contains(string(out), "Enabled: Yes") || isControllerPACActive()
 }
 
-func getActiveNetworkService() (string, error) {
-	// Get the default route interface (e.g., en0)
+// readSystemAutoProxy returns the auto-proxy (PAC) URL of the active service.
+func readSystemAutoProxy() (string, bool, error) {
+	service, err := getActiveNetworkService()
+	if err != nil {
+		return "", false, err
+	}
+	return readServiceAutoProxy(service)
+}
+
+// readServiceAutoProxy parses "networksetup -getautoproxyurl" output:
+//
+//	URL: http://wpad/proxy.pac
+//	Enabled: Yes
+func readServiceAutoProxy(service string) (string, bool, error) {
+	out, err := exec.Command("networksetup", "-getautoproxyurl", service).Output()
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read auto proxy URL of %s: %w", service, err)
+	}
+
+	var url string
+	var enabled bool
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, _ := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "URL":
+			if value != "(null)" {
+				url = value
+			}
+		case "Enabled":
+			enabled = value == "Yes"
+		}
+	}
+	return url, enabled, nil
+}
+
+func readSystemWebProxy() (systemProxyEndpoint, error) {
+	service, err := getActiveNetworkService()
+	if err != nil {
+		return systemProxyEndpoint{}, err
+	}
+
+	out, err := exec.Command("networksetup", "-getwebproxy", service).Output()
+	if err != nil {
+		return systemProxyEndpoint{}, fmt.Errorf("failed to read HTTP proxy: %w", err)
+	}
+	return parseNetworksetupProxy(string(out)), nil
+}
+
+// parseNetworksetupProxy parses "networksetup -get(secure)webproxy" output:
+//
+//	Enabled: Yes
+//	Server: 127.0.0.1
+//	Port: 8899
+func parseNetworksetupProxy(out string) systemProxyEndpoint {
+	var endpoint systemProxyEndpoint
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "Enabled":
+			endpoint.Enabled = value == "Yes"
+		case "Server":
+			endpoint.Host = value
+		case "Port":
+			endpoint.Port = value
+		}
+	}
+	if endpoint.Port == "0" {
+		endpoint.Port = ""
+	}
+	return endpoint
+}
+
+// getDefaultRouteInterface returns the interface of the default route
+// (e.g. en0), or "" if there is none.
+func getDefaultRouteInterface() string {
 	routeOut, err := exec.Command("route", "-n", "get", "default").Output()
 	if err != nil {
-		return "Wi-Fi", nil
+		return ""
 	}
 
-	var activeInterface string
 	for _, line := range strings.Split(string(routeOut), "\n") {
 		line = strings.TrimSpace(line)
 		if strings.HasPrefix(line, "interface:") {
-			activeInterface = strings.TrimSpace(strings.TrimPrefix(line, "interface:"))
-			break
+			return strings.TrimSpace(strings.TrimPrefix(line, "interface:"))
 		}
 	}
+	return ""
+}
 
+func getActiveNetworkService() (string, error) {
+	// Get the default route interface (e.g., en0)
+	activeInterface := getDefaultRouteInterface()
 	if activeInterface == "" {
 		return "Wi-Fi", nil
 	}
@@ -92,3 +311,267 @@ func getActiveNetworkService() (string, error) {
 
 	return "Wi-Fi", nil
 }
+
+// serviceProxySettings is the complete proxy configuration of one network
+// service as reported by networksetup.
+type serviceProxySettings struct {
+	Service          string              `json:"service"`
+	Web              systemProxyEndpoint `json:"web"`
+	SecureWeb        systemProxyEndpoint `json:"secure_web"`
+	Socks            systemProxyEndpoint `json:"socks"`
+	AutoProxyURL     string              `json:"auto_proxy_url,omitempty"`
+	AutoProxyEnabled bool                `json:"auto_proxy_enabled"`
+	AutoDiscovery    bool                `json:"auto_discovery"`
+	BypassDomains    []string            `json:"bypass_domains,omitempty"`
+}
+
+type platformProxyConfig struct {
+	Services []serviceProxySettings `json:"services"`
+}
+
+// webProxy returns the HTTP proxy of the first recorded service.
+func (c platformProxyConfig) webProxy() systemProxyEndpoint {
+	if len(c.Services) == 0 {
+		return systemProxyEndpoint{}
+	}
+	return c.Services[0].Web
+}
+
+func captureSystemProxy() (platformProxyConfig, error) {
+	services, err := proxyTargetServices()
+	if err != nil {
+		return platformProxyConfig{}, err
+	}
+
+	var config platformProxyConfig
+	for _, service := range services {
+		settings, err := readServiceProxySettings(service)
+		if err != nil {
+			return platformProxyConfig{}, err
+		}
+		config.Services = append(config.Services, settings)
+	}
+	return config, nil
+}
+
+// extendSystemProxy applies the proxy to selected services that are not in
+// the snapshot yet, recording their previous settings first. It returns the
+// services it added.
+func extendSystemProxy(config *platformProxyConfig) ([]string, error) {
+	services, err := proxyTargetServices()
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[string]bool{}
+	for _, settings := range config.Services {
+		known[settings.Service] = true
+	}
+
+	var added []string
+	for _, service := range services {
+		if known[service] {
+			continue
+		}
+		settings, err := readServiceProxySettings(service)
+		if err != nil {
+			return added, err
+		}
+		config.Services = append(config.Services, settings)
+		if err := applyControllerProxy(service, settings.BypassDomains); err != nil {
+			return added, err
+		}
+		added = append(added, service)
+	}
+	return added, nil
+}
+
+func readServiceProxySettings(service string) (serviceProxySettings, error) {
+	settings := serviceProxySettings{Service: service}
+
+	proxies := []struct {
+		flag   string
+		target *systemProxyEndpoint
+	}{
+		{"-getwebproxy", &settings.Web},
+		{"-getsecurewebproxy", &settings.SecureWeb},
+		{"-getsocksfirewallproxy", &settings.Socks},
+	}
+	for _, p := range proxies {
+		out, err := exec.Command("networksetup", p.flag, service).Output()
+		if err != nil {
+			return settings, fmt.Errorf("failed to read proxy settings of %s: %w", service, err)
+		}
+		*p.target = parseNetworksetupProxy(string(out))
+	}
+
+	if url, enabled, err := readServiceAutoProxy(service); err == nil {
+		settings.AutoProxyURL = url
+		settings.AutoProxyEnabled = enabled
+	}
+
+	// Output: "Auto Proxy Discovery: On"
+	if out, err := exec.Command("networksetup", "-getproxyautodiscovery", service).Output(); err == nil {
+		settings.AutoDiscovery = strings.HasSuffix(strings.TrimSpace(string(out)), ": On")
+	}
+
+	if domains, err := readServiceBypassDomains(service); err == nil {
+		settings.BypassDomains = domains
+	}
+
+	// Never record the controller's own endpoint as the previous proxy.
+	for _, endpoint := range []*systemProxyEndpoint{&settings.Web, &settings.SecureWeb} {
+		if endpoint.isController() {
+			*endpoint = systemProxyEndpoint{}
+		}
+	}
+	if isControllerPACURL(settings.AutoProxyURL) {
+		settings.AutoProxyURL = ""
+		settings.AutoProxyEnabled = false
+	}
+	return settings, nil
+}
+
+// readServiceBypassDomains parses "networksetup -getproxybypassdomains": one
+// domain per line, or "There aren't any bypass domains set on Wi-Fi."
+func readServiceBypassDomains(service string) ([]string, error) {
+	out, err := exec.Command("networksetup", "-getproxybypassdomains", service).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bypass domains of %s: %w", service, err)
+	}
+
+	var domains []string
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "There aren't any") {
+			domains = append(domains, line)
+		}
+	}
+	return domains, nil
+}
+
+// checkSystemProxy compares every service we configured with the desired
+// state and describes each difference.
+func checkSystemProxy(port string) ([]string, error) {
+	snapshot, ok := loadProxySnapshot()
+	if !ok {
+		return nil, nil
+	}
+
+	var drift []string
+	for _, original := range snapshot.Config.Services {
+		service := original.Service
+		if pacModeEnabled() {
+			pacURL, enabled, err := readServiceAutoProxy(service)
+			if err != nil {
+				return nil, err
+			}
+			if d := autoProxyDrift(pacURL, enabled); d != "" {
+				drift = append(drift, fmt.Sprintf("%s: auto proxy %s", service, d))
+			}
+			continue
+		}
+
+		for _, p := range []struct{ label, flag string }{
+			{"HTTP", "-getwebproxy"},
+			{"HTTPS", "-getsecurewebproxy"},
+		} {
+			out, err := exec.Command("networksetup", p.flag, service).Output()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read proxy settings of %s: %w", service, err)
+			}
+			if d := endpointDrift(parseNetworksetupProxy(string(out)), port); d != "" {
+				drift = append(drift, fmt.Sprintf("%s: %s proxy %s", service, p.label, d))
+			}
+		}
+
+		domains, err := readServiceBypassDomains(service)
+		if err != nil {
+			return nil, err
+		}
+		if !sameHostSet(domains, mergeHostLists(original.BypassDomains, systemBypassHosts())) {
+			drift = append(drift, fmt.Sprintf("%s: bypass list changed", service))
+		}
+	}
+	return drift, nil
+}
+
+func restoreSystemProxy(config platformProxyConfig) error {
+	var failed []string
+	for _, settings := range config.Services {
+		if err := applyServiceProxySettings(settings); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", settings.Service, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func applyServiceProxySettings(settings serviceProxySettings) error {
+	service := settings.Service
+
+	proxies := []struct {
+		setFlag, stateFlag string
+		endpoint           systemProxyEndpoint
+	}{
+		{"-setwebproxy", "-setwebproxystate", settings.Web},
+		{"-setsecurewebproxy", "-setsecurewebproxystate", settings.SecureWeb},
+		{"-setsocksfirewallproxy", "-setsocksfirewallproxystate", settings.Socks},
+	}
+	for _, p := range proxies {
+		if p.endpoint.Host != "" {
+			port := p.endpoint.Port
+			if port == "" {
+				port = "0"
+			}
+			if err := runNetworksetup(p.setFlag, service, p.endpoint.Host, port); err != nil {
+				return err
+			}
+		} else {
+			// Clear a server we may have left behind; older macOS versions
+			// reject an empty host, in which case switching it off suffices.
+			_ = exec.Command("networksetup", p.setFlag, service, "", "0").Run()
+		}
+		if err := runNetworksetup(p.stateFlag, service, onOff(p.endpoint.Enabled && p.endpoint.Host != "")); err != nil {
+			return err
+		}
+	}
+
+	if settings.AutoProxyURL != "" {
+		if err := runNetworksetup("-setautoproxyurl", service, settings.AutoProxyURL); err != nil {
+			return err
+		}
+	}
+	if err := runNetworksetup("-setautoproxystate", service, onOff(settings.AutoProxyEnabled)); err != nil {
+		return err
+	}
+	if err := runNetworksetup("-setproxyautodiscovery", service, onOff(settings.AutoDiscovery)); err != nil {
+		return err
+	}
+
+	bypass := settings.BypassDomains
+	if len(bypass) == 0 {
+		bypass = []string{"Empty"}
+	}
+	return runNetworksetup(append([]string{"-setproxybypassdomains", service}, bypass...)...)
+}
+
+func runNetworksetup(args ...string) error {
+	out, err := exec.Command("networksetup", args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("networksetup %s: %s", args[0], msg)
+		}
+		return fmt.Errorf("networksetup %s: %w", args[0], err)
+	}
+	return nil
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
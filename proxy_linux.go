@@ -0,0 +1,306 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// On Linux the system proxy is the GNOME one (org.gnome.system.proxy), which
+// GNOME, Chromium and most GTK applications follow.
+
+const gnomeProxySchema = "org.gnome.system.proxy"
+
+func enableSystemProxy() error {
+	if pacModeEnabled() {
+		pacURL, err := preparePACProxy()
+		if err != nil {
+			return err
+		}
+		if err := gsettingsSet(gnomeProxySchema, "autoconfig-url", gvariantString(pacURL)); err != nil {
+			return fmt.Errorf("failed to set auto proxy URL: %w", err)
+		}
+		return gsettingsSet(gnomeProxySchema, "mode", gvariantString("auto"))
+	}
+
+	port := systemProxyPort()
+	for _, proto := range []string{"http", "https"} {
+		if err := gsettingsSet(gnomeProxySchema+"."+proto, "host", gvariantString(proxyHost)); err != nil {
+			return fmt.Errorf("failed to set %s proxy: %w", strings.ToUpper(proto), err)
+		}
+		if err := gsettingsSet(gnomeProxySchema+"."+proto, "port", port); err != nil {
+			return fmt.Errorf("failed to set %s proxy: %w", strings.ToUpper(proto), err)
+		}
+	}
+
+	if ignore := desiredIgnoreHosts(); len(ignore) > 0 {
+		if err := gsettingsSet(gnomeProxySchema, "ignore-hosts", gvariantStringArray(ignore)); err != nil {
+			return fmt.Errorf("failed to set proxy bypass list: %w", err)
+		}
+	}
+
+	return gsettingsSet(gnomeProxySchema, "mode", gvariantString("manual"))
+}
+
+func desiredIgnoreHosts() []string {
+	var original []string
+	if snapshot, ok := loadProxySnapshot(); ok {
+		original = snapshot.Config.IgnoreHosts
+	}
+	return mergeHostLists(original, systemBypassHosts())
+}
+
+func disableSystemProxy() error {
+	return gsettingsSet(gnomeProxySchema, "mode", gvariantString("none"))
+}
+
+func isProxyEnabled() bool {
+	mode, err := gsettingsGet(gnomeProxySchema, "mode")
+	return err == nil && parseGVariantString(mode) == "manual" || isControllerPACActive()
+}
+
+// readSystemAutoProxy returns the PAC URL, which GNOME uses in "auto" mode.
+func readSystemAutoProxy() (string, bool, error) {
+	mode, err := gsettingsGet(gnomeProxySchema, "mode")
+	if err != nil {
+		return "", false, err
+	}
+	url, err := gsettingsGet(gnomeProxySchema, "autoconfig-url")
+	if err != nil {
+		return "", false, err
+	}
+	return parseGVariantString(url), parseGVariantString(mode) == "auto", nil
+}
+
+func readSystemWebProxy() (systemProxyEndpoint, error) {
+	mode, err := gsettingsGet(gnomeProxySchema, "mode")
+	if err != nil {
+		return systemProxyEndpoint{}, err
+	}
+	endpoint, err := readGnomeProxyEndpoint("http")
+	if err != nil {
+		return systemProxyEndpoint{}, err
+	}
+	endpoint.Enabled = parseGVariantString(mode) == "manual" && endpoint.Host != ""
+	return endpoint, nil
+}
+
+// checkSystemProxy compares the GNOME proxy settings with the desired state
+// and describes each difference.
+func checkSystemProxy(port string) ([]string, error) {
+	if pacModeEnabled() {
+		pacURL, enabled, err := readSystemAutoProxy()
+		if err != nil {
+			return nil, err
+		}
+		if d := autoProxyDrift(pacURL, enabled); d != "" {
+			return []string{"auto proxy " + d}, nil
+		}
+		return nil, nil
+	}
+
+	mode, err := gsettingsGet(gnomeProxySchema, "mode")
+	if err != nil {
+		return nil, err
+	}
+	manual := parseGVariantString(mode) == "manual"
+
+	var drift []string
+	for _, proto := range []string{"http", "https"} {
+		endpoint, err := readGnomeProxyEndpoint(proto)
+		if err != nil {
+			return nil, err
+		}
+		endpoint.Enabled = manual
+		if d := endpointDrift(endpoint, port); d != "" {
+			drift = append(drift, fmt.Sprintf("%s proxy %s", strings.ToUpper(proto), d))
+		}
+	}
+
+	if value, err := gsettingsGet(gnomeProxySchema, "ignore-hosts"); err == nil {
+		if !sameHostSet(parseGVariantStringArray(value), desiredIgnoreHosts()) {
+			drift = append(drift, "bypass list changed")
+		}
+	}
+	return drift, nil
+}
+
+// platformProxyConfig is the GNOME proxy configuration. Endpoint Enabled
+// flags are unused; GNOME has a single mode for all protocols.
+type platformProxyConfig struct {
+	Mode          string              `json:"mode"`
+	HTTP          systemProxyEndpoint `json:"http"`
+	HTTPS         systemProxyEndpoint `json:"https"`
+	Socks         systemProxyEndpoint `json:"socks"`
+	AutoConfigURL string              `json:"autoconfig_url,omitempty"`
+	IgnoreHosts   []string            `json:"ignore_hosts"`
+}
+
+func (c platformProxyConfig) webProxy() systemProxyEndpoint {
+	endpoint := c.HTTP
+	endpoint.Enabled = c.Mode == "manual" && endpoint.Host != ""
+	return endpoint
+}
+
+func captureSystemProxy() (platformProxyConfig, error) {
+	var config platformProxyConfig
+
+	mode, err := gsettingsGet(gnomeProxySchema, "mode")
+	if err != nil {
+		return config, err
+	}
+	config.Mode = parseGVariantString(mode)
+
+	for proto, target := range map[string]*systemProxyEndpoint{
+		"http":  &config.HTTP,
+		"https": &config.HTTPS,
+		"socks": &config.Socks,
+	} {
+		if *target, err = readGnomeProxyEndpoint(proto); err != nil {
+			return config, err
+		}
+	}
+
+	if value, err := gsettingsGet(gnomeProxySchema, "autoconfig-url"); err == nil {
+		config.AutoConfigURL = parseGVariantString(value)
+	}
+	if value, err := gsettingsGet(gnomeProxySchema, "ignore-hosts"); err == nil {
+		config.IgnoreHosts = parseGVariantStringArray(value)
+	}
+
+	// Never record the controller's own endpoint as the previous proxy.
+	for _, endpoint := range []*systemProxyEndpoint{&config.HTTP, &config.HTTPS} {
+		if endpoint.isController() {
+			*endpoint = systemProxyEndpoint{}
+		}
+	}
+	if isControllerPACURL(config.AutoConfigURL) {
+		config.AutoConfigURL = ""
+		if config.Mode == "auto" {
+			config.Mode = "none"
+		}
+	}
+	if config.Mode == "manual" && config.HTTP.Host == "" && config.HTTPS.Host == "" && config.Socks.Host == "" {
+		config.Mode = "none"
+	}
+	return config, nil
+}
+
+// extendSystemProxy is a no-op: the GNOME proxy applies to every connection.
+func extendSystemProxy(config *platformProxyConfig) ([]string, error) {
+	return nil, nil
+}
+
+func restoreSystemProxy(config platformProxyConfig) error {
+	for proto, endpoint := range map[string]systemProxyEndpoint{
+		"http":  config.HTTP,
+		"https": config.HTTPS,
+		"socks": config.Socks,
+	} {
+		port := endpoint.Port
+		if port == "" {
+			port = "0"
+		}
+		if err := gsettingsSet(gnomeProxySchema+"."+proto, "host", gvariantString(endpoint.Host)); err != nil {
+			return err
+		}
+		if err := gsettingsSet(gnomeProxySchema+"."+proto, "port", port); err != nil {
+			return err
+		}
+	}
+
+	if err := gsettingsSet(gnomeProxySchema, "autoconfig-url", gvariantString(config.AutoConfigURL)); err != nil {
+		return err
+	}
+	if err := gsettingsSet(gnomeProxySchema, "ignore-hosts", gvariantStringArray(config.IgnoreHosts)); err != nil {
+		return err
+	}
+
+	mode := config.Mode
+	if mode == "" {
+		mode = "none"
+	}
+	return gsettingsSet(gnomeProxySchema, "mode", gvariantString(mode))
+}
+
+func readGnomeProxyEndpoint(proto string) (systemProxyEndpoint, error) {
+	var endpoint systemProxyEndpoint
+	host, err := gsettingsGet(gnomeProxySchema+"."+proto, "host")
+	if err != nil {
+		return endpoint, err
+	}
+	port, err := gsettingsGet(gnomeProxySchema+"."+proto, "port")
+	if err != nil {
+		return endpoint, err
+	}
+
+	endpoint.Host = parseGVariantString(host)
+	endpoint.Port = strings.TrimSpace(port)
+	if endpoint.Port == "0" {
+		endpoint.Port = ""
+	}
+	return endpoint, nil
+}
+
+func gsettingsGet(schema, key string) (string, error) {
+	out, err := exec.Command("gsettings", "get", schema, key).Output()
+	if err != nil {
+		if _, lookErr := exec.LookPath("gsettings"); lookErr != nil {
+			return "", fmt.Errorf("gsettings not found; only the GNOME proxy settings are supported")
+		}
+		return "", fmt.Errorf("gsettings get %s %s: %w", schema, key, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func gsettingsSet(schema, key, value string) error {
+	out, err := exec.Command("gsettings", "set", schema, key, value).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("gsettings set %s %s: %s", schema, key, msg)
+		}
+		return fmt.Errorf("gsettings set %s %s: %w", schema, key, err)
+	}
+	return nil
+}
+
+// gvariantString quotes a value in GVariant text format: 'value'.
+func gvariantString(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return "'" + strings.ReplaceAll(value, "'", `\'`) + "'"
+}
+
+func gvariantStringArray(values []string) string {
+	if len(values) == 0 {
+		return "@as []"
+	}
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = gvariantString(value)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+func parseGVariantString(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && (value[0] == '\'' || value[0] == '"') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+	return strings.NewReplacer(`\\`, `\`, `\'`, "'", `\"`, `"`).Replace(value)
+}
+
+// parseGVariantStringArray parses "['localhost', '127.0.0.0/8']" or "@as []".
+func parseGVariantStringArray(value string) []string {
+	value = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(value), "@as"))
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+
+	var values []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			values = append(values, parseGVariantString(part))
+		}
+	}
+	return values
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxySnapshot is the complete OS proxy configuration captured right before
+// the controller enabled its own proxy. platformProxyConfig is defined per
+// platform next to the code that reads and writes it.
+type proxySnapshot struct {
+	CapturedAt time.Time           `json:"captured_at"`
+	Config     platformProxyConfig `json:"config"`
+}
+
+func getProxySnapshotPath() string {
+	return filepath.Join(getControllerDataDirectory(), "proxy-snapshot.json")
+}
+
+func loadProxySnapshot() (proxySnapshot, bool) {
+	var snapshot proxySnapshot
+	content, err := os.ReadFile(getProxySnapshotPath())
+	if err != nil {
+		return snapshot, false
+	}
+	if err := json.Unmarshal(content, &snapshot); err != nil {
+		return snapshot, false
+	}
+	return snapshot, true
+}
+
+// snapshotSystemProxy records the current proxy configuration before the
+// controller replaces it. An existing snapshot is kept while our proxy is
+// still active, so re-enabling never captures the controller's own settings,
+// and while we still own it but another tool rewrote it (see the watchdog).
+func snapshotSystemProxy() error {
+	if snapshot, ok := loadProxySnapshot(); ok {
+		if marker, owned := loadProxyMarker(); (owned && marker.PID == os.Getpid()) || controllerOwnsSystemProxy() {
+			// Still ours: only record services selected since then.
+			added, err := extendSystemProxy(&snapshot.Config)
+			if len(added) > 0 {
+				if saveErr := saveProxySnapshot(snapshot); saveErr != nil && err == nil {
+					err = saveErr
+				}
+			}
+			return err
+		}
+	}
+
+	config, err := captureSystemProxy()
+	if err != nil {
+		return err
+	}
+	return saveProxySnapshot(proxySnapshot{CapturedAt: time.Now(), Config: config})
+}
+
+func saveProxySnapshot(snapshot proxySnapshot) error {
+	payload, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(getControllerDataDirectory(), 0755); err != nil {
+		return err
+	}
+
+	tmpPath := getProxySnapshotPath() + ".tmp"
+	if err := os.WriteFile(tmpPath, payload, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, getProxySnapshotPath())
+}
+
+// restoreSystemProxySnapshot puts back the configuration recorded by
+// snapshotSystemProxy. Without a snapshot it only switches our proxy off.
+func restoreSystemProxySnapshot() error {
+	snapshot, ok := loadProxySnapshot()
+	if !ok {
+		if err := disableSystemProxy(); err != nil {
+			return err
+		}
+		clearProxyMarker()
+		return nil
+	}
+	if err := restoreSystemProxy(snapshot.Config); err != nil {
+		return fmt.Errorf("restore proxy settings from %s: %w", snapshot.CapturedAt.Format(time.RFC3339), err)
+	}
+	clearProxyMarker()
+	return os.Remove(getProxySnapshotPath())
+}
+
+var lastProxyNetwork networkInfo
+
+// reconcileProxyServices runs on every status poll. When the network changed
+// while our proxy is enabled, it applies the proxy to services that came up
+// since (docking onto Ethernet, a VPN service) so traffic keeps flowing
+// through mitmproxy. Nothing is read while the network stays the same.
+func reconcileProxyServices(poll pollState) string {
+	if poll.Network == lastProxyNetwork {
+		return ""
+	}
+	lastProxyNetwork = poll.Network
+
+	if !poll.OwnsProxy {
+		return ""
+	}
+	snapshot, ok := loadProxySnapshot()
+	if !ok {
+		return ""
+	}
+
+	added, err := extendSystemProxy(&snapshot.Config)
+	if len(added) > 0 {
+		if saveErr := saveProxySnapshot(snapshot); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+	if err != nil {
+		return fmt.Sprintf("Failed to apply proxy after network change: %v", err)
+	}
+	if len(added) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Proxy applied to %s", strings.Join(added, ", "))
+}
+
+// proxyMarker records that the controller enabled the system proxy. It
+// outlives a crash, so the next launch can tell a stale configuration from
+// one the user set up.
+type proxyMarker struct {
+	PID       int       `json:"pid"`
+	Port      string    `json:"port"`
+	EnabledAt time.Time `json:"enabled_at"`
+}
+
+func getProxyMarkerPath() string {
+	return filepath.Join(getControllerDataDirectory(), "proxy-enabled.json")
+}
+
+func markProxyEnabled() error {
+	payload, err := json.MarshalIndent(proxyMarker{
+		PID:       os.Getpid(),
+		Port:      systemProxyPort(),
+		EnabledAt: time.Now(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(getProxyMarkerPath(), payload, 0644)
+}
+
+func loadProxyMarker() (proxyMarker, bool) {
+	var marker proxyMarker
+	content, err := os.ReadFile(getProxyMarkerPath())
+	if err != nil {
+		return marker, false
+	}
+	if err := json.Unmarshal(content, &marker); err != nil {
+		return marker, false
+	}
+	return marker, true
+}
+
+func clearProxyMarker() {
+	_ = os.Remove(getProxyMarkerPath())
+}
+
+// releaseProxyMu serializes releaseSystemProxy: the signal handler and the
+// quit path can both run it.
+var releaseProxyMu sync.Mutex
+
+// releaseSystemProxy restores the previous settings if this process enabled
+// the system proxy. It is called on quit and on SIGINT/SIGTERM; the second
+// call finds the marker gone and does nothing.
+func releaseSystemProxy() string {
+	releaseProxyMu.Lock()
+	defer releaseProxyMu.Unlock()
+
+	marker, ok := loadProxyMarker()
+	if !ok || marker.PID != os.Getpid() {
+		return ""
+	}
+	if err := restoreSystemProxySnapshot(); err != nil {
+		return fmt.Sprintf("Failed to restore proxy settings: %v", err)
+	}
+	return "Proxy disabled, previous settings restored"
+}
+
+// recoverStaleProxy handles a proxy left enabled by a controller that did not
+// shut down cleanly, according to system_proxy.recovery in settings.yaml.
+func recoverStaleProxy() string {
+	marker, ok := loadProxyMarker()
+	if !ok || marker.PID == os.Getpid() {
+		return ""
+	}
+	if err := controlRequest("GET", "/v1/status", nil, nil); err == nil {
+		// Another controller is running and still owns the proxy.
+		return ""
+	}
+
+	if !controllerOwnsSystemProxy() {
+		// Someone already changed the settings; the snapshot is outdated.
+		clearProxyMarker()
+		_ = os.Remove(getProxySnapshotPath())
+		return ""
+	}
+
+	switch strings.ToLower(appSettings.SystemProxy.Recovery) {
+	case "off":
+		return adoptStaleProxy()
+	case "auto":
+	default:
+		restore, err := confirmAction("Restore Proxy Settings", fmt.Sprintf(
+			"mitmproxy-controller did not shut down cleanly and the system proxy still points at %s. Restore the previous proxy settings?",
+			net.JoinHostPort(proxyHost, marker.Port)))
+		if err != nil {
+			return fmt.Sprintf("Failed to ask about the stale proxy: %v", err)
+		}
+		if !restore {
+			return adoptStaleProxy()
+		}
+	}
+
+	if err := restoreSystemProxySnapshot(); err != nil {
+		return fmt.Sprintf("Failed to restore stale proxy settings: %v", err)
+	}
+	return "Restored proxy settings left behind by the last run"
+}
+
+// adoptStaleProxy keeps a stale proxy enabled and takes ownership of it, so
+// Disable System Proxy and quitting restore the original settings later.
+func adoptStaleProxy() string {
+	if err := markProxyEnabled(); err != nil {
+		return fmt.Sprintf("Failed to update proxy marker: %v", err)
+	}
+	return "Kept the system proxy enabled by the last run"
+}
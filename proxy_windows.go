@@ -21,7 +21,10 @@ var (
 )
 
 func enableSystemProxy() error {
-	proxyServer := fmt.Sprintf("%s:%s", proxyHost, proxyPort)
+	if pacModeEnabled() {
+		return enablePACProxy()
+	}
+	proxyServer := fmt.Sprintf("%s:%s", proxyHost, systemProxyPort())
 
 	// Set ProxyEnable = 1
 	if err := exec.Command("reg", "add",
@@ -37,12 +40,71 @@ func enableSystemProxy() error {
 		return fmt.Errorf("failed to set proxy server: %w", err)
 	}
 
+	// ProxyOverride: bypass hosts on top of what was configured before us
+	if override := desiredProxyOverride(); len(override) > 0 {
+		if err := exec.Command("reg", "add", internetSettingsKey,
+			"/v", "ProxyOverride", "/t", "REG_SZ", "/d", strings.Join(override, ";"), "/f").Run(); err != nil {
+			return fmt.Errorf("failed to set proxy bypass list: %w", err)
+		}
+	}
+
+	// Leaving PAC mode: put back the AutoConfigURL we replaced.
+	if current, ok := queryInternetSetting("AutoConfigURL"); ok && isControllerPACURL(current) {
+		if err := removeControllerPAC(); err != nil {
+			return err
+		}
+	}
+
 	// Notify applications of the change
 	notifyProxyChange()
 
 	return nil
 }
 
+func desiredProxyOverride() []string {
+	var original []string
+	if snapshot, ok := loadProxySnapshot(); ok && snapshot.Config.ProxyOverride.Present {
+		original = strings.Split(snapshot.Config.ProxyOverride.Value, ";")
+	}
+	return mergeHostLists(original, systemBypassHosts())
+}
+
+// enablePACProxy points WinINet at the controller's PAC file. ProxyEnable is
+// cleared so a static proxy configured before cannot bypass the PAC rules.
+func enablePACProxy() error {
+	pacURL, err := preparePACProxy()
+	if err != nil {
+		return err
+	}
+	if err := exec.Command("reg", "add", internetSettingsKey,
+		"/v", "AutoConfigURL", "/t", "REG_SZ", "/d", pacURL, "/f").Run(); err != nil {
+		return fmt.Errorf("failed to set auto proxy URL: %w", err)
+	}
+	if err := exec.Command("reg", "add", internetSettingsKey,
+		"/v", "ProxyEnable", "/t", "REG_DWORD", "/d", "0", "/f").Run(); err != nil {
+		return fmt.Errorf("failed to disable static proxy: %w", err)
+	}
+
+	notifyProxyChange()
+	return nil
+}
+
+// removeControllerPAC restores the AutoConfigURL recorded in the snapshot, or
+// deletes the value when there was none.
+func removeControllerPAC() error {
+	if snapshot, ok := loadProxySnapshot(); ok && snapshot.Config.AutoConfigURL.Present {
+		if err := exec.Command("reg", "add", internetSettingsKey,
+			"/v", "AutoConfigURL", "/t", "REG_SZ", "/d", snapshot.Config.AutoConfigURL.Value, "/f").Run(); err != nil {
+			return fmt.Errorf("failed to restore auto proxy URL: %w", err)
+		}
+		return nil
+	}
+	if err := exec.Command("reg", "delete", internetSettingsKey, "/v", "AutoConfigURL", "/f").Run(); err != nil {
+		return fmt.Errorf("failed to remove auto proxy URL: %w", err)
+	}
+	return nil
+}
+
 func disableSystemProxy() error {
 	// Set ProxyEnable = 0
 	if err := exec.Command("reg", "add",
@@ -50,6 +112,11 @@ func disableSystemProxy() error {
 		"/v", "ProxyEnable", "/t", "REG_DWORD", "/d", "0", "/f").Run(); err != nil {
 		return fmt.Errorf("failed to disable proxy: %w", err)
 	}
+	if current, ok := queryInternetSetting("AutoConfigURL"); ok && isControllerPACURL(current) {
+		if err := removeControllerPAC(); err != nil {
+			return err
+		}
+	}
 
 	// Notify applications of the change
 	notifyProxyChange()
@@ -67,7 +134,192 @@ func isProxyEnabled() bool {
 
 	// Check if ProxyEnable is set to 1
 	// Output format: "    ProxyEnable    REG_DWORD    0x1"
-	return strings.Contains(string(out), "0x1")
+	return strings.Contains(string(out), "0x1") || isControllerPACActive()
+}
+
+// readSystemAutoProxy returns AutoConfigURL; WinINet uses it whenever it is
+// set, independent of ProxyEnable.
+func readSystemAutoProxy() (string, bool, error) {
+	url, ok := queryInternetSetting("AutoConfigURL")
+	return url, ok && url != "", nil
+}
+
+func readSystemWebProxy() (systemProxyEndpoint, error) {
+	var endpoint systemProxyEndpoint
+
+	enabled, _ := queryInternetSetting("ProxyEnable")
+	endpoint.Enabled = strings.HasSuffix(enabled, "0x1")
+
+	server, ok := queryInternetSetting("ProxyServer")
+	if !ok {
+		return endpoint, nil
+	}
+	endpoint.Host, endpoint.Port = parseProxyServer(server)
+	return endpoint, nil
+}
+
+// parseProxyServer splits a ProxyServer value, which is either "host:port" or
+// a per-protocol list like "http=host:port;https=host:port".
+func parseProxyServer(value string) (string, string) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "=") {
+		entries := map[string]string{}
+		for _, part := range strings.Split(value, ";") {
+			if proto, addr, ok := strings.Cut(part, "="); ok {
+				entries[strings.ToLower(strings.TrimSpace(proto))] = strings.TrimSpace(addr)
+			}
+		}
+		value = entries["http"]
+		if value == "" {
+			value = entries["https"]
+		}
+	}
+
+	value = strings.TrimPrefix(strings.TrimPrefix(value, "http://"), "https://")
+	if host, port, ok := strings.Cut(value, ":"); ok {
+		return host, strings.TrimSuffix(port, "/")
+	}
+	return value, "80"
+}
+
+// queryInternetSetting reads a value from the per-user Internet Settings key.
+// Output format: "    ProxyServer    REG_SZ    127.0.0.1:8899"
+func queryInternetSetting(name string) (string, bool) {
+	out, err := exec.Command("reg", "query",
+		`HKCU\Software\Microsoft\Windows\CurrentVersion\Internet Settings`,
+		"/v", name).Output()
+	if err != nil {
+		return "", false
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && strings.EqualFold(fields[0], name) && strings.HasPrefix(fields[1], "REG_") {
+			if len(fields) == 2 {
+				return "", true
+			}
+			idx := strings.Index(line, fields[1]) + len(fields[1])
+			return strings.TrimSpace(line[idx:]), true
+		}
+	}
+	return "", false
+}
+
+const internetSettingsKey = `HKCU\Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+
+// registryValue is a REG_SZ value that may be absent; restoring an absent
+// value deletes it again instead of writing an empty string.
+type registryValue struct {
+	Present bool   `json:"present"`
+	Value   string `json:"value,omitempty"`
+}
+
+type platformProxyConfig struct {
+	ProxyEnable   bool          `json:"proxy_enable"`
+	ProxyServer   registryValue `json:"proxy_server"`
+	ProxyOverride registryValue `json:"proxy_override"`
+	AutoConfigURL registryValue `json:"auto_config_url"`
+}
+
+func (c platformProxyConfig) webProxy() systemProxyEndpoint {
+	if !c.ProxyServer.Present {
+		return systemProxyEndpoint{}
+	}
+	host, port := parseProxyServer(c.ProxyServer.Value)
+	return systemProxyEndpoint{Enabled: c.ProxyEnable, Host: host, Port: port}
+}
+
+func captureSystemProxy() (platformProxyConfig, error) {
+	var config platformProxyConfig
+
+	enabled, _ := queryInternetSetting("ProxyEnable")
+	config.ProxyEnable = strings.HasSuffix(enabled, "0x1")
+	for name, target := range map[string]*registryValue{
+		"ProxyServer":   &config.ProxyServer,
+		"ProxyOverride": &config.ProxyOverride,
+		"AutoConfigURL": &config.AutoConfigURL,
+	} {
+		target.Value, target.Present = queryInternetSetting(name)
+	}
+
+	// Never record the controller's own endpoint as the previous proxy.
+	if config.webProxy().isController() {
+		config.ProxyEnable = false
+		config.ProxyServer = registryValue{}
+	}
+	if isControllerPACURL(config.AutoConfigURL.Value) {
+		config.AutoConfigURL = registryValue{}
+	}
+	return config, nil
+}
+
+// extendSystemProxy is a no-op: WinINet proxy settings apply to every
+// connection of the user already.
+func extendSystemProxy(config *platformProxyConfig) ([]string, error) {
+	return nil, nil
+}
+
+func restoreSystemProxy(config platformProxyConfig) error {
+	enable := "0"
+	if config.ProxyEnable {
+		enable = "1"
+	}
+	if err := exec.Command("reg", "add", internetSettingsKey,
+		"/v", "ProxyEnable", "/t", "REG_DWORD", "/d", enable, "/f").Run(); err != nil {
+		return fmt.Errorf("failed to restore ProxyEnable: %w", err)
+	}
+
+	for _, v := range []struct {
+		name  string
+		value registryValue
+	}{
+		{"ProxyServer", config.ProxyServer},
+		{"ProxyOverride", config.ProxyOverride},
+		{"AutoConfigURL", config.AutoConfigURL},
+	} {
+		if v.value.Present {
+			if err := exec.Command("reg", "add", internetSettingsKey,
+				"/v", v.name, "/t", "REG_SZ", "/d", v.value.Value, "/f").Run(); err != nil {
+				return fmt.Errorf("failed to restore %s: %w", v.name, err)
+			}
+		} else if _, exists := queryInternetSetting(v.name); exists {
+			if err := exec.Command("reg", "delete", internetSettingsKey, "/v", v.name, "/f").Run(); err != nil {
+				return fmt.Errorf("failed to remove %s: %w", v.name, err)
+			}
+		}
+	}
+
+	notifyProxyChange()
+	return nil
+}
+
+// checkSystemProxy compares the WinINet settings with the desired state and
+// describes each difference.
+func checkSystemProxy(port string) ([]string, error) {
+	if pacModeEnabled() {
+		pacURL, enabled, err := readSystemAutoProxy()
+		if err != nil {
+			return nil, err
+		}
+		if d := autoProxyDrift(pacURL, enabled); d != "" {
+			return []string{"auto proxy " + d}, nil
+		}
+		return nil, nil
+	}
+
+	var drift []string
+	current, err := readSystemWebProxy()
+	if err != nil {
+		return nil, err
+	}
+	if d := endpointDrift(current, port); d != "" {
+		drift = append(drift, "proxy "+d)
+	}
+	override, _ := queryInternetSetting("ProxyOverride")
+	if !sameHostSet(strings.Split(override, ";"), desiredProxyOverride()) {
+		drift = append(drift, "bypass list changed")
+	}
+	return drift, nil
 }
 
 func notifyProxyChange() {
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultRulesInterval = 60 * time.Second
+	minRulesInterval     = 10 * time.Second
+)
+
+const rulesTemplate = `# Automatic profile switching rules for mitmproxy-controller.
+# Rules are evaluated top to bottom; the first rule whose conditions all match
+# selects its profile. Enable switching with "Automatic Profile Switching" in
+# the tray. Rules are re-evaluated every "interval", when the network changes
+# and when a terminal reports a repository (mitmproxy-controller report-repo).
+#
+# Conditions (all optional, "*" and "?" wildcards, case-insensitive):
+#   ssid:            Wi-Fi network name
+#   interface:       default-route interface, e.g. en0
+#   network_service: macOS network service, e.g. "USB 10/100/1000 LAN"
+#   time:            "09:00-18:00" (may wrap midnight, e.g. "22:00-06:00")
+#   days:            [mon, tue, wed, thu, fri]
+#   repo:            last reported git repo path, folder name or remote URL
+interval: 60s
+rules: []
+#  - name: Payments repo
+#    profile: payments
+#    when:
+#      repo: "*payments-service*"
+#  - name: Office network
+#    profile: team/corp
+#    when:
+#      ssid: CorpWiFi
+#      days: [mon, tue, wed, thu, fri]
+#  - name: Everything else
+#    profile: default
+`
+
+type profileRulesFile struct {
+	Interval string        `yaml:"interval"`
+	Rules    []profileRule `yaml:"rules"`
+}
+
+type profileRule struct {
+	Name    string         `yaml:"name"`
+	Profile string         `yaml:"profile"`
+	When    ruleConditions `yaml:"when"`
+}
+
+type ruleConditions struct {
+	SSID           string   `yaml:"ssid"`
+	Interface      string   `yaml:"interface"`
+	NetworkService string   `yaml:"network_service"`
+	Time           string   `yaml:"time"`
+	Days           []string `yaml:"days"`
+	Repo           string   `yaml:"repo"`
+}
+
+type networkInfo struct {
+	Interface string `json:"interface"`
+	Service   string `json:"service"`
+	SSID      string `json:"ssid"`
+}
+
+// reportedRepo is the git repository a terminal last reported through the
+// control API.
+type reportedRepo struct {
+	Path       string    `json:"path"`
+	Remote     string    `json:"remote,omitempty"`
+	ReportedAt time.Time `json:"reported_at"`
+}
+
+type ruleContext struct {
+	Network networkInfo
+	Now     time.Time
+	Repo    reportedRepo
+}
+
+// autoSwitch holds the rule engine's state between evaluations. It is only
+// touched from the tray goroutine, except for repo which the control API
+// updates.
+var autoSwitch struct {
+	enabled     bool
+	evaluated   bool
+	lastEval    time.Time
+	lastNetwork networkInfo
+	// interval is the one from the last read of rules.yaml, so the file is
+	// only read once the next evaluation is due.
+	interval    time.Duration
+	matched     string
+	matchedDesc string
+
+	repoMu sync.Mutex
+	repo   reportedRepo
+}
+
+// rulesTriggerC requests an immediate rule evaluation from the tray loop.
+var rulesTriggerC = make(chan struct{}, 1)
+
+func getRulesPath() string {
+	return filepath.Join(getControllerDataDirectory(), "rules.yaml")
+}
+
+func ensureRulesFileExists() (string, error) {
+	if err := os.MkdirAll(getControllerDataDirectory(), 0755); err != nil {
+		return "", err
+	}
+
+	rulesPath := getRulesPath()
+	f, err := os.OpenFile(rulesPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return rulesPath, nil
+		}
+		return "", err
+	}
+	if _, err := f.WriteString(rulesTemplate); err != nil {
+		f.Close()
+		return "", err
+	}
+	return rulesPath, f.Close()
+}
+
+func loadProfileRules() (profileRulesFile, time.Duration, error) {
+	var rules profileRulesFile
+	content, err := os.ReadFile(getRulesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return rules, defaultRulesInterval, nil
+		}
+		return rules, defaultRulesInterval, err
+	}
+	if err := yaml.Unmarshal(content, &rules); err != nil {
+		return rules, defaultRulesInterval, fmt.Errorf("rules.yaml: %w", err)
+	}
+
+	interval := defaultRulesInterval
+	if rules.Interval != "" {
+		d, err := time.ParseDuration(rules.Interval)
+		if err != nil {
+			return rules, defaultRulesInterval, fmt.Errorf("rules.yaml: invalid interval %q", rules.Interval)
+		}
+		interval = max(d, minRulesInterval)
+	}
+
+	for i := range rules.Rules {
+		rules.Rules[i].Profile = normalizeProfileRef(rules.Rules[i].Profile)
+		if strings.TrimSpace(rules.Rules[i].Name) == "" {
+			rules.Rules[i].Name = fmt.Sprintf("rule %d", i+1)
+		}
+	}
+	return rules, interval, nil
+}
+
+// matchProfileRule returns the first rule whose conditions all hold.
+func matchProfileRule(rules []profileRule, ctx ruleContext) (profileRule, bool, error) {
+	for _, rule := range rules {
+		ok, err := rule.When.matches(ctx)
+		if err != nil {
+			return profileRule{}, false, fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		if ok {
+			return rule, true, nil
+		}
+	}
+	return profileRule{}, false, nil
+}
+
+func (c ruleConditions) matches(ctx ruleContext) (bool, error) {
+	if c.SSID != "" && !globMatch(c.SSID, ctx.Network.SSID) {
+		return false, nil
+	}
+	if c.Interface != "" && !globMatch(c.Interface, ctx.Network.Interface) {
+		return false, nil
+	}
+	if c.NetworkService != "" && !globMatch(c.NetworkService, ctx.Network.Service) {
+		return false, nil
+	}
+	if c.Repo != "" {
+		repo := ctx.Repo
+		if repo.Path == "" {
+			return false, nil
+		}
+		if !globMatch(c.Repo, repo.Path) && !globMatch(c.Repo, filepath.Base(repo.Path)) &&
+			(repo.Remote == "" || !globMatch(c.Repo, repo.Remote)) {
+			return false, nil
+		}
+	}
+	if len(c.Days) > 0 && !dayMatches(c.Days, ctx.Now) {
+		return false, nil
+	}
+	if c.Time != "" {
+		ok, err := timeWindowMatches(c.Time, ctx.Now)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func globMatch(pattern, value string) bool {
+	if value == "" {
+		return false
+	}
+	quoted := regexp.QuoteMeta(strings.TrimSpace(pattern))
+	quoted = strings.ReplaceAll(quoted, `\*`, ".*")
+	quoted = strings.ReplaceAll(quoted, `\?`, ".")
+	re, err := regexp.Compile("(?i)^" + quoted + "$")
+	return err == nil && re.MatchString(value)
+}
+
+func dayMatches(days []string, now time.Time) bool {
+	today := strings.ToLower(now.Weekday().String()[:3])
+	for _, day := range days {
+		day = strings.ToLower(strings.TrimSpace(day))
+		if len(day) >= 3 && day[:3] == today {
+			return true
+		}
+	}
+	return false
+}
+
+// timeWindowMatches checks "HH:MM-HH:MM"; windows may wrap past midnight.
+func timeWindowMatches(window string, now time.Time) (bool, error) {
+	startRaw, endRaw, ok := strings.Cut(window, "-")
+	if !ok {
+		return false, fmt.Errorf("invalid time window %q", window)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(startRaw))
+	if err != nil {
+		return false, fmt.Errorf("invalid time window %q", window)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(endRaw))
+	if err != nil {
+		return false, fmt.Errorf("invalid time window %q", window)
+	}
+
+	minutes := now.Hour()*60 + now.Minute()
+	from := start.Hour()*60 + start.Minute()
+	to := end.Hour()*60 + end.Minute()
+	if from <= to {
+		return minutes >= from && minutes < to, nil
+	}
+	return minutes >= from || minutes < to, nil
+}
+
+func setReportedRepo(repo reportedRepo) {
+	autoSwitch.repoMu.Lock()
+	autoSwitch.repo = repo
+	autoSwitch.repoMu.Unlock()
+	triggerRuleEvaluation()
+}
+
+func getReportedRepo() reportedRepo {
+	autoSwitch.repoMu.Lock()
+	defer autoSwitch.repoMu.Unlock()
+	return autoSwitch.repo
+}
+
+func triggerRuleEvaluation() {
+	select {
+	case rulesTriggerC <- struct{}{}:
+	default:
+	}
+}
+
+func setAutoSwitchEnabled(enabled bool) error {
+	autoSwitch.enabled = enabled
+	autoSwitch.evaluated = false
+	autoSwitch.lastEval = time.Time{}
+	autoSwitch.matched = ""
+	autoSwitch.matchedDesc = ""
+
+	state := loadControllerState()
+	state.AutoSwitchEnabled = enabled
+	return saveControllerState(state)
+}
+
+// evaluateAutoSwitch runs the rules when due (forced, network changed or
+// interval elapsed) and applies the matched profile when the matched rule
+// changed since the last evaluation, so manual selections stick until the
+// conditions change. network is the current network, read by the caller.
+// It returns a status message when something happened.
+func evaluateAutoSwitch(force bool, network networkInfo) string {
+	if !autoSwitch.enabled {
+		return ""
+	}
+
+	due := force || autoSwitch.lastEval.IsZero() || network != autoSwitch.lastNetwork ||
+		time.Since(autoSwitch.lastEval) >= autoSwitch.interval
+	if !due {
+		return ""
+	}
+	autoSwitch.lastEval = time.Now()
+	autoSwitch.lastNetwork = network
+
+	rules, interval, err := loadProfileRules()
+	autoSwitch.interval = interval
+	if err != nil {
+		return fmt.Sprintf("Auto profile: %v", err)
+	}
+
+	ctx := ruleContext{Network: network, Now: time.Now(), Repo: getReportedRepo()}
+	rule, ok, err := matchProfileRule(rules.Rules, ctx)
+	if err != nil {
+		return fmt.Sprintf("Auto profile: %v", err)
+	}
+
+	matched := ""
+	if ok {
+		matched = rule.Name + "\x00" + rule.Profile
+	}
+	if autoSwitch.evaluated && matched == autoSwitch.matched {
+		return ""
+	}
+	autoSwitch.evaluated = true
+	autoSwitch.matched = matched
+
+	if !ok {
+		autoSwitch.matchedDesc = ""
+		return ""
+	}
+
+	profile, found := getProfileByID(rule.Profile)
+	if !found {
+		autoSwitch.matchedDesc = fmt.Sprintf("%s → missing profile %s", rule.Name, rule.Profile)
+		return fmt.Sprintf("Auto profile: rule %q selects unknown profile %q", rule.Name, rule.Profile)
+	}
+	autoSwitch.matchedDesc = fmt.Sprintf("%s → %s", rule.Name, profile.Name)
+
+	if profile.ID == selectedProfileID {
+		return ""
+	}
+	return fmt.Sprintf("Rule %q: %s", rule.Name, applyProfileSelection(profile.ID))
+}
+
+func autoSwitchMenuTitle() string {
+	if autoSwitch.matchedDesc == "" {
+		return "Rule: no rule matched"
+	}
+	return "Rule: " + autoSwitch.matchedDesc
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const settingsTemplate = `# mitmproxy-controller settings.
+# Changes are picked up on "Refresh Status" or the next start.
+
+# Additional read-only profile sources. Profiles from a source are listed as
+# "<name>/<profile id>" and can be forked into a local editable copy.
+#
+# profile_sources:
+#   - name: team
+#     git: git@github.com:acme/mitm-profiles.git
+#     branch: main
+#     subdir: profiles
+#   - name: shared
+#     path: ~/work/shared-mitm-profiles
+profile_sources: []
+
+# Upstream (corporate) proxy that mitmproxy chains through. A profile can
+# override it with "upstream: <url>" or disable it with "upstream: none".
+#
+# upstream:
+#   url: http://proxy.corp.example:3128   # fixed upstream
+#   username: jdoe
+#   keychain: true     # password from keychain entry "mitmproxy-controller-upstream"
+#   auto_detect: true  # otherwise use the system proxy that was active before ours
+upstream: {}
+
+# System proxy handling.
+#
+# system_proxy:
+#   # static (default): every request goes through mitmproxy. pac: the OS
+#   # loads a PAC file served on 127.0.0.1:<pac_port>, which sends only the
+#   # profiles' intercept_hosts to mitmproxy and everything else DIRECT.
+#   mode: pac
+#   pac_port: 8897
+#   # What to do at launch when the previous run crashed or was killed while
+#   # the system proxy pointed at mitmproxy: ask (default), auto (restore the
+#   # previous settings without asking) or off (keep it enabled).
+#   recovery: ask
+#   # macOS network services to configure: active (default, the service of
+#   # the default route), all (every enabled service) or a list of names
+#   # ("*" wildcards allowed). Services that come up later (Ethernet dock,
+#   # VPN) are added while the proxy is enabled and restored on disable.
+#   services: all
+#   # services: [Wi-Fi, "USB*LAN"]
+#   # Hosts that skip the proxy for every profile (profiles can add more with
+#   # their own bypass_hosts). Written to the OS bypass list and passed to
+#   # mitmproxy as ignore_hosts. Network ranges like 10.0.0.0/8 are OS-only.
+#   bypass_hosts:
+#     - "*.okta.com"
+#     - "*.zoom.us"
+#     - registry.npmjs.org
+#   # Checks every 5 seconds that the proxy host, port and bypass list (or
+#   # PAC URL) are still the ones we applied. on_change: alert (default, show
+#   # it in the status line), reassert (apply ours again) or ignore.
+#   # when_stopped: keep (default) or disable (restore the previous settings
+#   # when mitmproxy has not been running for 10 seconds).
+#   watchdog:
+#     on_change: reassert
+#     when_stopped: disable
+system_proxy: {}
+
+# mitmproxy CA created by the controller when ~/.mitmproxy has none (before
+# the first start, "Install CA Certificate" or "cert generate"). The tray
+# warns expiry_warning_days before the CA expires. "Expose CA for Devices"
+# serves it on the LAN for export_timeout_minutes or until the first download.
+#
+# ca:
+#   key_type: rsa-2048     # rsa-2048 (default), rsa-3072, rsa-4096, ecdsa-p256, ecdsa-p384
+#   validity_days: 3650
+#   common_name: mitmproxy
+#   organization: mitmproxy
+#   expiry_warning_days: 30
+#   export_timeout_minutes: 10
+#   # CA lists of developer runtimes, updated on install, rotation and
+#   # removal next to the OS store ("cert target" manages them alone).
+#   trust_targets:
+#     - type: jvm               # cacerts of $JAVA_HOME (or java_home:, path:)
+#     - type: pem_bundle
+#       name: api-venv
+#       path: ~/src/api/.venv/lib/python3.12/site-packages/certifi/cacert.pem
+ca: {}
+`
+
+type controllerSettings struct {
+	ProfileSources []profileSource     `yaml:"profile_sources"`
+	Upstream       upstreamSettings    `yaml:"upstream"`
+	SystemProxy    systemProxySettings `yaml:"system_proxy"`
+	CA             caSettings          `yaml:"ca"`
+}
+
+type systemProxySettings struct {
+	Mode        string           `yaml:"mode"`
+	PACPort     int              `yaml:"pac_port"`
+	Recovery    string           `yaml:"recovery"`
+	Services    serviceSelection `yaml:"services"`
+	BypassHosts []string         `yaml:"bypass_hosts"`
+	Watchdog    watchdogSettings `yaml:"watchdog"`
+}
+
+// serviceSelection is system_proxy.services: "active", "all" or a list of
+// network service names.
+type serviceSelection struct {
+	All   bool
+	Names []string
+}
+
+func (s *serviceSelection) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		switch strings.ToLower(strings.TrimSpace(value.Value)) {
+		case "", "active":
+			*s = serviceSelection{}
+		case "all":
+			*s = serviceSelection{All: true}
+		default:
+			*s = serviceSelection{Names: []string{value.Value}}
+		}
+		return nil
+	case yaml.SequenceNode:
+		*s = serviceSelection{}
+		return value.Decode(&s.Names)
+	default:
+		return fmt.Errorf("line %d: services must be active, all or a list of service names", value.Line)
+	}
+}
+
+var (
+	appSettings      controllerSettings
+	settingsWarnings []string
+)
+
+func getSettingsPath() string {
+	return filepath.Join(getControllerDataDirectory(), "settings.yaml")
+}
+
+// loadSettingsFromDisk refreshes appSettings. A malformed settings file keeps
+// the defaults and is reported through settingsWarnings instead of failing.
+func loadSettingsFromDisk() {
+	appSettings = controllerSettings{}
+	settingsWarnings = nil
+
+	content, err := os.ReadFile(getSettingsPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			settingsWarnings = append(settingsWarnings, fmt.Sprintf("settings.yaml: %v", err))
+		}
+		return
+	}
+
+	var parsed controllerSettings
+	if err := yaml.Unmarshal(content, &parsed); err != nil {
+		settingsWarnings = append(settingsWarnings, fmt.Sprintf("settings.yaml: %v", err))
+		return
+	}
+	appSettings = parsed
+}
+
+func ensureSettingsFileExists() (string, error) {
+	if err := os.MkdirAll(getControllerDataDirectory(), 0755); err != nil {
+		return "", err
+	}
+
+	settingsPath := getSettingsPath()
+	f, err := os.OpenFile(settingsPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return settingsPath, nil
+		}
+		return "", err
+	}
+	if _, err := f.WriteString(settingsTemplate); err != nil {
+		f.Close()
+		return "", err
+	}
+	return settingsPath, f.Close()
+}
+
+func expandHomePath(path string) string {
+	if path == "~" || (len(path) > 1 && path[0] == '~' && (path[1] == '/' || path[1] == '\\')) {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[1:])
+		}
+	}
+	return path
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CLI tools and test runners mostly ignore the OS proxy. exec and env point
+// them at a mitmproxy instance through the conventional environment
+// variables instead; status --prompt feeds shell prompts.
+
+const caBundleName = "ca-bundle.pem"
+
+// systemCABundles are the OS certificate bundles appended to the mitmproxy CA
+// so hosts that bypass the proxy still verify when a tool replaces its trust
+// store with SSL_CERT_FILE, REQUESTS_CA_BUNDLE or CURL_CA_BUNDLE.
+var systemCABundles = []string{
+	"/etc/ssl/cert.pem",                  // macOS, Alpine
+	"/etc/ssl/certs/ca-certificates.crt", // Debian, Ubuntu
+	"/etc/pki/tls/certs/ca-bundle.crt",   // Fedora, RHEL
+}
+
+// proxyEnvironmentNames are the variables exec sets and env prints. Both
+// upper- and lowercase proxy names are set since curl only reads http_proxy
+// in lowercase.
+var proxyEnvironmentNames = []string{
+	"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy", "NO_PROXY", "no_proxy",
+	"SSL_CERT_FILE", "REQUESTS_CA_BUNDLE", "CURL_CA_BUNDLE", "NODE_EXTRA_CA_CERTS",
+	"MITM_CONTROLLER_PROFILE",
+}
+
+type envVar struct {
+	Name  string
+	Value string
+}
+
+// shellInstance is the instance exec and env point at. stop is set when the
+// instance was started by this process and has to be stopped again.
+type shellInstance struct {
+	controlInstance
+	stop func()
+}
+
+// getCABundlePath is the bundle for a confdir; named confdirs get their own
+// so instances with different CAs can run side by side.
+func getCABundlePath(confdir string) string {
+	if confdir == getMitmHomeDirectory() {
+		return filepath.Join(getControllerDataDirectory(), caBundleName)
+	}
+	return filepath.Join(getControllerDataDirectory(), "ca-bundle-"+filepath.Base(confdir)+".pem")
+}
+
+// findShellInstance returns the running instance of profileID (the primary
+// one if empty) from the tray app. With start set, a missing instance is
+// started by the tray app, or by this process if the tray app is not running.
+func findShellInstance(profileID string, start bool) (shellInstance, error) {
+	lookupID := profileID
+	if lookupID == "" {
+		lookupID = selectedProfileID
+	}
+	if profile, ok := getProfileByID(lookupID); ok && !modeAcceptsProxyClients(profileModeName(profile)) {
+		return shellInstance{}, fmt.Errorf("%s runs in %s mode and takes no proxy clients", profile.Name, profileModeName(profile))
+	}
+
+	var status controlStatus
+	if err := controlRequest("GET", "/v1/status", nil, &status); err == nil {
+		for _, inst := range status.Instances {
+			if (profileID == "" && inst.Primary) || inst.ProfileID == profileID {
+				return shellInstance{controlInstance: inst}, nil
+			}
+		}
+		if !start {
+			return shellInstance{}, fmt.Errorf("no mitmproxy instance running for %s", describeProfileArg(profileID))
+		}
+
+		var started controlInstance
+		if err := controlRequestTimeout(controlStartTimeout, "POST", "/v1/instances", controlStartRequest{ProfileID: profileID}, &started); err != nil {
+			return shellInstance{}, err
+		}
+		return shellInstance{controlInstance: started}, nil
+	}
+
+	if !start {
+		return shellInstance{}, fmt.Errorf("no mitmproxy instance running (the controller is not running)")
+	}
+
+	// No tray app: run an instance owned by this process.
+	if profileID == "" {
+		profileID = selectedProfileID
+	}
+	profile, ok := getProfileByID(profileID)
+	if !ok {
+		return shellInstance{}, fmt.Errorf("profile %q not found", profileID)
+	}
+	result := startProfileInstance(profile)
+	inst, ok := getInstance(profile.ID)
+	if !ok {
+		return shellInstance{}, fmt.Errorf("%s", result)
+	}
+	return shellInstance{
+		controlInstance: newControlInstance(inst),
+		stop:            func() { stopProfileInstance(profile.ID) },
+	}, nil
+}
+
+func describeProfileArg(profileID string) string {
+	if profileID == "" {
+		return "the selected profile"
+	}
+	return "profile " + profileID
+}
+
+// waitForProxyPort waits until a freshly started mitmproxy accepts
+// connections, which also means it has created its CA.
+func waitForProxyPort(port string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(proxyHost, port), 500*time.Millisecond)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("mitmproxy is not accepting connections on port %s", port)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// writeCABundle writes the CA of a confdir followed by the first system
+// bundle found and returns its path.
+func writeCABundle(confdir string) (string, error) {
+	if _, err := ensureConfdirCA(confdir); err != nil {
+		return "", fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	ca, err := os.ReadFile(caCertPEMPath(confdir))
+	if err != nil {
+		return "", fmt.Errorf("mitmproxy CA not found at %s", caCertPEMPath(confdir))
+	}
+
+	var bundle bytes.Buffer
+	bundle.Write(bytes.TrimSpace(ca))
+	bundle.WriteString("\n")
+	for _, path := range systemCABundles {
+		if system, err := os.ReadFile(path); err == nil {
+			bundle.Write(system)
+			break
+		}
+	}
+
+	if err := os.MkdirAll(getControllerDataDirectory(), 0755); err != nil {
+		return "", err
+	}
+	path := getCABundlePath(confdir)
+	if err := os.WriteFile(path, bundle.Bytes(), 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// proxyEnvironment returns the proxy and CA variables for an instance, in
+// the order of proxyEnvironmentNames.
+func proxyEnvironment(inst controlInstance) ([]envVar, error) {
+	confdir := profileConfdirByID(inst.ProfileID)
+	bundle, err := writeCABundle(confdir)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyURL := "http://" + net.JoinHostPort(proxyHost, inst.ProxyPort)
+	noProxy := strings.Join(noProxyHosts(inst.ProfileID), ",")
+	values := map[string]string{
+		"HTTP_PROXY":              proxyURL,
+		"HTTPS_PROXY":             proxyURL,
+		"http_proxy":              proxyURL,
+		"https_proxy":             proxyURL,
+		"NO_PROXY":                noProxy,
+		"no_proxy":                noProxy,
+		"SSL_CERT_FILE":           bundle,
+		"REQUESTS_CA_BUNDLE":      bundle,
+		"CURL_CA_BUNDLE":          bundle,
+		"NODE_EXTRA_CA_CERTS":     caCertPEMPath(confdir),
+		"MITM_CONTROLLER_PROFILE": inst.ProfileID,
+	}
+
+	env := make([]envVar, 0, len(proxyEnvironmentNames))
+	for _, name := range proxyEnvironmentNames {
+		env = append(env, envVar{Name: name, Value: values[name]})
+	}
+	return env, nil
+}
+
+// noProxyHosts converts loopback and the profile's bypass hosts to NO_PROXY
+// syntax, where ".example.com" matches subdomains.
+func noProxyHosts(profileID string) []string {
+	profile, _ := getProfileByID(profileID)
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	for _, host := range bypassHostsFor(profile) {
+		if host == "<local>" {
+			continue
+		}
+		hosts = append(hosts, strings.TrimPrefix(host, "*"))
+	}
+	return mergeHostLists(hosts)
+}
+
+// shellNames are the shells env can print statements for.
+var shellNames = []string{"bash", "zsh", "fish", "powershell"}
+
+// defaultShell guesses the shell from $SHELL, or PowerShell on Windows.
+func defaultShell() string {
+	if shell := filepath.Base(os.Getenv("SHELL")); shell == "zsh" || shell == "fish" || shell == "bash" {
+		return shell
+	}
+	if runtime.GOOS == "windows" {
+		return "powershell"
+	}
+	return "bash"
+}
+
+func formatEnvExport(shell string, v envVar) string {
+	switch shell {
+	case "fish":
+		value := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v.Value)
+		return fmt.Sprintf("set -gx %s '%s';", v.Name, value)
+	case "powershell":
+		return fmt.Sprintf("$env:%s = '%s'", v.Name, strings.ReplaceAll(v.Value, "'", "''"))
+	default:
+		return fmt.Sprintf("export %s='%s'", v.Name, strings.ReplaceAll(v.Value, "'", `'\''`))
+	}
+}
+
+func formatEnvUnset(shell, name string) string {
+	switch shell {
+	case "fish":
+		return fmt.Sprintf("set -e %s;", name)
+	case "powershell":
+		return fmt.Sprintf("Remove-Item Env:%s -ErrorAction SilentlyContinue", name)
+	default:
+		return "unset " + name
+	}
+}
+
+// formatPrompt expands {profile}, {name}, {port} and {instances} in a
+// status --prompt format.
+func formatPrompt(format string, status controlStatus) string {
+	port := status.ProxyPort
+	for _, inst := range status.Instances {
+		if inst.Primary {
+			port = inst.ProxyPort
+		}
+	}
+	return strings.NewReplacer(
+		"{profile}", status.ProfileID,
+		"{name}", status.ProfileName,
+		"{port}", port,
+		"{instances}", strconv.Itoa(len(status.Instances)),
+	).Replace(format)
+}
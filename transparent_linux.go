@@ -0,0 +1,485 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Transparent mode on Linux: mitmproxy reads the original destination of
+// connections that netfilter redirected to its port. The controller installs
+// that redirect in a table (nftables) or chain (iptables) of its own, scoped
+// to a user, a cgroup or an incoming interface, and turns on forwarding for
+// the interface case. Before anything is applied the commands that undo it
+// are written to transparent/<profile>.json, so rules left behind by a crash
+// are removed at the next launch or by "proxy restore". Forwarding is shared
+// by all interface instances: transparent/forwarding.json keeps the values
+// found before the first one and the profiles that still need it.
+
+var transparentMu sync.Mutex
+
+var defaultTransparentPorts = []int{80, 443}
+
+// Interface names and cgroup paths end up in nft scripts and shell commands.
+var (
+	transparentInterfacePattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,15}$`)
+	transparentCgroupPattern    = regexp.MustCompile(`^/?[A-Za-z0-9_.@:-]+(/[A-Za-z0-9_.@:-]+)*/?$`)
+)
+
+// forwardingSysctls are set while a profile redirects traffic arriving on an
+// interface; the previous values are restored when the last such profile
+// stops. ICMP redirects would tell clients to bypass this host.
+var forwardingSysctls = []struct{ key, value string }{
+	{"net.ipv4.ip_forward", "1"},
+	{"net.ipv4.conf.all.send_redirects", "0"},
+}
+
+type transparentState struct {
+	ProfileID  string `json:"profile_id"`
+	ListenPort string `json:"listen_port,omitempty"`
+	// PID is the controller that applied the rules.
+	PID      int      `json:"pid,omitempty"`
+	Backend  string   `json:"backend"`
+	Teardown []string `json:"teardown"`
+	// Forwarding is set when the profile holds a reference on the shared
+	// forwarding sysctls.
+	Forwarding bool `json:"forwarding,omitempty"`
+}
+
+// forwardingState is the shared record of the forwarding sysctls: the
+// values before the controller changed them and the profiles using them.
+type forwardingState struct {
+	Previous map[string]string `json:"previous"`
+	Profiles []string          `json:"profiles"`
+}
+
+func getTransparentStateDirectory() string {
+	return filepath.Join(getControllerDataDirectory(), "transparent")
+}
+
+func forwardingStatePath() string {
+	return filepath.Join(getTransparentStateDirectory(), "forwarding.json")
+}
+
+func transparentStatePath(profileID string) string {
+	return filepath.Join(getTransparentStateDirectory(), strings.ReplaceAll(profileID, "/", "-")+".json")
+}
+
+// setupTransparentRedirect installs the redirect rules of a transparent
+// profile in one privileged call. If any command fails, what was applied is
+// undone in the same call.
+func setupTransparentRedirect(inst *mitmInstance) error {
+	transparentMu.Lock()
+	defer transparentMu.Unlock()
+
+	t := inst.Profile.Transparent
+	if t.User == "" && t.Cgroup == "" && t.Interface == "" {
+		return fmt.Errorf("transparent mode needs transparent.user, transparent.cgroup or transparent.interface")
+	}
+	if t.Interface != "" && !transparentInterfacePattern.MatchString(t.Interface) {
+		return fmt.Errorf("invalid transparent.interface %q", t.Interface)
+	}
+	if t.Cgroup != "" && (!transparentCgroupPattern.MatchString(t.Cgroup) || strings.Contains("/"+t.Cgroup+"/", "/../")) {
+		return fmt.Errorf("invalid transparent.cgroup %q", t.Cgroup)
+	}
+	uid := ""
+	if t.User != "" {
+		var err error
+		if uid, err = lookupUID(t.User); err != nil {
+			return err
+		}
+		if uid == strconv.Itoa(os.Getuid()) {
+			return fmt.Errorf("transparent.user %s runs mitmproxy itself; its traffic would loop", t.User)
+		}
+	}
+
+	ports := t.Ports
+	if len(ports) == 0 {
+		ports = defaultTransparentPorts
+	}
+	for _, port := range ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid transparent port %d", port)
+		}
+	}
+
+	backend, err := transparentBackend(t.Backend)
+	if err != nil {
+		return err
+	}
+	var apply, teardown []string
+	if backend == "nftables" {
+		apply, teardown = nftablesRedirect(inst.ProxyPort, ports, uid, t)
+	} else {
+		apply, teardown = iptablesRedirect(inst.ProxyPort, ports, uid, t)
+	}
+	state := transparentState{ProfileID: inst.Profile.ID, ListenPort: inst.ProxyPort, PID: os.Getpid(), Backend: backend, Teardown: teardown}
+	if t.Interface != "" {
+		// Take the reference before applying, so the originals are read
+		// before this profile changes them.
+		if err := acquireForwarding(inst.Profile.ID); err != nil {
+			return fmt.Errorf("failed to save forwarding state: %w", err)
+		}
+		state.Forwarding = true
+		apply = append(apply, forwardingCommands()...)
+	}
+
+	// Record the teardown before applying anything, so a crash halfway is
+	// still cleaned up.
+	if err := saveTransparentState(state); err != nil {
+		_ = releaseForwarding(inst.Profile.ID)
+		return fmt.Errorf("failed to save transparent mode state: %w", err)
+	}
+
+	script := fmt.Sprintf("( set -e; %s ) || { %s; exit 1; }", strings.Join(apply, "; "), strings.Join(teardown, "; "))
+	if out, err := runPrivileged(script); err != nil {
+		_ = os.Remove(transparentStatePath(inst.Profile.ID))
+		_ = releaseForwarding(inst.Profile.ID)
+		return fmt.Errorf("failed to set up %s redirect: %v %s", backend, err, out)
+	}
+	return nil
+}
+
+// teardownTransparentRedirect removes the rules of a profile's instance on
+// listenPort. Rules of a newer instance of the profile are left alone. The
+// state file is kept when that fails so the next launch tries again.
+func teardownTransparentRedirect(profileID, listenPort string) error {
+	transparentMu.Lock()
+	defer transparentMu.Unlock()
+
+	state, ok := loadTransparentState(transparentStatePath(profileID))
+	if !ok || (state.ListenPort != "" && state.ListenPort != listenPort) {
+		return nil
+	}
+	return runTransparentTeardown(state, transparentStatePath(profileID))
+}
+
+// recoverTransparentRedirects removes rules of profiles that are not running
+// in this process, which were left behind by a crash or kill. Rules of a
+// controller that is still running (the tray, when "proxy restore" runs from
+// a terminal) are left alone.
+func recoverTransparentRedirects() string {
+	transparentMu.Lock()
+	defer transparentMu.Unlock()
+
+	if err := controlRequest("GET", "/v1/status", nil, nil); err == nil {
+		return ""
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(getTransparentStateDirectory(), "*.json"))
+	var removed, failed []string
+	for _, path := range paths {
+		state, ok := loadTransparentState(path)
+		if !ok {
+			continue
+		}
+		if _, running := getInstance(state.ProfileID); running || isOtherControllerAlive(state.PID) {
+			continue
+		}
+		if err := runTransparentTeardown(state, path); err != nil {
+			failed = append(failed, state.ProfileID)
+		} else {
+			removed = append(removed, state.ProfileID)
+		}
+	}
+
+	// A crash between taking the forwarding reference and saving the
+	// profile's state leaves a reference nothing would release.
+	if forwarding, ok := loadForwardingState(); ok {
+		for _, id := range forwarding.Profiles {
+			if _, running := getInstance(id); running {
+				continue
+			}
+			if _, err := os.Stat(transparentStatePath(id)); err == nil {
+				continue
+			}
+			if err := releaseForwarding(id); err != nil {
+				failed = append(failed, id)
+			}
+		}
+	}
+
+	switch {
+	case len(failed) > 0:
+		return fmt.Sprintf("Failed to remove transparent mode rules of %s", strings.Join(failed, ", "))
+	case len(removed) > 0:
+		return fmt.Sprintf("Removed transparent mode rules left by %s", strings.Join(removed, ", "))
+	}
+	return ""
+}
+
+// isOtherControllerAlive reports whether pid is a live process other than
+// this one. State files written before the PID was recorded have none.
+func isOtherControllerAlive(pid int) bool {
+	if pid <= 0 || pid == os.Getpid() {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	return err == nil && isProcessAlive(p)
+}
+
+func runTransparentTeardown(state transparentState, path string) error {
+	if out, err := runPrivileged(strings.Join(state.Teardown, "; ")); err != nil {
+		return fmt.Errorf("failed to remove %s redirect: %v %s", state.Backend, err, out)
+	}
+	_ = os.Remove(path)
+	if state.Forwarding {
+		return releaseForwarding(state.ProfileID)
+	}
+	return nil
+}
+
+func transparentBackend(configured string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(configured)) {
+	case "", "auto":
+		if _, err := exec.LookPath("nft"); err == nil {
+			return "nftables", nil
+		}
+		if _, err := exec.LookPath("iptables"); err == nil {
+			return "iptables", nil
+		}
+		return "", fmt.Errorf("transparent mode needs nft or iptables")
+	case "nftables", "nft":
+		return "nftables", nil
+	case "iptables":
+		return "iptables", nil
+	default:
+		return "", fmt.Errorf("unknown transparent.backend %q (use auto, nftables or iptables)", configured)
+	}
+}
+
+// nftablesRedirect builds an ip table per instance port; deleting the table
+// removes every rule at once. Only IPv4 is redirected: instances listen on
+// 127.0.0.1, and a redirect to ::1 would reach nothing. Cgroup rules skip
+// the controller's own user, whose mitmproxy may run in the same cgroup.
+func nftablesRedirect(listenPort string, ports []int, uid string, t transparentSettings) ([]string, []string) {
+	table := "mitm_controller_" + listenPort
+	dports := make([]string, len(ports))
+	for i, port := range ports {
+		dports[i] = strconv.Itoa(port)
+	}
+	match := fmt.Sprintf("tcp dport { %s } redirect to :%s", strings.Join(dports, ", "), listenPort)
+
+	var rules []string
+	if uid != "" || t.Cgroup != "" {
+		rules = append(rules, fmt.Sprintf("add chain ip %s output { type nat hook output priority -100 ; }", table))
+		if uid != "" {
+			rules = append(rules, fmt.Sprintf("add rule ip %s output oifname != \"lo\" meta skuid %s %s", table, uid, match))
+		}
+		if t.Cgroup != "" {
+			path := strings.Trim(t.Cgroup, "/")
+			level := strings.Count(path, "/") + 1
+			rules = append(rules, fmt.Sprintf("add rule ip %s output oifname != \"lo\" meta skuid != %d socket cgroupv2 level %d \"%s\" %s", table, os.Getuid(), level, path, match))
+		}
+	}
+	if t.Interface != "" {
+		rules = append(rules,
+			fmt.Sprintf("add chain ip %s prerouting { type nat hook prerouting priority -100 ; }", table),
+			fmt.Sprintf("add rule ip %s prerouting iifname \"%s\" %s", table, t.Interface, match),
+		)
+	}
+
+	var script strings.Builder
+	fmt.Fprintf(&script, "add table ip %s\n", table)
+	for _, rule := range rules {
+		script.WriteString(rule + "\n")
+	}
+	apply := []string{fmt.Sprintf("printf '%%s' %s | nft -f -", shellQuote(script.String()))}
+	teardown := []string{fmt.Sprintf("nft delete table ip %s 2>/dev/null || true", table)}
+	return apply, teardown
+}
+
+// iptablesRedirect builds an IPv4 nat chain per instance port, see
+// nftablesRedirect; the OUTPUT/PREROUTING jumps are removed first on
+// teardown.
+func iptablesRedirect(listenPort string, ports []int, uid string, t transparentSettings) ([]string, []string) {
+	chain := "MITM-CONTROLLER-" + listenPort
+	dports := make([]string, len(ports))
+	for i, port := range ports {
+		dports[i] = strconv.Itoa(port)
+	}
+
+	var jumps []string
+	if uid != "" {
+		jumps = append(jumps, fmt.Sprintf("OUTPUT ! -o lo -m owner --uid-owner %s -j %s", uid, chain))
+	}
+	if t.Cgroup != "" {
+		jumps = append(jumps, fmt.Sprintf("OUTPUT ! -o lo -m owner ! --uid-owner %d -m cgroup --path %s -j %s", os.Getuid(), shellQuote(t.Cgroup), chain))
+	}
+	if t.Interface != "" {
+		jumps = append(jumps, fmt.Sprintf("PREROUTING -i %s -j %s", shellQuote(t.Interface), chain))
+	}
+
+	apply := []string{
+		fmt.Sprintf("iptables -t nat -N %s", chain),
+		fmt.Sprintf("iptables -t nat -A %s -p tcp -m multiport --dports %s -j REDIRECT --to-ports %s", chain, strings.Join(dports, ","), listenPort),
+	}
+	var teardown []string
+	for _, jump := range jumps {
+		apply = append(apply, fmt.Sprintf("iptables -t nat -A %s", jump))
+		teardown = append(teardown, fmt.Sprintf("iptables -t nat -D %s 2>/dev/null", jump))
+	}
+	teardown = append(teardown,
+		fmt.Sprintf("iptables -t nat -F %s 2>/dev/null", chain),
+		fmt.Sprintf("iptables -t nat -X %s 2>/dev/null", chain),
+	)
+	return apply, append(teardown, "true")
+}
+
+// forwardingCommands sets forwardingSysctls. Keys missing on this kernel (no
+// IPv6) are skipped.
+func forwardingCommands() []string {
+	var apply []string
+	for _, sysctl := range forwardingSysctls {
+		if _, err := os.Stat(sysctlPath(sysctl.key)); err != nil {
+			continue
+		}
+		apply = append(apply, fmt.Sprintf("sysctl -q -w %s=%s", sysctl.key, sysctl.value))
+	}
+	return apply
+}
+
+func sysctlPath(key string) string {
+	return filepath.Join("/proc/sys", strings.ReplaceAll(key, ".", "/"))
+}
+
+// acquireForwarding adds a profile to the forwarding state. The first one
+// records the current sysctl values; later ones keep them, since the
+// controller has changed them by then.
+func acquireForwarding(profileID string) error {
+	state, ok := loadForwardingState()
+	if !ok {
+		state = forwardingState{Previous: map[string]string{}}
+		for _, sysctl := range forwardingSysctls {
+			if previous, err := os.ReadFile(sysctlPath(sysctl.key)); err == nil {
+				state.Previous[sysctl.key] = strings.TrimSpace(string(previous))
+			}
+		}
+	}
+	for _, id := range state.Profiles {
+		if id == profileID {
+			return nil
+		}
+	}
+	state.Profiles = append(state.Profiles, profileID)
+	return saveForwardingState(state)
+}
+
+// releaseForwarding removes a profile from the forwarding state and, when it
+// was the last one, restores the recorded sysctl values. The state is kept
+// when that fails so the next teardown tries again.
+func releaseForwarding(profileID string) error {
+	state, ok := loadForwardingState()
+	if !ok {
+		return nil
+	}
+	remaining := state.Profiles[:0]
+	for _, id := range state.Profiles {
+		if id != profileID {
+			remaining = append(remaining, id)
+		}
+	}
+	state.Profiles = remaining
+	if len(state.Profiles) > 0 {
+		return saveForwardingState(state)
+	}
+
+	var restore []string
+	for _, sysctl := range forwardingSysctls {
+		if previous, ok := state.Previous[sysctl.key]; ok {
+			restore = append(restore, fmt.Sprintf("sysctl -q -w %s=%s", sysctl.key, shellQuote(previous)))
+		}
+	}
+	if len(restore) > 0 {
+		if out, err := runPrivileged(strings.Join(restore, "; ")); err != nil {
+			_ = saveForwardingState(state)
+			return fmt.Errorf("failed to restore forwarding: %v %s", err, out)
+		}
+	}
+	return os.Remove(forwardingStatePath())
+}
+
+func loadForwardingState() (forwardingState, bool) {
+	content, err := os.ReadFile(forwardingStatePath())
+	if err != nil {
+		return forwardingState{}, false
+	}
+	var state forwardingState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return forwardingState{}, false
+	}
+	if state.Previous == nil {
+		state.Previous = map[string]string{}
+	}
+	return state, true
+}
+
+func saveForwardingState(state forwardingState) error {
+	if err := os.MkdirAll(getTransparentStateDirectory(), 0755); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(forwardingStatePath(), content, 0644)
+}
+
+func lookupUID(name string) (string, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return name, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", fmt.Errorf("transparent.user: %w", err)
+	}
+	return u.Uid, nil
+}
+
+// runPrivileged runs a shell script as root, through pkexec unless the
+// controller already is root.
+func runPrivileged(script string) (string, error) {
+	cmd := exec.Command("pkexec", "sh", "-c", script)
+	if os.Geteuid() == 0 {
+		cmd = exec.Command("sh", "-c", script)
+	}
+	out, err := cmd.CombinedOutput()
+	return string(bytes.TrimSpace(out)), err
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+func saveTransparentState(state transparentState) error {
+	if err := os.MkdirAll(getTransparentStateDirectory(), 0755); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(transparentStatePath(state.ProfileID), content, 0644)
+}
+
+func loadTransparentState(path string) (transparentState, bool) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return transparentState{}, false
+	}
+	var state transparentState
+	if err := json.Unmarshal(content, &state); err != nil || len(state.Teardown) == 0 {
+		return transparentState{}, false
+	}
+	return state, true
+}
@@ -0,0 +1,18 @@
+//go:build darwin || windows
+
+package main
+
+// Redirect rules for transparent mode are only managed on Linux. On Windows
+// mitmproxy redirects traffic itself; on macOS pf is configured by the user.
+
+func setupTransparentRedirect(inst *mitmInstance) error {
+	return nil
+}
+
+func teardownTransparentRedirect(profileID, listenPort string) error {
+	return nil
+}
+
+func recoverTransparentRedirects() string {
+	return ""
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// upstreamKeychainService is the keychain / Credential Manager entry that holds
+// upstream proxy passwords, keyed by username.
+const upstreamKeychainService = "mitmproxy-controller-upstream"
+
+type upstreamSettings struct {
+	URL        string `yaml:"url"`
+	Username   string `yaml:"username"`
+	Keychain   bool   `yaml:"keychain"`
+	AutoDetect bool   `yaml:"auto_detect"`
+}
+
+// systemProxyEndpoint is the OS-level HTTP proxy as read from the platform
+// settings.
+type systemProxyEndpoint struct {
+	Enabled bool   `json:"enabled"`
+	Host    string `json:"host"`
+	Port    string `json:"port"`
+}
+
+func (e systemProxyEndpoint) isController() bool {
+	return e.Host == proxyHost && isControllerProxyPort(e.Port)
+}
+
+func (e systemProxyEndpoint) url() string {
+	return "http://" + net.JoinHostPort(e.Host, e.Port)
+}
+
+// resolvedUpstream is the upstream proxy applied to a mitmproxy run.
+type resolvedUpstream struct {
+	URL    string
+	Auth   string
+	Origin string
+}
+
+func (u resolvedUpstream) String() string {
+	if u.URL == "" && u.Origin != "" {
+		return u.Origin
+	}
+	if u.URL == "" {
+		return "direct"
+	}
+	return fmt.Sprintf("%s (%s)", redactURL(u.URL), u.Origin)
+}
+
+// detectSystemUpstream returns the proxy the system would use without the
+// controller: the live setting, or the one from the proxy snapshot while ours
+// is active.
+func detectSystemUpstream() (systemProxyEndpoint, bool) {
+	current, err := readSystemWebProxy()
+	if err == nil && !current.isController() && !isControllerPACActive() {
+		return current, current.Enabled && current.Host != ""
+	}
+
+	snapshot, ok := loadProxySnapshot()
+	if !ok {
+		return systemProxyEndpoint{}, false
+	}
+	previous := snapshot.Config.webProxy()
+	return previous, previous.Enabled && previous.Host != "" && !previous.isController()
+}
+
+// resolveUpstream picks the upstream proxy for a profile. Precedence:
+// profile "upstream" > controller url > auto-detected system proxy.
+func resolveUpstream(profile ServiceProfile) (resolvedUpstream, error) {
+	if profileOwnsMode(profile) {
+		return resolvedUpstream{Origin: "profile mode"}, nil
+	}
+	settings := appSettings.Upstream
+
+	var rawURL, origin string
+	switch strings.ToLower(profile.Upstream) {
+	case "none", "direct", "off":
+		return resolvedUpstream{}, nil
+	case "", "auto", "inherit":
+		if settings.URL != "" {
+			rawURL, origin = settings.URL, "settings"
+		} else if settings.AutoDetect {
+			if detected, ok := detectSystemUpstream(); ok {
+				rawURL, origin = detected.url(), "auto-detected"
+			}
+		}
+	default:
+		rawURL, origin = profile.Upstream, "profile"
+	}
+
+	if rawURL == "" {
+		return resolvedUpstream{}, nil
+	}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return resolvedUpstream{}, fmt.Errorf("invalid upstream proxy URL %q", redactURL(rawURL))
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return resolvedUpstream{}, fmt.Errorf("unsupported upstream proxy scheme %q", parsed.Scheme)
+	}
+
+	username := parsed.User.Username()
+	password, hasPassword := parsed.User.Password()
+	if username == "" && origin != "profile" {
+		username = settings.Username
+	}
+	if username != "" && !hasPassword && settings.Keychain {
+		password, err = lookupKeychainPassword(upstreamKeychainService, username)
+		if err != nil {
+			return resolvedUpstream{}, fmt.Errorf("upstream password for %q: %w", username, err)
+		}
+	}
+
+	resolved := resolvedUpstream{
+		URL:    fmt.Sprintf("%s://%s", parsed.Scheme, parsed.Host),
+		Origin: origin,
+	}
+	if username != "" {
+		resolved.Auth = username + ":" + password
+	}
+	return resolved, nil
+}
+
+// profileOwnsMode reports whether the profile sets a mode other than the
+// default regular proxy; such profiles keep full control over --mode.
+func profileOwnsMode(profile ServiceProfile) bool {
+	mode := strings.ToLower(strings.TrimSpace(profile.Mode))
+	return mode != "" && mode != "regular"
+}
+
+// upstreamAuthEnv carries the upstream credentials to mitmproxy. Unlike
+// argv, another user cannot read a process's environment.
+const upstreamAuthEnv = "MITM_CONTROLLER_UPSTREAM_AUTH"
+
+// upstreamAuthAddon sets upstream_auth from the environment and removes the
+// variable, so processes started by mitmproxy do not inherit it.
+const upstreamAuthAddon = `# Written by mitmproxy-controller: sets upstream_auth from the environment
+# so the upstream proxy credentials stay off the command line.
+import os
+
+from mitmproxy import ctx
+
+
+def load(loader):
+    auth = os.environ.pop("` + upstreamAuthEnv + `", "")
+    if auth:
+        ctx.options.upstream_auth = auth
+`
+
+// upstreamArgs returns the mitmproxy arguments that chain through upstream.
+// Credentials go through the environment (see upstreamEnv) and an addon
+// instead of --set upstream_auth.
+func upstreamArgs(profile ServiceProfile, upstream resolvedUpstream) ([]string, error) {
+	if profileOwnsMode(profile) || upstream.URL == "" {
+		return nil, nil
+	}
+
+	args := []string{"--mode", "upstream:" + upstream.URL}
+	if upstreamEnv(profile, upstream) != nil {
+		addon, err := ensureUpstreamAuthAddon()
+		if err != nil {
+			return nil, fmt.Errorf("failed to write upstream auth addon: %w", err)
+		}
+		args = append(args, "-s", addon)
+	}
+	return args, nil
+}
+
+// upstreamEnv returns the environment entry with the upstream credentials,
+// or nil when there are none or the profile sets upstream_auth itself.
+func upstreamEnv(profile ServiceProfile, upstream resolvedUpstream) []string {
+	if profileOwnsMode(profile) || upstream.URL == "" || upstream.Auth == "" {
+		return nil
+	}
+	if _, hasAuth := profile.SetOptions["upstream_auth"]; hasAuth {
+		return nil
+	}
+	return []string{upstreamAuthEnv + "=" + upstream.Auth}
+}
+
+// ensureUpstreamAuthAddon writes the addon to the data folder and returns
+// its path. It holds no credentials.
+func ensureUpstreamAuthAddon() (string, error) {
+	path := filepath.Join(getControllerDataDirectory(), "addons", "upstream_auth.py")
+	if current, err := os.ReadFile(path); err == nil && string(current) == upstreamAuthAddon {
+		return path, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return path, os.WriteFile(path, []byte(upstreamAuthAddon), 0644)
+}
+
+func redactURL(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.User == nil {
+		return raw
+	}
+	parsed.User = url.User(parsed.User.Username())
+	return parsed.String()
+}
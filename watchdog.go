@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// The proxy watchdog runs on every status poll while this process owns the
+// system proxy. It compares the live OS settings (host, port, bypass list or
+// PAC URL) with what the controller applied, because VPN clients and MDM
+// agents rewrite them silently, and follows system_proxy.watchdog:
+//
+//	on_change:    alert (default), reassert or ignore
+//	when_stopped: keep (default) or disable
+
+// watchdogStopGrace is how long mitmproxy may be stopped before
+// when_stopped: disable restores the previous proxy settings. It covers a
+// restart from a hook or the CLI.
+const watchdogStopGrace = 10 * time.Second
+
+type watchdogSettings struct {
+	OnChange    string `yaml:"on_change"`
+	WhenStopped string `yaml:"when_stopped"`
+}
+
+type proxyWatchdogState struct {
+	drift        []string
+	alerted      string
+	stoppedSince time.Time
+}
+
+var proxyWatchdog proxyWatchdogState
+
+// reconcileSystemProxy applies the watchdog policy and returns a status
+// message when it acted or found new drift. Only the proxy settings
+// themselves are read; the rest comes from the poll.
+func reconcileSystemProxy(poll pollState) string {
+	if !poll.OwnsProxy {
+		proxyWatchdog = proxyWatchdogState{}
+		return ""
+	}
+	policy := appSettings.SystemProxy.Watchdog
+
+	// While mitmproxy is stopped the proxy stays on the port it was enabled
+	// for rather than the default one.
+	port := poll.Marker.Port
+	if poll.MitmRunning {
+		port = systemProxyPort()
+		proxyWatchdog.stoppedSince = time.Time{}
+	} else {
+		if proxyWatchdog.stoppedSince.IsZero() {
+			proxyWatchdog.stoppedSince = time.Now()
+		}
+		if strings.EqualFold(policy.WhenStopped, "disable") && time.Since(proxyWatchdog.stoppedSince) >= watchdogStopGrace {
+			proxyWatchdog = proxyWatchdogState{}
+			if err := restoreSystemProxySnapshot(); err != nil {
+				return fmt.Sprintf("Failed to disable proxy while mitmproxy is stopped: %v", err)
+			}
+			return "Proxy disabled because mitmproxy is not running"
+		}
+	}
+
+	drift, err := checkSystemProxy(port)
+	if err != nil {
+		// Reading the settings can fail transiently during network changes.
+		return ""
+	}
+	if len(drift) == 0 {
+		proxyWatchdog.drift = nil
+		proxyWatchdog.alerted = ""
+		return ""
+	}
+
+	summary := strings.Join(drift, "; ")
+	switch strings.ToLower(policy.OnChange) {
+	case "ignore":
+		proxyWatchdog.drift = nil
+		return ""
+	case "reassert":
+		proxyWatchdog.drift = nil
+		if err := enableSystemProxy(); err != nil {
+			return fmt.Sprintf("Failed to re-apply proxy settings: %v", err)
+		}
+		_ = markProxyEnabled()
+		return fmt.Sprintf("Proxy settings re-applied (%s)", summary)
+	default:
+		proxyWatchdog.drift = drift
+		if summary == proxyWatchdog.alerted {
+			return ""
+		}
+		proxyWatchdog.alerted = summary
+		return fmt.Sprintf("Proxy changed externally: %s", summary)
+	}
+}
+
+// proxyDrift returns the differences found by the last watchdog run that
+// were left in place (on_change: alert).
+func proxyDrift() []string {
+	return proxyWatchdog.drift
+}
+
+// endpointDrift describes how a static proxy endpoint differs from ours, or
+// returns "" if it points at the controller on the expected port.
+func endpointDrift(actual systemProxyEndpoint, port string) string {
+	switch {
+	case !actual.Enabled:
+		return "is disabled"
+	case actual.Host == "":
+		return "has no server"
+	case actual.Host != proxyHost || actual.Port != port:
+		return "points at " + net.JoinHostPort(actual.Host, actual.Port)
+	}
+	return ""
+}
+
+// autoProxyDrift describes how an auto-proxy setting differs from our PAC
+// file. The version parameter is not compared; reconcilePACProxy owns it.
+func autoProxyDrift(pacURL string, enabled bool) string {
+	switch {
+	case !enabled:
+		return "is disabled"
+	case !isControllerPACURL(pacURL):
+		return "points at " + pacURL
+	}
+	return ""
+}
+
+// sameHostSet compares two bypass lists, ignoring order, case and blanks.
+func sameHostSet(a, b []string) bool {
+	set := func(hosts []string) map[string]bool {
+		m := map[string]bool{}
+		for _, host := range hosts {
+			if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+				m[host] = true
+			}
+		}
+		return m
+	}
+	left, right := set(a), set(b)
+	if len(left) != len(right) {
+		return false
+	}
+	for host := range left {
+		if !right[host] {
+			return false
+		}
+	}
+	return true
+}